@@ -1,71 +1,165 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	appsAPI "k8s.io/api/apps/v1"
 	coreAPI "k8s.io/api/core/v1"
-	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
 )
 
 // App is a Analytical Platform "app" consisting of a kubernetes
-// deployment, with a corresponding hostname and ingress
+// workload (e.g. a Deployment), with a corresponding hostname and ingress
 type App struct {
-	deployment *Deployment
-	host       string
-	ingress    *Ingress
-	logger     *log.Logger
-	service    *Service
+	host    string
+	ingress *Ingress
+	logger  *Logger
+	// path is the path requested, selecting the app when several share the
+	// host
+	path string
+	// resolver is the AppResolver which found the App's Ingress
+	resolver AppResolver
+	service  *Service
+	span     *Span
+	// workload runs the app's pods, e.g. a Deployment or a StatefulSet
+	workload Workload
+	// unidledAt is the time the App was unidled, see RemoveIdledMetadata
+	unidledAt time.Time
+	// group is the App's workload and the other workloads unidled together
+	// with it, in batches started one after the other, see unidleOrder
+	group [][]Workload
+	// scaledUp is the time each of the App's workloads scaled up from zero
+	// replicas by the unidling was scaled, see RecordColdStart
+	scaledUp map[Workload]time.Time
 }
 
 const (
-	// IdledLabel is a metadata label which indicates a Deployment is idled.
+	// IdledLabel is a metadata label which indicates a workload is idled.
 	IdledLabel = "mojanalytics.xyz/idled"
 	// IdledAtAnnotation is a metadata annotation which indicates the time a
-	// Deployment was idled and the number of replicas it had at that time,
+	// workload was idled and the number of replicas it had at that time,
 	// separated by a semicolon, eg: "2018-11-26T17:27:34;2".
 	IdledAtAnnotation = "mojanalytics.xyz/idled-at"
 	// ReplicasWhenUnidledAnnotation contains the number of replicas an app
 	// had before being idled
 	ReplicasWhenUnidledAnnotation = "mojanalytics.xyz/replicas-when-unidled"
+	// UnidledAtAnnotation is a metadata annotation which indicates the time
+	// (UTC) a workload was last unidled, eg: "2018-11-26T17:55:02". Idlers
+	// leave it alone for UnidleGracePeriod after that
+	UnidledAtAnnotation = "mojanalytics.xyz/unidled-at"
+	// UnidledByAnnotation contains the ID of the request which last unidled
+	// a workload
+	UnidledByAnnotation = "mojanalytics.xyz/unidled-by"
+	// ServiceSpecWhenUnidledAnnotation contains the JSON spec of the app's
+	// Service (type, selector, ports and session affinity) before it was
+	// idled, written by the idler
+	ServiceSpecWhenUnidledAnnotation = "mojanalytics.xyz/service-spec-when-unidled"
 	// UnidlerName is the name of the kubernetes Unidler ingress
 	UnidlerName = "unidler"
 	// UnidlerNs is the namespace of the kubernetes Unidler ingress
 	UnidlerNs = "default"
+	// UnidlerPort is the port of the unidler's Service, which idled apps'
+	// Ingresses and HTTPRoutes send the traffic to
+	UnidlerPort = 80
+	// StartingMessage is shown to the user while waiting for the app to start
+	StartingMessage = "Replicas restored. Starting app. This could take a few minutes..."
 )
 
-// NewApp constructs a new App and fetches the corresponding kubernetes ingress
-// and deployment
-func NewApp(host string) (app *App, err error) {
+// NewApp constructs a new App and fetches the corresponding kubernetes ingress,
+// workload and service for the given host and path. The App logs with the given
+// Logger, adding its details, and traces its operations as children of the
+// given Span (if not nil)
+func NewApp(host string, path string, logger *Logger, span *Span) (app *App, err error) {
 	app = &App{
 		host:   host,
-		logger: log.New(os.Stdout, "", log.LstdFlags|log.Lshortfile),
+		path:   path,
+		logger: logger.With(Fields{"host": host, "path": path}),
+		span:   span,
 	}
 
 	app.ingress, err = app.GetIngress()
 	if err != nil {
-		app.log("Ingress not found: %s", err)
-		return nil, fmt.Errorf("Ingress for your app not found.")
+		app.logError(err, "Ingress not found.")
+		return nil, userFriendlyLookupError("Ingress", err)
 	}
-	app.deployment, err = app.GetDeployment()
+	app.logger = app.logger.With(Fields{"namespace": app.ingress.Namespace})
+	app.span.SetAttributes(Fields{"namespace": app.ingress.Namespace})
+
+	app.workload, err = app.GetWorkload()
+	if err != nil {
+		app.logError(err, "Workload not found.")
+		return nil, userFriendlyLookupError("Workload", err)
+	}
+	app.logger = app.logger.With(Fields{"workload": app.workload.GetName(), "kind": workloadKind(app.workload)})
+	app.span.SetAttributes(Fields{"app": app.workload.GetName(), "kind": workloadKind(app.workload)})
+
+	group, err := app.GetGroup()
+	if err != nil {
+		app.logError(err, "App group not found.")
+		return nil, userFriendlyLookupError("Workloads group", err)
+	}
+	app.group, err = unidleOrder(group)
 	if err != nil {
-		app.log("Deployment not found: %s", err)
-		return nil, fmt.Errorf("Deployment for your app not found.")
+		app.logError(err, "Invalid dependencies in the app group.")
+		return nil, fmt.Errorf("Invalid dependencies between the components of your app: %s. Please contact the Analytical Platform team.", err)
 	}
+
 	app.service, err = app.GetService()
 	if err != nil {
-		app.log("Service not found: %s", err)
-		return nil, fmt.Errorf("Service for your app not found.")
+		app.logError(err, "Service not found.")
+		return nil, userFriendlyLookupError("Service", err)
 	}
 	return app, nil
 }
 
+// route returns the host and path the App was requested for
+func (a *App) route() Route {
+	return Route{Host: a.host, Path: a.path}
+}
+
+// userFriendlyLookupError returns the error shown to the user when the lookup
+// of one of the App's resources failed
+func userFriendlyLookupError(resource string, err error) error {
+	if ambiguous, ok := err.(*AmbiguousAppError); ok {
+		return fmt.Errorf("Several apps match %s (%s: %s). Please contact the Analytical Platform team.", ambiguous.Route, ambiguous.Resource, strings.Join(ambiguous.Matches, ", "))
+	}
+	return fmt.Errorf("%s for your app not found.", resource)
+}
+
 func (a *App) log(format string, args ...interface{}) {
-	a.logger.Printf("%s: %s", a.host, fmt.Sprintf(format, args...))
+	a.logger.Info(format, args...)
+}
+
+func (a *App) logError(err error, format string, args ...interface{}) {
+	a.logger.Error(err, format, args...)
+}
+
+// startSpan starts a span for an operation on the App, child of the App's span
+func (a *App) startSpan(name string) *Span {
+	span := a.span.Child(name)
+	attributes := Fields{"host": a.host}
+	if a.ingress != nil {
+		attributes["namespace"] = a.ingress.Namespace
+	}
+	if a.workload != nil {
+		attributes["app"] = a.workload.GetName()
+	}
+	span.SetAttributes(attributes)
+	return span
+}
+
+// finishSpan records the error (if any) on the span and ends it
+func finishSpan(span *Span, err error) {
+	if err != nil {
+		span.SetError(err)
+	}
+	span.Finish()
 }
 
 // Key used in label selector to find app's resources
@@ -79,154 +173,200 @@ func unidleKey(host string) string {
 	return host
 }
 
-// GetIngress returns the ingress for the app
-func (a *App) GetIngress() (*Ingress, error) {
-	// Get ingresses with app host label
-	ings, err := k8sClient.ExtensionsV1beta1().Ingresses("").List(metaAPI.ListOptions{
-		LabelSelector: fmt.Sprintf("%s=%s", UnidleKeyLabel, unidleKey(a.host)),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed listing ingresses: %s", err)
+// GetIngress returns the ingress for the app, found by the first of the
+// `appResolvers` which finds it
+func (a *App) GetIngress() (_ *Ingress, err error) {
+	span := a.startSpan("GetIngress")
+	defer func() { finishSpan(span, err) }()
+
+	if cacheReady() && appCache.IsUnknown(a.route()) {
+		inc(cacheLookups, "ingresses", "negative")
+		return nil, notFound("no Ingress found (cached)")
 	}
 
-	count := len(ings.Items)
-	if count != 1 {
-		return nil, fmt.Errorf("expected exactly 1 Ingress with host label, found %d", count)
+	ing, resolver, err := appResolvers.FindIngress(a.route())
+	if err != nil {
+		if isNotFound(err) && appCache != nil {
+			appCache.MarkUnknown(a.route())
+		}
+		return nil, err
 	}
 
+	a.resolver = resolver
+	a.logger = a.logger.With(Fields{"resolver": resolver.Name()})
 	a.log("Ingress found.")
-	ingress := Ingress(ings.Items[0])
-	return &ingress, nil
+	return ing, nil
 }
 
-// GetDeployment returns the deployment for the app
-func (a *App) GetDeployment() (*Deployment, error) {
-	deps, err := k8sClient.AppsV1().Deployments(a.ingress.Namespace).List(
-		metaAPI.ListOptions{
-			LabelSelector: fmt.Sprintf("%s=%s", UnidleKeyLabel, unidleKey(a.host)),
-		},
-	)
+// GetWorkload returns the workload for the app, of the first of the
+// `workloadKinds` which has it
+func (a *App) GetWorkload() (_ Workload, err error) {
+	span := a.startSpan("GetWorkload")
+	defer func() { finishSpan(span, err) }()
+
+	workload, err := a.resolver.FindWorkload(a.route(), a.ingress)
 	if err != nil {
-		return nil, fmt.Errorf("failed listing deployments: %s", err)
-	}
-	count := len(deps.Items)
-	if count != 1 {
-		return nil, fmt.Errorf("expected exactly 1 Deployment with host label, found %d", count)
+		return nil, err
 	}
 
-	a.log("Deployment found.")
-	dep := Deployment(deps.Items[0])
-	return &dep, nil
+	a.log("%s found.", workloadKind(workload))
+	return workload, nil
 }
 
-// GetService returns the service for the app
-func (a *App) GetService() (*Service, error) {
-	svcs, err := k8sClient.CoreV1().Services(a.ingress.Namespace).List(
-		metaAPI.ListOptions{
-			LabelSelector: fmt.Sprintf("%s=%s", UnidleKeyLabel, unidleKey(a.host)),
-		},
-	)
+// GetGroup returns the workloads unidled together with the App's workload,
+// e.g. its worker and cache, starting with the App's workload
+func (a *App) GetGroup() (_ []Workload, err error) {
+	span := a.startSpan("GetGroup")
+	defer func() { finishSpan(span, err) }()
+
+	group, err := a.resolver.FindGroup(a.route(), a.ingress, a.workload)
 	if err != nil {
-		return nil, fmt.Errorf("failed listing services: %s", err)
+		return nil, err
 	}
 
-	count := len(svcs.Items)
-	if count != 1 {
-		return nil, fmt.Errorf("expected exactly 1 Service with host label, found %d", count)
+	span.SetAttributes(Fields{"group.size": len(group)})
+	if len(group) > 1 {
+		names := []string{}
+		for _, workload := range group[1:] {
+			names = append(names, workload.GetName())
+		}
+		a.log("App group found, with %s.", strings.Join(names, ", "))
+	}
+	return group, nil
+}
+
+// GetService returns the service for the app
+func (a *App) GetService() (_ *Service, err error) {
+	span := a.startSpan("GetService")
+	defer func() { finishSpan(span, err) }()
+
+	svc, err := a.resolver.FindService(a.route(), a.ingress)
+	if err != nil {
+		return nil, err
 	}
 
 	a.log("Service found.")
-	svc := Service(svcs.Items[0])
-	return &svc, nil
+	return svc, nil
 }
 
-// GetReplicasWhenUnidled return the number of replicas when app is unidled
-func (a *App) GetReplicasWhenUnidled() (replicas int) {
-	replicasWhenUnidled, exists := a.deployment.Annotations[ReplicasWhenUnidledAnnotation]
+// GetReplicasWhenUnidled return the number of replicas when the App's
+// workload is unidled
+func (a *App) GetReplicasWhenUnidled(workload Workload) (replicas int) {
+	kind := a.describe(workload)
+	replicasWhenUnidled, exists := workload.GetAnnotations()[ReplicasWhenUnidledAnnotation]
 	if !exists {
-		a.log("Deployment doesn't have '%s' annotation. Assuming it had 1 replica when it was unidled.", ReplicasWhenUnidledAnnotation)
+		a.log("%s doesn't have '%s' annotation. Assuming it had 1 replica when it was unidled.", kind, ReplicasWhenUnidledAnnotation)
 		return 1
 	}
 
 	num, err := strconv.ParseInt(replicasWhenUnidled, 10, 32)
 	if err != nil {
-		a.log("Failed to parse number of replicas when unidled, assuming Deployment had 1 replica. Deployment annotation: '%s=%s': %s", ReplicasWhenUnidledAnnotation, replicasWhenUnidled, err)
+		a.logError(err, "Failed to parse number of replicas when unidled, assuming %s had 1 replica. %s annotation: '%s=%s'.", kind, kind, ReplicasWhenUnidledAnnotation, replicasWhenUnidled)
 		return 1
 	}
 
 	if num < 1 {
-		a.log("Replicas when unidled was %d, assuming Deployment had 1 replica: '%s=%s'.", num, ReplicasWhenUnidledAnnotation, replicasWhenUnidled)
+		a.log("Replicas when unidled was %d, assuming %s had 1 replica: '%s=%s'.", num, kind, ReplicasWhenUnidledAnnotation, replicasWhenUnidled)
 		return 1
 	}
 
 	return int(num)
 }
 
-// SetReplicas updates an App's number of replicas to the specified number
-func (a *App) SetReplicas() (err error) {
-	if *a.deployment.Spec.Replicas > 0 {
-		a.log("Deployment's replicas is already %d. Assuming is already unidled.", *a.deployment.Spec.Replicas)
+// SetReplicas restores the replicas of the App's workloads which are started
+// first, i.e. don't depend on other workloads of its group. The others are
+// started while waiting, see WaitForWorkload
+func (a *App) SetReplicas() error {
+	for _, workload := range a.batches()[0] {
+		err := a.setReplicas(workload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setReplicas restores the number of replicas the workload had before being
+// idled, through its scale subresource
+func (a *App) setReplicas(workload Workload) (err error) {
+	kind := a.describe(workload)
+	current, err := workload.Replicas()
+	if err != nil {
+		a.logError(err, "Failed to get %s's replicas.", kind)
+		return fmt.Errorf("Failed to set your app's replicas back.")
+	}
+	if current > 0 {
+		a.log("%s's replicas is already %d. Assuming is already unidled.", kind, current)
 		return nil
 	}
 
-	replicas := a.GetReplicasWhenUnidled()
-	patch := fmt.Sprintf(`{
-			"spec": {
-				"replicas": %d
-			}
-		}`,
-		replicas,
-	)
+	replicas := a.GetReplicasWhenUnidled(workload)
+	span := a.startSpan("SetReplicas")
+	span.SetAttributes(Fields{"replicas.desired": replicas, "workload": workload.GetName()})
+	defer func() { finishSpan(span, err) }()
 
-	err = a.deployment.Patch([]byte(patch))
+	// NOTE: Truncated as the pods creation timestamp has a precision of a
+	//       second
+	scaledAt := time.Now().Truncate(time.Second)
+	err = workload.Scale(int32(replicas))
 	if err != nil {
-		a.log("Patch to set replicas back to %d failed: %s", replicas, err)
+		a.logError(err, "Scale to set replicas back to %d failed.", replicas)
 		return fmt.Errorf("Failed to set your app's replicas back to %d.", replicas)
 	}
+	if a.scaledUp == nil {
+		a.scaledUp = map[Workload]time.Time{}
+	}
+	a.scaledUp[workload] = scaledAt
 
-	a.log("Successfully set Deployment's replicas to %d.", replicas)
+	a.log("Successfully set %s's replicas to %d.", kind, replicas)
+	a.recordWorkloadEvent(workload, coreAPI.EventTypeNormal, EventReplicasRestored, "Restored replicas to %d.", replicas)
 	return nil
 }
 
-// RedirectService redirects the App's service from the unidler to the app pods
-func (a *App) RedirectService() error {
-	patch := fmt.Sprintf(`{
-			"spec": {
-				"externalName": null,
-				"type": "%s",
-				"selector": {
-					"app": "%s"
-				},
-				"ports": [
-					{
-						"port": 80,
-						"targetPort": 3000
-					}
-				]
-			}
-		}`,
-		coreAPI.ServiceTypeClusterIP,
-		a.service.Labels["app"],
-	)
+// RedirectService redirects the App's service from the unidler to the app
+// pods, restoring its spec from before it was idled
+func (a *App) RedirectService() (err error) {
+	span := a.startSpan("RedirectService")
+	span.SetAttributes(Fields{"service": a.service.Name})
+	defer func() { finishSpan(span, err) }()
 
-	err := a.service.Patch([]byte(patch))
+	spec, source := a.ServiceSpecWhenUnidled()
+	span.SetAttributes(Fields{"service.spec": source})
+	patch, err := serviceSpecPatch(a.service, spec)
 	if err != nil {
-		a.log("Patch to Service failed: %s", err)
+		a.logError(err, "Failed to build Service patch.")
 		return fmt.Errorf("Failed to redirect back your app.")
 	}
 
-	a.log("Successfully redirected Service back to app's pods.")
+	err = a.service.Patch(patch)
+	if err != nil {
+		a.logError(err, "Patch to Service failed.")
+		return fmt.Errorf("Failed to redirect back your app.")
+	}
+
+	a.log("Successfully redirected Service back to app's pods (spec from %s).", source)
+	a.RecordServiceEvent(coreAPI.EventTypeNormal, EventServiceRedirected, "Redirected from the unidler back to the app's pods (spec from %s).", source)
+	a.RecordWorkloadEvent(coreAPI.EventTypeNormal, EventServiceRedirected, "Redirected Service %s back to the app's pods (spec from %s).", a.service.Name, source)
 	return nil
 }
 
-// RemoveIdledMetadata removes the App's label and annotation which indicate its
-// idled status, marking it as no longer idled
-func (a *App) RemoveIdledMetadata() (err error) {
+// RemoveIdledMetadata removes the label and annotation which indicate the
+// idled status of the App's workloads, marking them as no longer idled. The
+// time they were unidled and the ID of the request which unidled them are
+// recorded instead
+func (a *App) RemoveIdledMetadata(unidledBy string) (err error) {
+	span := a.startSpan("RemoveIdledMetadata")
+	defer func() { finishSpan(span, err) }()
+
+	// NOTE: Truncated as the annotation has a precision of a second
+	a.unidledAt = time.Now().UTC().Truncate(time.Second)
 	patch := fmt.Sprintf(`{
 			"metadata": {
 				"annotations": {
 					"%s": null,
-					"%s": null
+					"%s": null,
+					"%s": "%s",
+					"%s": "%s"
 				},
 				"labels": {
 					"%s": null
@@ -235,42 +375,346 @@ func (a *App) RemoveIdledMetadata() (err error) {
 		}`,
 		IdledAtAnnotation,
 		ReplicasWhenUnidledAnnotation,
+		UnidledAtAnnotation, a.unidledAt.Format(IdledAtFormat),
+		UnidledByAnnotation, unidledBy,
 		IdledLabel,
 	)
 
-	err = a.deployment.Patch([]byte(patch))
-	if err != nil {
-		a.log("Patch to remove idled metadata label/annotation failed: %s", err)
-		return fmt.Errorf("Failed to remove idled metadata from your app.")
+	for _, batch := range a.batches() {
+		for _, workload := range batch {
+			err = workload.PatchMetadata([]byte(patch))
+			if err != nil {
+				a.logError(err, "Patch to remove idled metadata label/annotation from %s failed.", a.describe(workload))
+				return fmt.Errorf("Failed to remove idled metadata from your app.")
+			}
+
+			a.log("Successfully removed idled metadata (label/annotation) from %s.", a.describe(workload))
+			a.recordWorkloadEvent(workload, coreAPI.EventTypeNormal, EventIdledMetadataRemoved, "Removed idled label and annotations.")
+		}
 	}
+	return nil
+}
 
-	a.log("Successfully removed idled metadata (label/annotation) from Deployment.")
+// UpUntil returns the time until which the App is guaranteed to stay up, the
+// end of the grace period after it was unidled during which idlers leave it
+// alone. It's zero until the App is unidled
+func (a *App) UpUntil() time.Time {
+	if a.unidledAt.IsZero() {
+		return time.Time{}
+	}
+	return a.unidledAt.Add(UnidleGracePeriod)
+}
+
+// WaitForWorkload blocks until the App's workloads are ready to receive
+// incoming requests or until WaitTimeout is reached.
+// While waiting, the workloads' pods are inspected and the reason why
+// the app is not coming up is reported, along with the status of its
+// replicas and pods. If the failure is terminal (e.g. the image can't be
+// pulled) it stops waiting and returns it as an error.
+// Deployments are watched, the other workloads are polled every
+// DiagnosisInterval.
+// The workloads of an app group are waited for in the order they're started:
+// once a batch is ready the next one is started, see unidleOrder. The
+// updates then include the state of each of them
+func (a *App) WaitForWorkload(report func(*Update)) (err error) {
+	span := a.startSpan("WaitForWorkload")
+	var status *ReplicasStatus
+	defer func() {
+		if status != nil {
+			span.SetAttributes(Fields{
+				"replicas.desired":   status.Desired,
+				"replicas.ready":     status.Ready,
+				"replicas.available": status.Available,
+			})
+		}
+		finishSpan(span, err)
+	}()
+
+	deadline := time.NewTimer(WaitTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(DiagnosisInterval)
+	defer ticker.Stop()
+
+	states := map[Workload]string{}
+	for i, batch := range a.batches() {
+		for _, workload := range batch {
+			if i > 0 {
+				err = a.setReplicas(workload)
+				if err != nil {
+					return err
+				}
+			}
+			states[workload] = ComponentStarting
+		}
+
+		for _, workload := range batch {
+			progress := a.progressReporter(workload, a.groupReporter(workload, states, report))
+			if dep, ok := workload.(*Deployment); ok {
+				status, err = a.waitForDeployment(dep, deadline.C, ticker.C, progress)
+			} else {
+				status, err = a.pollWorkload(workload, deadline.C, ticker.C, progress)
+			}
+			if err != nil {
+				return err
+			}
+
+			states[workload] = ComponentReady
+			a.log("Successfully waited for %s replicas to be available.", a.describe(workload))
+			a.recordWorkloadEvent(workload, coreAPI.EventTypeNormal, EventReady, "App ready with %d available replica(s).", status.Available)
+		}
+	}
 	return nil
 }
 
-// WaitForDeployment blocks until the App's Deployment is ready to receive
-// incoming requests
-func (a *App) WaitForDeployment() error {
-	userFriendlyError := fmt.Errorf("Failed to wait for for your app to come back up.")
+// groupReporter returns the function reporting the updates while waiting
+// for the workload. When the App is a group, the message is prefixed with
+// the workload's name and the state of each workload is added
+func (a *App) groupReporter(workload Workload, states map[Workload]string, report func(*Update)) func(*Update) {
+	if !a.grouped() {
+		return report
+	}
+	return func(update *Update) {
+		update.Message = fmt.Sprintf("%s: %s", workload.GetName(), update.Message)
+		update.Components = a.componentStatuses(states)
+		report(update)
+	}
+}
 
-	w, err := a.deployment.Watch()
+const (
+	// Delays before watching a Deployment again once its watch is closed,
+	// doubled every time it's closed without any event
+	MIN_REWATCH_BACKOFF = 500 * time.Millisecond
+	MAX_REWATCH_BACKOFF = 30 * time.Second
+)
+
+// rewatchBackoff returns the delay before watching again, given the previous
+// one (zero when the watch had events)
+func rewatchBackoff(previous time.Duration) time.Duration {
+	delay := 2 * previous
+	if delay < MIN_REWATCH_BACKOFF {
+		return MIN_REWATCH_BACKOFF
+	}
+	if delay > MAX_REWATCH_BACKOFF {
+		return MAX_REWATCH_BACKOFF
+	}
+	return delay
+}
+
+// waitForDeployment watches the Deployment until it has available replicas.
+// It returns the status of its replicas last seen
+func (a *App) waitForDeployment(deployment *Deployment, deadline <-chan time.Time, tick <-chan time.Time, progress progressFunc) (*ReplicasStatus, error) {
+	check := func(dep *appsAPI.Deployment) error {
+		pods, err := deploymentPods(dep)
+		if err != nil {
+			// Not being able to inspect the pods is not a reason to stop waiting
+			a.logError(err, "Failed to get Deployment's pods.")
+		}
+		diagnosis, err := Diagnose(dep, pods)
+		if err != nil {
+			a.logError(err, "Failed to diagnose Deployment.")
+		}
+		return progress(replicasStatus(dep), pods, diagnosis)
+	}
+
+	list := func() (*appsAPI.Deployment, string, error) {
+		dep, resourceVersion, err := deployment.List()
+		if err != nil {
+			a.logError(err, "List Deployment failed.")
+			return nil, "", fmt.Errorf("Failed to wait for for your app to come back up.")
+		}
+		return dep, resourceVersion, nil
+	}
+
+	dep, resourceVersion, err := list()
 	if err != nil {
-		a.log("Watch on Deployment failed: %s", err)
-		return userFriendlyError
+		return nil, err
 	}
 
-	for event := range w.ResultChan() {
-		dep, ok := event.Object.(*appsAPI.Deployment)
-		if !ok {
-			a.log("Unexpected Watch event type: %+v", event.Object)
-			return userFriendlyError
+	delay := time.Duration(0)
+	for {
+		if dep.Status.AvailableReplicas > 0 {
+			return replicasStatus(dep), nil
+		}
+
+		err = check(dep)
+		if err != nil {
+			return replicasStatus(dep), err
+		}
+
+		// Watch from the last seen version of the Deployment. When the watch
+		// is closed (e.g. API server watch timeout) it's re-established,
+		// backing off when it's closed without events
+		w, err := deployment.Watch(resourceVersion)
+		if err != nil {
+			a.logError(err, "Watch on Deployment failed.")
+			return replicasStatus(dep), fmt.Errorf("Failed to wait for for your app to come back up.")
 		}
 
+		latest, expired, err := a.waitForEvent(w, dep, deadline, tick, check)
+		w.Stop()
+		if err != nil {
+			return replicasStatus(dep), err
+		}
+		if latest != dep {
+			delay = 0
+		}
+		dep, resourceVersion = latest, latest.ResourceVersion
 		if dep.Status.AvailableReplicas > 0 {
-			break
+			continue
+		}
+
+		delay = rewatchBackoff(delay)
+		select {
+		case <-deadline:
+			a.log("Timed out after %s waiting for Deployment replicas to be available.", WaitTimeout)
+			return replicasStatus(dep), fmt.Errorf("Timed out after %s waiting for your app to come back up.", WaitTimeout)
+		case <-time.After(delay):
+		}
+
+		if expired {
+			// e.g. resource version too old (410 Gone), list it again
+			dep, resourceVersion, err = list()
+			if err != nil {
+				return replicasStatus(latest), err
+			}
+		}
+	}
+}
+
+// waitForEvent waits on the watch until the Deployment has available replicas,
+// the watch is closed or fails, the deadline is reached or a terminal failure
+// is diagnosed. It returns the last seen version of the Deployment, and true
+// when the watch failed (e.g. the version watched from is too old) and the
+// Deployment must be listed again
+func (a *App) waitForEvent(w watch.Interface, dep *appsAPI.Deployment, deadline <-chan time.Time, tick <-chan time.Time, check func(*appsAPI.Deployment) error) (*appsAPI.Deployment, bool, error) {
+	for {
+		select {
+		case <-deadline:
+			a.log("Timed out after %s waiting for Deployment replicas to be available.", WaitTimeout)
+			return nil, false, fmt.Errorf("Timed out after %s waiting for your app to come back up.", WaitTimeout)
+
+		case <-tick:
+			// Pods status changes don't trigger Deployment events
+			err := check(dep)
+			if err != nil {
+				return nil, false, err
+			}
+
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				a.log("Watch on Deployment closed. Watching it again from version %s.", dep.ResourceVersion)
+				return dep, false, nil
+			}
+
+			if event.Type == watch.Error {
+				a.log("Watch on Deployment returned an error: %+v. Listing it again.", event.Object)
+				return dep, true, nil
+			}
+
+			latest, ok := event.Object.(*appsAPI.Deployment)
+			if !ok {
+				a.log("Unexpected Watch event type: %+v", event.Object)
+				return nil, false, fmt.Errorf("Failed to wait for for your app to come back up.")
+			}
+			if latest.Name != dep.Name {
+				continue
+			}
+
+			dep = latest
+			if dep.Status.AvailableReplicas > 0 {
+				return dep, false, nil
+			}
+			err := check(dep)
+			if err != nil {
+				return nil, false, err
+			}
 		}
 	}
+}
 
-	a.log("Successfully waited for Deployment replicas to be available.")
-	return nil
+// pollWorkload gets the status of the workload and of its pods every tick,
+// until it has available replicas, the deadline is reached or a terminal
+// failure is diagnosed. It returns the status of its replicas last seen
+func (a *App) pollWorkload(workload Workload, deadline <-chan time.Time, tick <-chan time.Time, progress progressFunc) (*ReplicasStatus, error) {
+	kind := a.describe(workload)
+	var status *ReplicasStatus
+	for {
+		latest, err := workload.ReplicasStatus()
+		if err != nil {
+			a.logError(err, "Get %s status failed.", kind)
+			return status, fmt.Errorf("Failed to wait for for your app to come back up.")
+		}
+		status = latest
+		if status.Available > 0 {
+			return status, nil
+		}
+
+		pods, err := workload.Pods()
+		if err != nil {
+			// Not being able to inspect the pods is not a reason to stop waiting
+			a.logError(err, "Failed to get %s's pods.", kind)
+		}
+		diagnosis, err := DiagnosePods(pods)
+		if err != nil {
+			a.logError(err, "Failed to diagnose %s.", kind)
+		}
+		err = progress(status, pods, diagnosis)
+		if err != nil {
+			return status, err
+		}
+
+		select {
+		case <-deadline:
+			a.log("Timed out after %s waiting for %s replicas to be available.", WaitTimeout, kind)
+			return status, fmt.Errorf("Timed out after %s waiting for your app to come back up.", WaitTimeout)
+		case <-tick:
+		}
+	}
+}
+
+// progressFunc reports the status of the workload's replicas and pods, and
+// returns an error when the diagnosis is a terminal failure
+type progressFunc func(status *ReplicasStatus, pods []coreAPI.Pod, diagnosis *Diagnosis) error
+
+// progressReporter returns a progressFunc which reports the status of the
+// workload and of its pods, whenever that changes. Kubernetes backing off is
+// only a terminal failure once it lasted BackOffTimeout
+func (a *App) progressReporter(workload Workload, report func(*Update)) progressFunc {
+	var reported []byte
+	diagnosed := ""
+	// Time since when kubernetes has been backing off, see Diagnosis.BackOff
+	var backingOff time.Time
+	kind := a.describe(workload)
+	return func(status *ReplicasStatus, pods []coreAPI.Pod, diagnosis *Diagnosis) error {
+		if diagnosis == nil || !diagnosis.BackOff {
+			backingOff = time.Time{}
+		} else if backingOff.IsZero() {
+			backingOff = time.Now()
+		}
+
+		message := StartingMessage
+		if diagnosis != nil {
+			if diagnosis.Terminal || (diagnosis.BackOff && time.Since(backingOff) >= BackOffTimeout) {
+				a.log("%s is failing (%s): %s", kind, diagnosis.Reason, diagnosis.Message)
+				return errors.New(diagnosis.Message)
+			}
+			if diagnosis.Message != diagnosed {
+				a.log("%s is not available yet (%s): %s", kind, diagnosis.Reason, diagnosis.Message)
+			}
+			message = diagnosis.Message
+			diagnosed = diagnosis.Message
+		}
+
+		update := &Update{
+			Message:  message,
+			Replicas: status,
+			Pods:     podStatuses(pods),
+		}
+		encoded, _ := json.Marshal(update)
+		if !bytes.Equal(encoded, reported) {
+			report(update)
+			reported = encoded
+		}
+		return nil
+	}
 }
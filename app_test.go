@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -9,9 +10,11 @@ import (
 	coreAPI "k8s.io/api/core/v1"
 	extAPI "k8s.io/api/extensions/v1beta1"
 	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
 	k8s "k8s.io/client-go/kubernetes"
 
 	k8sFake "k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
 )
 
 const (
@@ -19,6 +22,8 @@ const (
 	NS         = "test-ns"
 	NAME       = "test"
 	UNIDLE_KEY = "test-tool"
+	// AUTH_PROXY_SECRET is the secret shared with the authenticating proxy
+	AUTH_PROXY_SECRET = "test-proxy-secret"
 )
 
 var (
@@ -30,20 +35,23 @@ var (
 
 func init() {
 	UnidleKeyLabel = "unidle-key"
+	AuthProxySecret = AUTH_PROXY_SECRET
 
-	k8sClient = k8sFake.NewSimpleClientset()
+	client := k8sFake.NewSimpleClientset()
+	fakeScale(client)
+	k8sClient = client
 
 	// setup mock kubernetes resources
 	deploy = mockDeployment(k8sClient, NS, NAME, HOST)
 	svc = mockService(k8sClient, NS, NAME, HOST)
 	ing = mockIngress(k8sClient, NS, NAME, HOST)
 
-	app, _ = NewApp(HOST)
+	app, _ = NewApp(HOST, "/", logger, nil)
 }
 
 func TestNewApp(t *testing.T) {
 	assert.Equal(t, &ing, app.ingress)
-	assert.Equal(t, &deploy, app.deployment)
+	assert.Equal(t, &deploy, app.workload)
 	assert.Equal(t, &svc, app.service)
 }
 
@@ -69,8 +77,8 @@ func TestRedirectService(t *testing.T) {
 	assert.Nil(t, err)
 	svc = getService(NS, NAME)
 	assert.Equal(t, coreAPI.ServiceTypeClusterIP, svc.Spec.Type)
-	// XXX fake patch doesn't remove
-	//assert.Nil(t, svc.Spec.ExternalName)
+	// XXX fake patch doesn't remove the external name, see
+	//     TestRedirectServiceRestoresSnapshot
 	assert.Equal(t, NAME, svc.Spec.Selector["app"])
 	assert.Equal(t, int32(80), svc.Spec.Ports[0].Port)
 	assert.Equal(t, 3000, svc.Spec.Ports[0].TargetPort.IntValue())
@@ -81,10 +89,15 @@ func TestRemoveIdledMetadata(t *testing.T) {
 	assert.True(t, hasIdledLabel(deploy))
 	assert.True(t, hasReplicasAnnotation(deploy))
 
-	err := app.RemoveIdledMetadata()
+	err := app.RemoveIdledMetadata("test-request-id")
 
 	assert.Nil(t, err)
 	deploy = getDeployment(NS, NAME)
+	assert.Equal(t, "test-request-id", deploy.Annotations[UnidledByAnnotation])
+	unidledAt, err := time.Parse(IdledAtFormat, deploy.Annotations[UnidledAtAnnotation])
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), unidledAt, time.Minute)
+	assert.Equal(t, UnidleGracePeriod, app.UpUntil().Sub(unidledAt))
 	// XXX fake patch doesn't remove
 	// assert.False(t, hasIdledLabel(deploy))
 	// assert.False(t, hasReplicasAnnotation(deploy))
@@ -153,7 +166,7 @@ func mockIngress(client k8s.Interface, ns string, name string, host string) Ingr
 			},
 		},
 	})
-	return Ingress(*ing)
+	return *ingressFromExtensions(ing)
 }
 
 func mockService(k k8s.Interface, ns string, name string, host string) Service {
@@ -189,3 +202,127 @@ func TestUnidleKey(t *testing.T) {
 		assert.Equal(t, unidleKey(tc.host), tc.unidleKey)
 	}
 }
+
+func TestWaitForWorkloadReestablishesWatch(t *testing.T) {
+	const ns = "wait-ns"
+	dep := mockDeployment(k8sClient, ns, NAME, HOST)
+	a := &App{host: HOST, workload: &dep, logger: app.logger}
+
+	watchers := make(chan *watch.FakeWatcher, 2)
+	resourceVersions := []string{}
+	fakeClient := k8sClient.(*k8sFake.Clientset)
+	fakeClient.PrependWatchReactor("deployments", func(action k8sTesting.Action) (bool, watch.Interface, error) {
+		if action.GetNamespace() != ns {
+			return false, nil, nil
+		}
+		resourceVersions = append(resourceVersions, action.(k8sTesting.WatchActionImpl).WatchRestrictions.ResourceVersion)
+		w := watch.NewFake()
+		watchers <- w
+		return true, w, nil
+	})
+
+	go func() {
+		// First watch is closed by the API server before app is available
+		w := <-watchers
+		progressing := appsAPI.Deployment(dep)
+		progressing.ResourceVersion = "42"
+		w.Modify(&progressing)
+		w.Stop()
+
+		w = <-watchers
+		available := appsAPI.Deployment(dep)
+		available.ResourceVersion = "43"
+		available.Status.AvailableReplicas = 1
+		w.Modify(&available)
+	}()
+
+	err := a.WaitForWorkload(func(*Update) {})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"", "42"}, resourceVersions)
+}
+
+func TestWaitForWorkloadBacksOffRewatching(t *testing.T) {
+	const ns = "backoff-ns"
+	defer func(timeout time.Duration) { WaitTimeout = timeout }(WaitTimeout)
+	WaitTimeout = 1200 * time.Millisecond
+
+	dep := mockDeployment(k8sClient, ns, NAME, HOST)
+	a := &App{host: HOST, workload: &dep, logger: app.logger}
+
+	watches := 0
+	fakeClient := k8sClient.(*k8sFake.Clientset)
+	fakeClient.PrependWatchReactor("deployments", func(action k8sTesting.Action) (bool, watch.Interface, error) {
+		if action.GetNamespace() != ns {
+			return false, nil, nil
+		}
+		// Watch closed straight away, without any event
+		watches++
+		w := watch.NewFake()
+		w.Stop()
+		return true, w, nil
+	})
+
+	err := a.WaitForWorkload(func(*Update) {})
+
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Timed out")
+	// Watched again after 500ms then 1s
+	assert.Equal(t, 2, watches)
+}
+
+func TestWaitForWorkloadListsAgainWhenWatchExpires(t *testing.T) {
+	const ns = "expired-ns"
+	dep := mockDeployment(k8sClient, ns, NAME, HOST)
+	a := &App{host: HOST, workload: &dep, logger: app.logger}
+
+	watchers := make(chan *watch.FakeWatcher, 2)
+	fakeClient := k8sClient.(*k8sFake.Clientset)
+	fakeClient.PrependWatchReactor("deployments", func(action k8sTesting.Action) (bool, watch.Interface, error) {
+		if action.GetNamespace() != ns {
+			return false, nil, nil
+		}
+		w := watch.NewFake()
+		watchers <- w
+		return true, w, nil
+	})
+	lists := func() int {
+		count := 0
+		for _, action := range fakeClient.Actions() {
+			if action.GetVerb() == "list" && action.GetNamespace() == ns && action.GetResource().Resource == "deployments" {
+				count++
+			}
+		}
+		return count
+	}
+
+	go func() {
+		// Version watched from is too old
+		w := <-watchers
+		w.Error(&metaAPI.Status{Code: 410, Reason: metaAPI.StatusReasonExpired})
+
+		w = <-watchers
+		available := appsAPI.Deployment(dep)
+		available.Status.AvailableReplicas = 1
+		w.Modify(&available)
+	}()
+
+	err := a.WaitForWorkload(func(*Update) {})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, lists())
+}
+
+func TestWaitForWorkloadTimesOut(t *testing.T) {
+	const ns = "timeout-ns"
+	defer func(timeout time.Duration) { WaitTimeout = timeout }(WaitTimeout)
+	WaitTimeout = 50 * time.Millisecond
+
+	dep := mockDeployment(k8sClient, ns, NAME, HOST)
+	a := &App{host: HOST, workload: &dep, logger: app.logger}
+
+	err := a.WaitForWorkload(func(*Update) {})
+
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Timed out")
+}
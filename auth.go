@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+)
+
+const (
+	// DEFAULT_AUTH_USER_HEADER is the header with the user's name set by
+	// OAuth2 Proxy
+	DEFAULT_AUTH_USER_HEADER = "X-Auth-Request-User"
+	// DEFAULT_AUTH_PROXY_SECRET_HEADER is the header with the secret shared
+	// with the authenticating proxy, proving it set the user's header
+	DEFAULT_AUTH_PROXY_SECRET_HEADER = "X-Auth-Proxy-Secret"
+	DEFAULT_USER_NAMESPACE_TEMPLATE  = "user-{{.User | lower}}"
+)
+
+var (
+	// AuthUserHeader is the request header with the name of the user, set by
+	// the authenticating proxy in front of the unidler
+	AuthUserHeader = DEFAULT_AUTH_USER_HEADER
+	// AuthProxySecretHeader is the request header with the AuthProxySecret,
+	// set by the authenticating proxy
+	AuthProxySecretHeader = DEFAULT_AUTH_PROXY_SECRET_HEADER
+	// AuthProxySecret is the secret shared with the authenticating proxy. No
+	// user is trusted when it's empty
+	AuthProxySecret string
+	// userNamespace is the template of the namespace of a user's apps, see
+	// UserNamespaceFromEnv
+	userNamespace = template.Must(newUserNamespaceTemplate(DEFAULT_USER_NAMESPACE_TEMPLATE))
+)
+
+func newUserNamespaceTemplate(text string) (*template.Template, error) {
+	return template.New("namespace").Option("missingkey=error").Funcs(template.FuncMap{
+		"lower": strings.ToLower,
+	}).Parse(text)
+}
+
+// UserNamespaceFromEnv parses the template of the namespace of a user's apps
+// in `USER_NAMESPACE_TEMPLATE`, a Go template of `.User`
+func UserNamespaceFromEnv() (*template.Template, error) {
+	text, ok := os.LookupEnv("USER_NAMESPACE_TEMPLATE")
+	if !ok {
+		logger.Info("$USER_NAMESPACE_TEMPLATE not set. Defaulting to '%s'", DEFAULT_USER_NAMESPACE_TEMPLATE)
+		text = DEFAULT_USER_NAMESPACE_TEMPLATE
+	}
+	tmpl, err := newUserNamespaceTemplate(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid $USER_NAMESPACE_TEMPLATE: %s", err)
+	}
+	return tmpl, nil
+}
+
+// authenticatedUser returns the name of the user authenticated by the proxy
+// in front of the unidler, empty when there's none. Any client can set the
+// user's header, so it's only trusted when the request came through the
+// proxy, see fromAuthProxy
+func authenticatedUser(req *http.Request) string {
+	if !fromAuthProxy(req) {
+		return ""
+	}
+	return strings.TrimSpace(req.Header.Get(AuthUserHeader))
+}
+
+// fromAuthProxy returns true if the request came through the authenticating
+// proxy: it has the secret shared with the proxy in its AuthProxySecretHeader
+func fromAuthProxy(req *http.Request) bool {
+	if AuthProxySecret == "" {
+		return false
+	}
+	secret := req.Header.Get(AuthProxySecretHeader)
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(AuthProxySecret)) == 1
+}
+
+// ownsApp returns true if the App runs in the user's namespace
+func ownsApp(user string, a *App) (bool, error) {
+	namespace := &bytes.Buffer{}
+	err := userNamespace.Execute(namespace, map[string]string{"User": user})
+	if err != nil {
+		return false, fmt.Errorf("failed executing user namespace template: %s", err)
+	}
+	return namespace.String() == a.workload.GetNamespace(), nil
+}
+
+// sameOrigin returns true if the request doesn't come from another site: its
+// `Origin` header (when sent by the browser) is the host requested
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == req.Host
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	appsAPI "k8s.io/api/apps/v1"
+	coreAPI "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	DEFAULT_CACHE_ENABLED      = true
+	DEFAULT_NEGATIVE_CACHE_TTL = 10 * time.Second
+	// Interval between the full resyncs of the cache
+	CACHE_RESYNC_PERIOD = 10 * time.Minute
+)
+
+// Names of the indexes of the cached resources
+const (
+	labelsIndex = "labels"
+	hostsIndex  = "hosts"
+)
+
+var cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "unidler_cache_lookups_total",
+	Help: "Number of app lookups served by the cache, by resource and result (hit, miss for a resource not cached, or negative for a recently unknown route).",
+}, []string{"resource", "result"})
+
+// appCache serves the lookups of the apps' resources when enabled (non-nil)
+var appCache *AppCache
+
+// CacheSelectorFromEnv returns the label selector of the resources cached, in
+// `CACHE_SELECTOR`. By default it's the label the apps are found by, when
+// they're only found by label, see defaultCacheSelector
+func CacheSelectorFromEnv(chain ResolverChain) (string, error) {
+	selector, ok := os.LookupEnv("CACHE_SELECTOR")
+	if !ok {
+		selector = defaultCacheSelector(chain)
+		logger.Info("$CACHE_SELECTOR not set. Defaulting to '%s'", selector)
+	}
+	_, err := labels.Parse(selector)
+	if err != nil {
+		return "", fmt.Errorf("invalid $CACHE_SELECTOR: %s", err)
+	}
+	return selector, nil
+}
+
+// defaultCacheSelector selects the resources with the label of the `label` or
+// `hashed-label` resolver when it's the only one. The other resolvers find
+// resources without a label of their own, so everything is cached for them
+func defaultCacheSelector(chain ResolverChain) string {
+	if len(chain) != 1 {
+		return ""
+	}
+	switch resolver := chain[0].(type) {
+	case *labelResolver:
+		return UnidleKeyLabel
+	case *hashedLabelResolver:
+		return resolver.label
+	}
+	return ""
+}
+
+func storeKey(namespace string, name string) string {
+	return namespace + "/" + name
+}
+
+// labelIndexKey is the index key of the objects with the given label
+func labelIndexKey(label string, value string) string {
+	return label + "=" + value
+}
+
+// indexByLabels indexes the objects by each of their labels, in all
+// namespaces and in their own
+func indexByLabels(obj interface{}) ([]string, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for label, value := range accessor.GetLabels() {
+		key := labelIndexKey(label, value)
+		keys = append(keys, key, storeKey(accessor.GetNamespace(), key))
+	}
+	return keys, nil
+}
+
+// indexByHosts indexes the Ingresses by each of their hosts
+func indexByHosts(obj interface{}) ([]string, error) {
+	ing, ok := obj.(*Ingress)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object in the Ingresses cache: %T", obj)
+	}
+	return ing.Hosts(), nil
+}
+
+// AppCache is a local cache of the Ingresses, Deployments and Services of the
+// apps, kept consistent with the kubernetes API by informers. Only the
+// resources matching its label selector are cached. It also remembers the
+// routes for which no app was found, for a short time
+type AppCache struct {
+	factory     informers.SharedInformerFactory
+	ingresses   cache.SharedIndexInformer
+	deployments cache.SharedIndexInformer
+	services    cache.SharedIndexInformer
+
+	ttl     time.Duration
+	mu      sync.Mutex
+	unknown map[Route]time.Time
+}
+
+// NewAppCache constructs a new AppCache of the resources matching the label
+// selector (all if empty), remembering unknown routes for the given time
+func NewAppCache(ttl time.Duration, selector string) *AppCache {
+	c := &AppCache{
+		ttl:     ttl,
+		unknown: map[Route]time.Time{},
+	}
+
+	selectApps := func(opts *metaAPI.ListOptions) {
+		opts.LabelSelector = selector
+	}
+	c.factory = informers.NewSharedInformerFactoryWithOptions(k8sClient, CACHE_RESYNC_PERIOD, informers.WithTweakListOptions(selectApps))
+
+	c.deployments = c.factory.Apps().V1().Deployments().Informer()
+	c.deployments.AddIndexers(cache.Indexers{labelsIndex: indexByLabels})
+	c.services = c.factory.Core().V1().Services().Informer()
+	c.services.AddIndexers(cache.Indexers{labelsIndex: indexByLabels})
+
+	// NOTE: The Ingresses are listed and watched by the ingressClient, in the
+	// API version served by the cluster
+	c.ingresses = c.factory.InformerFor(&Ingress{}, func(_ kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		return cache.NewSharedIndexInformer(
+			&cache.ListWatch{
+				ListFunc: func(opts metaAPI.ListOptions) (runtime.Object, error) {
+					selectApps(&opts)
+					start := time.Now()
+					ings, resourceVersion, err := ingressClient.List("", opts)
+					observeKubernetesRequest("list", "ingresses", start, err)
+					if err != nil {
+						return nil, err
+					}
+					return &IngressList{ListMeta: metaAPI.ListMeta{ResourceVersion: resourceVersion}, Items: ings}, nil
+				},
+				WatchFunc: func(opts metaAPI.ListOptions) (watch.Interface, error) {
+					selectApps(&opts)
+					start := time.Now()
+					w, err := ingressClient.Watch("", opts)
+					observeKubernetesRequest("watch", "ingresses", start, err)
+					return w, err
+				},
+			},
+			&Ingress{},
+			resync,
+			cache.Indexers{labelsIndex: indexByLabels, hostsIndex: indexByHosts},
+		)
+	})
+	// A new Ingress can make an unknown route known
+	c.ingresses.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.forgetUnknown() },
+		UpdateFunc: func(interface{}, interface{}) { c.forgetUnknown() },
+		DeleteFunc: func(interface{}) { c.forgetUnknown() },
+	})
+
+	return c
+}
+
+// Start starts filling and watching the cache in the background, until stop
+// is closed
+func (c *AppCache) Start(stop <-chan struct{}) {
+	c.factory.Start(stop)
+}
+
+// Synced returns true once all the resources have been listed. Until then
+// lookups go to the kubernetes API
+func (c *AppCache) Synced() bool {
+	return c.ingresses.HasSynced() && c.deployments.HasSynced() && c.services.HasSynced()
+}
+
+// byIndex returns copies of the objects of the informer with the given index
+// key
+func byIndex(informer cache.SharedIndexInformer, index string, key string) []runtime.Object {
+	items, err := informer.GetIndexer().ByIndex(index, key)
+	if err != nil {
+		logger.Error(err, "Failed looking up %s in the cache.", key)
+		return nil
+	}
+	objects := []runtime.Object{}
+	for _, item := range items {
+		objects = append(objects, item.(runtime.Object).DeepCopyObject())
+	}
+	return objects
+}
+
+// byLabel returns copies of the objects of the informer in the namespace (or
+// all namespaces if empty) with the given label
+func byLabel(informer cache.SharedIndexInformer, namespace string, label string, value string) []runtime.Object {
+	key := labelIndexKey(label, value)
+	if namespace != "" {
+		key = storeKey(namespace, key)
+	}
+	return byIndex(informer, labelsIndex, key)
+}
+
+// cached returns a copy of the object of the informer with the given namespace
+// and name, or nil
+func cached(informer cache.SharedIndexInformer, namespace string, name string) runtime.Object {
+	item, ok, err := informer.GetIndexer().GetByKey(storeKey(namespace, name))
+	if err != nil || !ok {
+		return nil
+	}
+	return item.(runtime.Object).DeepCopyObject()
+}
+
+// IngressesByLabel returns the Ingresses with the given label, in all
+// namespaces
+func (c *AppCache) IngressesByLabel(label string, value string) []Ingress {
+	return ingresses(byLabel(c.ingresses, "", label, value))
+}
+
+// IngressesByHost returns the Ingresses with a rule for the given host, in all
+// namespaces
+func (c *AppCache) IngressesByHost(host string) []Ingress {
+	return ingresses(byIndex(c.ingresses, hostsIndex, host))
+}
+
+// Ingress returns the Ingress with the given namespace and name, or nil
+func (c *AppCache) Ingress(namespace string, name string) *Ingress {
+	obj := cached(c.ingresses, namespace, name)
+	if obj == nil {
+		return nil
+	}
+	return obj.(*Ingress)
+}
+
+// DeploymentsByLabel returns the Deployments in the namespace with the given
+// label
+func (c *AppCache) DeploymentsByLabel(namespace string, label string, value string) []appsAPI.Deployment {
+	deps := []appsAPI.Deployment{}
+	for _, obj := range byLabel(c.deployments, namespace, label, value) {
+		deps = append(deps, *obj.(*appsAPI.Deployment))
+	}
+	return deps
+}
+
+// Deployment returns the Deployment with the given namespace and name, or nil
+func (c *AppCache) Deployment(namespace string, name string) *appsAPI.Deployment {
+	obj := cached(c.deployments, namespace, name)
+	if obj == nil {
+		return nil
+	}
+	return obj.(*appsAPI.Deployment)
+}
+
+// ServicesByLabel returns the Services in the namespace with the given label
+func (c *AppCache) ServicesByLabel(namespace string, label string, value string) []coreAPI.Service {
+	svcs := []coreAPI.Service{}
+	for _, obj := range byLabel(c.services, namespace, label, value) {
+		svcs = append(svcs, *obj.(*coreAPI.Service))
+	}
+	return svcs
+}
+
+// Service returns the Service with the given namespace and name, or nil
+func (c *AppCache) Service(namespace string, name string) *coreAPI.Service {
+	obj := cached(c.services, namespace, name)
+	if obj == nil {
+		return nil
+	}
+	return obj.(*coreAPI.Service)
+}
+
+func ingresses(objects []runtime.Object) []Ingress {
+	ings := []Ingress{}
+	for _, obj := range objects {
+		ings = append(ings, *obj.(*Ingress))
+	}
+	return ings
+}
+
+// IsUnknown returns true if no app was recently found for the route. Routes
+// are remembered with their path, as apps can share a host on different paths
+func (c *AppCache) IsUnknown(route Route) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expiry, ok := c.unknown[route]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(c.unknown, route)
+		return false
+	}
+	return true
+}
+
+// MarkUnknown remembers that no app was found for the route
+func (c *AppCache) MarkUnknown(route Route) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unknown[route] = time.Now().Add(c.ttl)
+}
+
+func (c *AppCache) forgetUnknown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.unknown) > 0 {
+		c.unknown = map[Route]time.Time{}
+	}
+}
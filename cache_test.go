@@ -0,0 +1,189 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	appsAPI "k8s.io/api/apps/v1"
+	extAPI "k8s.io/api/extensions/v1beta1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sFake "k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+// waitFor polls the condition until it's true or times out
+func waitFor(t *testing.T, condition func() bool, msg string) {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", msg)
+}
+
+func countActions(client *k8sFake.Clientset, verb string) int {
+	count := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == verb {
+			count++
+		}
+	}
+	return count
+}
+
+// withAppCache sets up an AppCache of a new fake clientset, with the app's
+// resources and the given objects, for the duration of the test
+func withAppCache(t *testing.T, objects ...runtime.Object) (*k8sFake.Clientset, func()) {
+	previousClient := k8sClient
+	client := k8sFake.NewSimpleClientset(objects...)
+	k8sClient = client
+	mockDeployment(client, NS, NAME, HOST)
+	mockService(client, NS, NAME, HOST)
+	mockIngress(client, NS, NAME, HOST)
+
+	stop := make(chan struct{})
+	appCache = NewAppCache(time.Minute, UnidleKeyLabel)
+	appCache.Start(stop)
+	waitFor(t, appCache.Synced, "cache to be synced")
+	waitFor(t, func() bool { return countActions(client, "watch") == 3 }, "resources to be watched")
+
+	return client, func() {
+		close(stop)
+		appCache = nil
+		k8sClient = previousClient
+	}
+}
+
+func TestAppCacheOnlyCachesSelectedResources(t *testing.T) {
+	// NOTE: The fake clientset doesn't filter the watch events by label, so
+	// the Deployment exists before the cache is filled
+	client, restore := withAppCache(t, &appsAPI.Deployment{ObjectMeta: metaAPI.ObjectMeta{Namespace: NS, Name: "unselected"}})
+	defer restore()
+
+	for _, action := range client.Actions() {
+		if list, ok := action.(k8sTesting.ListAction); ok {
+			assert.Equal(t, UnidleKeyLabel, list.GetListRestrictions().Labels.String())
+		}
+	}
+
+	assert.Nil(t, appCache.Deployment(NS, "unselected"))
+
+	// Lookups by name of resources not cached go to the kubernetes API
+	misses := testutil.ToFloat64(cacheLookups.WithLabelValues("deployments", "miss"))
+	workload, err := (&deploymentKind{}).FindByName(NS, "unselected")
+	assert.Nil(t, err)
+	assert.Equal(t, "unselected", workload.GetName())
+	assert.Equal(t, misses+1, testutil.ToFloat64(cacheLookups.WithLabelValues("deployments", "miss")))
+}
+
+func TestAppCacheReturnsCopies(t *testing.T) {
+	_, restore := withAppCache(t)
+	defer restore()
+
+	ings := appCache.IngressesByLabel(UnidleKeyLabel, UNIDLE_KEY)
+	assert.Len(t, ings, 1)
+	ings[0].Labels[UnidleKeyLabel] = "changed"
+	assert.Len(t, appCache.IngressesByLabel(UnidleKeyLabel, UNIDLE_KEY), 1)
+	assert.Len(t, appCache.DeploymentsByLabel(NS, UnidleKeyLabel, UNIDLE_KEY), 1)
+	assert.Len(t, appCache.DeploymentsByLabel("other-ns", UnidleKeyLabel, UNIDLE_KEY), 0)
+}
+
+func TestDefaultCacheSelector(t *testing.T) {
+	testCases := []struct {
+		chain    ResolverChain
+		expected string
+	}{
+		{ResolverChain{&labelResolver{}}, UnidleKeyLabel},
+		{ResolverChain{&hashedLabelResolver{label: DEFAULT_HASHED_LABEL}}, DEFAULT_HASHED_LABEL},
+		{ResolverChain{&ingressHostResolver{}}, ""},
+		{ResolverChain{&labelResolver{}, &ingressHostResolver{}}, ""},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, defaultCacheSelector(tc.chain))
+	}
+}
+
+func TestAppCacheServesLookups(t *testing.T) {
+	client, restore := withAppCache(t)
+	defer restore()
+	// Only Deployments are cached, StatefulSets are listed for the app's group
+	defer withWorkloadKinds(&deploymentKind{})()
+
+	lists := countActions(client, "list")
+	a, err := NewApp(HOST, "/", logger, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, NS, a.ingress.Namespace)
+	assert.Equal(t, NAME, a.workload.GetName())
+	assert.Equal(t, NAME, a.service.Name)
+	assert.Equal(t, lists, countActions(client, "list"), "expected lookups to be served by the cache")
+	assert.Len(t, appCache.IngressesByHost(HOST), 1)
+}
+
+func TestAppCacheFollowsWatchEvents(t *testing.T) {
+	client, restore := withAppCache(t)
+	defer restore()
+
+	ing := &extAPI.Ingress{ObjectMeta: metaAPI.ObjectMeta{
+		Namespace: "cache-ns",
+		Name:      "new",
+		Labels:    map[string]string{UnidleKeyLabel: "new-tool"},
+	}}
+	client.ExtensionsV1beta1().Ingresses("cache-ns").Create(ing)
+	waitFor(t, func() bool { return len(appCache.IngressesByLabel(UnidleKeyLabel, "new-tool")) == 1 }, "new Ingress to be cached")
+
+	ing.Labels[UnidleKeyLabel] = "renamed-tool"
+	client.ExtensionsV1beta1().Ingresses("cache-ns").Update(ing)
+	waitFor(t, func() bool { return len(appCache.IngressesByLabel(UnidleKeyLabel, "renamed-tool")) == 1 }, "Ingress update to be cached")
+	assert.Len(t, appCache.IngressesByLabel(UnidleKeyLabel, "new-tool"), 0)
+
+	client.ExtensionsV1beta1().Ingresses("cache-ns").Delete("new", &metaAPI.DeleteOptions{})
+	waitFor(t, func() bool { return len(appCache.IngressesByLabel(UnidleKeyLabel, "renamed-tool")) == 0 }, "Ingress deletion to be cached")
+}
+
+func TestAppCacheRemembersUnknownHosts(t *testing.T) {
+	client, restore := withAppCache(t)
+	defer restore()
+
+	a := &App{host: "unknown-tool.example.com", logger: logger}
+	_, err := a.GetIngress()
+	assert.NotNil(t, err)
+	assert.True(t, appCache.IsUnknown(a.route()))
+
+	negative := testutil.ToFloat64(cacheLookups.WithLabelValues("ingresses", "negative"))
+	lists := countActions(client, "list")
+	_, err = a.GetIngress()
+	assert.Contains(t, err.Error(), "cached")
+	assert.Equal(t, negative+1, testutil.ToFloat64(cacheLookups.WithLabelValues("ingresses", "negative")))
+	assert.Equal(t, lists, countActions(client, "list"))
+
+	// A new Ingress can make the host known
+	client.ExtensionsV1beta1().Ingresses("unknown-ns").Create(&extAPI.Ingress{ObjectMeta: metaAPI.ObjectMeta{
+		Namespace: "unknown-ns",
+		Name:      "unknown",
+		Labels:    map[string]string{UnidleKeyLabel: "unknown-tool"},
+	}})
+	waitFor(t, func() bool { return !appCache.IsUnknown(a.route()) }, "unknown host to be forgotten")
+
+	ingress, err := a.GetIngress()
+	assert.Nil(t, err)
+	assert.Equal(t, "unknown-ns", ingress.Namespace)
+}
+
+func TestAppCacheRemembersUnknownRoutesWithTheirPath(t *testing.T) {
+	_, restore := withAppCache(t)
+	defer restore()
+
+	a := &App{host: "shared-tool.example.com", path: "/missing/", logger: logger}
+	_, err := a.GetIngress()
+	assert.NotNil(t, err)
+	assert.True(t, appCache.IsUnknown(Route{Host: "shared-tool.example.com", Path: "/missing/"}))
+
+	// Another app can be on another path of the same host
+	assert.False(t, appCache.IsUnknown(Route{Host: "shared-tool.example.com", Path: "/other/"}))
+	assert.False(t, appCache.IsUnknown(Route{Host: "shared-tool.example.com"}))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Phases of the cold start of an app's pod
+const (
+	PhaseScheduling     = "scheduling"
+	PhaseImagePull      = "image_pull"
+	PhaseContainerStart = "container_start"
+	PhaseReadiness      = "readiness"
+)
+
+var coldStartPhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "unidler_cold_start_phase_seconds",
+	Help:    "Time spent in each phase of the cold start of unidled apps' pods.",
+	Buckets: DurationBuckets,
+}, []string{"namespace", "phase"})
+
+// ColdStart is the breakdown of the time it took for a pod to become ready
+type ColdStart struct {
+	Pod string
+	// Scheduling is the time from the pod creation to it being scheduled
+	Scheduling time.Duration
+	// ImagePull is the time from the pod being initialized to the images
+	// being pulled (0 when unknown, included in ContainerStart)
+	ImagePull time.Duration
+	// ContainerStart is the time until the containers are running
+	ContainerStart time.Duration
+	// Readiness is the time from the containers running to the pod being
+	// ready (e.g. app start up and readiness probe)
+	Readiness time.Duration
+}
+
+// Phases returns the duration of each phase of the cold start, by phase
+func (c *ColdStart) Phases() map[string]time.Duration {
+	return map[string]time.Duration{
+		PhaseScheduling:     c.Scheduling,
+		PhaseImagePull:      c.ImagePull,
+		PhaseContainerStart: c.ContainerStart,
+		PhaseReadiness:      c.Readiness,
+	}
+}
+
+func (c *ColdStart) String() string {
+	return fmt.Sprintf(
+		"pod=%s scheduling=%s image_pull=%s container_start=%s readiness=%s",
+		c.Pod, c.Scheduling, c.ImagePull, c.ContainerStart, c.Readiness,
+	)
+}
+
+// NewColdStart computes the cold start breakdown of a ready pod from its
+// conditions, its containers state and the image pull events (if any).
+// Returns nil if the pod is not ready
+func NewColdStart(pod *coreAPI.Pod, events []coreAPI.Event) *ColdStart {
+	ready := podConditionTime(pod, coreAPI.PodReady)
+	scheduled := podConditionTime(pod, coreAPI.PodScheduled)
+	if ready == nil || scheduled == nil {
+		return nil
+	}
+
+	initialized := podConditionTime(pod, coreAPI.PodInitialized)
+	if initialized == nil || initialized.Before(scheduled) {
+		initialized = scheduled
+	}
+
+	var running *metaAPI.Time
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Running == nil {
+			continue
+		}
+		startedAt := status.State.Running.StartedAt
+		if running == nil || running.Before(&startedAt) {
+			running = &startedAt
+		}
+	}
+	if running == nil {
+		running = ready
+	}
+
+	pulled := initialized
+	if event := latestEvent(events, "Pulled"); event != nil && !event.LastTimestamp.IsZero() {
+		pulled = &event.LastTimestamp
+		if pulled.Before(initialized) {
+			pulled = initialized
+		}
+		if running.Before(pulled) {
+			pulled = running
+		}
+	}
+
+	return &ColdStart{
+		Pod:            pod.Name,
+		Scheduling:     between(&pod.CreationTimestamp, scheduled),
+		ImagePull:      between(initialized, pulled),
+		ContainerStart: between(pulled, running),
+		Readiness:      between(running, ready),
+	}
+}
+
+// RecordColdStart computes the cold start breakdown of each ready pod created
+// since the App's workloads were scaled up by the unidling, for all the
+// workloads of its group, then records them in the metrics and logs.
+// Nothing is recorded when no workload was scaled up (e.g. the app was
+// already unidled), as its pods didn't cold start
+func (a *App) RecordColdStart() {
+	if len(a.scaledUp) == 0 {
+		a.log("No workload scaled up. Not computing cold start breakdown.")
+		return
+	}
+
+	for _, batch := range a.batches() {
+		for _, workload := range batch {
+			scaledAt, ok := a.scaledUp[workload]
+			if ok {
+				a.recordColdStarts(workload, scaledAt)
+			}
+		}
+	}
+}
+
+// recordColdStarts records the cold start breakdown of the workload's ready
+// pods created since it was scaled up
+func (a *App) recordColdStarts(workload Workload, scaledAt time.Time) {
+	pods, err := workload.Pods()
+	if err != nil {
+		a.logError(err, "Failed to get %s's pods to compute cold start breakdown.", a.describe(workload))
+		return
+	}
+
+	created := newReadyPods(pods, scaledAt)
+	if len(created) == 0 {
+		a.log("No new ready pod of %s to compute cold start breakdown.", a.describe(workload))
+		return
+	}
+
+	for _, pod := range created {
+		events, err := podEvents(pod)
+		if err != nil {
+			// Image pull time will be included in container start
+			a.logError(err, "Failed to get pod events to compute cold start breakdown.")
+		}
+
+		coldStart := NewColdStart(pod, events)
+		for phase, duration := range coldStart.Phases() {
+			observe(coldStartPhaseDuration, duration.Seconds(), workload.GetNamespace(), phase)
+		}
+		fields := Fields{"pod": coldStart.Pod, "workload": workload.GetName()}
+		for phase, duration := range coldStart.Phases() {
+			fields[phase] = duration.Seconds()
+		}
+		a.logger.With(fields).Info("Cold start breakdown: %s", coldStart)
+	}
+}
+
+// newReadyPods returns the pods created since the given time which are
+// scheduled and ready
+func newReadyPods(pods []coreAPI.Pod, since time.Time) []*coreAPI.Pod {
+	created := []*coreAPI.Pod{}
+	for i := range pods {
+		if pods[i].CreationTimestamp.Time.Before(since) {
+			continue
+		}
+		if podConditionTime(&pods[i], coreAPI.PodReady) == nil || podConditionTime(&pods[i], coreAPI.PodScheduled) == nil {
+			continue
+		}
+		created = append(created, &pods[i])
+	}
+	return created
+}
+
+// podConditionTime returns the time the pod condition became true, or nil if
+// it isn't true
+func podConditionTime(pod *coreAPI.Pod, condType coreAPI.PodConditionType) *metaAPI.Time {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == condType && cond.Status == coreAPI.ConditionTrue {
+			t := cond.LastTransitionTime
+			return &t
+		}
+	}
+	return nil
+}
+
+// between returns the time elapsed between from and to, 0 if negative
+// (e.g. because of clock skew)
+func between(from *metaAPI.Time, to *metaAPI.Time) time.Duration {
+	d := to.Sub(from.Time)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
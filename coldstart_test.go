@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewColdStart(t *testing.T) {
+	created := time.Date(2019, 11, 1, 9, 0, 0, 0, time.UTC)
+	at := func(seconds int) metaAPI.Time {
+		return metaAPI.NewTime(created.Add(time.Duration(seconds) * time.Second))
+	}
+
+	pod := &coreAPI.Pod{
+		ObjectMeta: metaAPI.ObjectMeta{
+			Name:              "test-pod",
+			CreationTimestamp: at(0),
+		},
+		Status: coreAPI.PodStatus{
+			Conditions: []coreAPI.PodCondition{
+				{Type: coreAPI.PodScheduled, Status: coreAPI.ConditionTrue, LastTransitionTime: at(40)},
+				{Type: coreAPI.PodInitialized, Status: coreAPI.ConditionTrue, LastTransitionTime: at(41)},
+				{Type: coreAPI.PodReady, Status: coreAPI.ConditionTrue, LastTransitionTime: at(150)},
+			},
+			ContainerStatuses: []coreAPI.ContainerStatus{
+				{
+					Name:  "app",
+					State: coreAPI.ContainerState{Running: &coreAPI.ContainerStateRunning{StartedAt: at(100)}},
+				},
+			},
+		},
+	}
+	events := []coreAPI.Event{
+		{Reason: "Pulling", LastTimestamp: at(42)},
+		{Reason: "Pulled", LastTimestamp: at(95)},
+	}
+
+	coldStart := NewColdStart(pod, events)
+
+	assert.Equal(t, 40*time.Second, coldStart.Scheduling)
+	assert.Equal(t, 54*time.Second, coldStart.ImagePull)
+	assert.Equal(t, 5*time.Second, coldStart.ContainerStart)
+	assert.Equal(t, 50*time.Second, coldStart.Readiness)
+
+	// Without events image pull is included in container start
+	coldStart = NewColdStart(pod, nil)
+	assert.Equal(t, time.Duration(0), coldStart.ImagePull)
+	assert.Equal(t, 59*time.Second, coldStart.ContainerStart)
+
+	// Not ready pods have no breakdown
+	pod.Status.Conditions = pod.Status.Conditions[:1]
+	assert.Nil(t, NewColdStart(pod, events))
+}
+
+func TestNewReadyPods(t *testing.T) {
+	scaledAt := time.Date(2019, 11, 1, 9, 0, 0, 0, time.UTC)
+	pod := func(name string, created time.Time, conditions ...coreAPI.PodConditionType) coreAPI.Pod {
+		pod := coreAPI.Pod{ObjectMeta: metaAPI.ObjectMeta{Name: name, CreationTimestamp: metaAPI.NewTime(created)}}
+		for _, condType := range conditions {
+			pod.Status.Conditions = append(pod.Status.Conditions, coreAPI.PodCondition{Type: condType, Status: coreAPI.ConditionTrue})
+		}
+		return pod
+	}
+	pods := []coreAPI.Pod{
+		pod("before-scale-up", scaledAt.Add(-time.Hour), coreAPI.PodScheduled, coreAPI.PodReady),
+		pod("new", scaledAt, coreAPI.PodScheduled, coreAPI.PodReady),
+		pod("not-ready", scaledAt.Add(time.Second), coreAPI.PodScheduled),
+		pod("other-new", scaledAt.Add(2*time.Second), coreAPI.PodScheduled, coreAPI.PodReady),
+	}
+
+	names := []string{}
+	for _, pod := range newReadyPods(pods, scaledAt) {
+		names = append(names, pod.Name)
+	}
+
+	assert.Equal(t, []string{"new", "other-new"}, names)
+}
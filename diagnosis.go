@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	appsAPI "k8s.io/api/apps/v1"
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RevisionAnnotation is the annotation kubernetes uses to keep track of the
+// revision of a Deployment and of its ReplicaSets
+const RevisionAnnotation = "deployment.kubernetes.io/revision"
+
+const (
+	// CRASH_LOOP_RESTARTS is the number of restarts after which a container
+	// crashing on start up is a terminal failure. Crashes during a cold start
+	// are often transient (e.g. a dependency still starting)
+	CRASH_LOOP_RESTARTS = 3
+	// DEFAULT_BACKOFF_TIMEOUT is how long kubernetes can back off retrying
+	// (e.g. pulling the image) before it's a terminal failure
+	DEFAULT_BACKOFF_TIMEOUT = 2 * time.Minute
+)
+
+// BackOffTimeout is how long kubernetes can back off retrying before it's a
+// terminal failure, see `BACKOFF_TIMEOUT`
+var BackOffTimeout = DEFAULT_BACKOFF_TIMEOUT
+
+// Diagnosis explains why an app is not coming up
+type Diagnosis struct {
+	// Reason is the kubernetes reason of the failure, e.g. "CrashLoopBackOff"
+	Reason string
+	// Message is a user-friendly explanation of the failure
+	Message string
+	// Terminal is true when the app is not expected to come up without
+	// human intervention
+	Terminal bool
+	// BackOff is true when kubernetes backs off retrying (e.g. pulling the
+	// image), which is often transient (e.g. registry hiccup). It's a
+	// terminal failure once it lasted BackOffTimeout, see progressReporter
+	BackOff bool
+}
+
+// Diagnose inspects the Deployment and the pods of its current ReplicaSet
+// and returns the reason why the app is not coming up, or nil if nothing is
+// wrong (yet)
+func Diagnose(dep *appsAPI.Deployment, pods []coreAPI.Pod) (*Diagnosis, error) {
+	for _, cond := range dep.Status.Conditions {
+		if cond.Type == appsAPI.DeploymentProgressing && cond.Reason == "ProgressDeadlineExceeded" {
+			return &Diagnosis{
+				Reason:   cond.Reason,
+				Message:  fmt.Sprintf("Your app failed to start in time: %s", cond.Message),
+				Terminal: true,
+			}, nil
+		}
+	}
+
+	return DiagnosePods(pods)
+}
+
+// DiagnosePods inspects the pods of a workload and returns the reason why
+// the app is not coming up, or nil if nothing is wrong (yet)
+func DiagnosePods(pods []coreAPI.Pod) (*Diagnosis, error) {
+	var diagnosis *Diagnosis
+	for _, pod := range pods {
+		d, err := diagnosePod(&pod)
+		if err != nil {
+			return nil, err
+		}
+		// Terminal failures take precedence
+		if d != nil && (diagnosis == nil || d.Terminal) {
+			diagnosis = d
+		}
+		if diagnosis != nil && diagnosis.Terminal {
+			break
+		}
+	}
+	return diagnosis, nil
+}
+
+// deploymentPods returns the pods of the Deployment's current ReplicaSet, or
+// all the pods matching the Deployment's selector when that's not known
+func deploymentPods(dep *appsAPI.Deployment) ([]coreAPI.Pod, error) {
+	if dep.Spec.Selector == nil {
+		return nil, nil
+	}
+
+	selector, err := metaAPI.LabelSelectorAsSelector(dep.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Deployment selector: %s", err)
+	}
+
+	start := time.Now()
+	rss, err := k8sClient.AppsV1().ReplicaSets(dep.Namespace).List(metaAPI.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	observeKubernetesRequest("list", "replicasets", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing replicasets: %s", err)
+	}
+	for _, rs := range rss.Items {
+		owner := metaAPI.GetControllerOf(&rs)
+		if owner == nil || owner.UID != dep.UID {
+			continue
+		}
+		if rs.Annotations[RevisionAnnotation] != dep.Annotations[RevisionAnnotation] {
+			continue
+		}
+		selector, err = metaAPI.LabelSelectorAsSelector(rs.Spec.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ReplicaSet selector: %s", err)
+		}
+		break
+	}
+
+	return listPods(dep.Namespace, selector.String())
+}
+
+func diagnosePod(pod *coreAPI.Pod) (*Diagnosis, error) {
+	statuses := append([]coreAPI.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+
+	for _, status := range statuses {
+		if d := diagnoseContainer(&status); d != nil {
+			return d, nil
+		}
+	}
+
+	if pod.Status.Phase == coreAPI.PodPending {
+		for _, cond := range pod.Status.Conditions {
+			if cond.Type == coreAPI.PodScheduled && cond.Status == coreAPI.ConditionFalse && cond.Reason == coreAPI.PodReasonUnschedulable {
+				return diagnoseUnschedulable(pod, cond.Message)
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func diagnoseContainer(status *coreAPI.ContainerStatus) *Diagnosis {
+	oomKilled := false
+	if terminated := status.LastTerminationState.Terminated; terminated != nil && terminated.Reason == "OOMKilled" {
+		oomKilled = true
+	}
+	if terminated := status.State.Terminated; terminated != nil && terminated.Reason == "OOMKilled" {
+		oomKilled = true
+	}
+
+	waiting := status.State.Waiting
+	if waiting != nil {
+		switch waiting.Reason {
+		case "ImagePullBackOff":
+			return &Diagnosis{
+				Reason:  waiting.Reason,
+				Message: fmt.Sprintf("Your app's image '%s' could not be pulled. Please check the image exists and is accessible.", status.Image),
+				BackOff: true,
+			}
+		case "InvalidImageName":
+			return &Diagnosis{
+				Reason:   waiting.Reason,
+				Message:  fmt.Sprintf("Your app's image '%s' could not be pulled. Please check the image exists and is accessible.", status.Image),
+				Terminal: true,
+			}
+		case "ErrImagePull":
+			return &Diagnosis{
+				Reason:  waiting.Reason,
+				Message: fmt.Sprintf("Failed to pull your app's image '%s'. Retrying...", status.Image),
+			}
+		case "CrashLoopBackOff":
+			if status.RestartCount < CRASH_LOOP_RESTARTS {
+				if oomKilled {
+					break
+				}
+				return &Diagnosis{
+					Reason:  waiting.Reason,
+					Message: fmt.Sprintf("Your app crashed on start up (container '%s' restarted %d times). Restarting it...", status.Name, status.RestartCount),
+				}
+			}
+			if oomKilled {
+				return &Diagnosis{
+					Reason:   "OOMKilled",
+					Message:  fmt.Sprintf("Your app keeps running out of memory on start up (container '%s').", status.Name),
+					Terminal: true,
+				}
+			}
+			return &Diagnosis{
+				Reason:   waiting.Reason,
+				Message:  fmt.Sprintf("Your app keeps crashing on start up (container '%s' restarted %d times).", status.Name, status.RestartCount),
+				Terminal: true,
+			}
+		}
+	}
+
+	if oomKilled {
+		return &Diagnosis{
+			Reason:  "OOMKilled",
+			Message: fmt.Sprintf("Your app ran out of memory (container '%s'). Restarting it...", status.Name),
+		}
+	}
+	return nil
+}
+
+// diagnoseUnschedulable explains why a pod can't be scheduled, using the
+// latest FailedScheduling event if there is one. This is not terminal as
+// the cluster could scale up to make room for the app
+func diagnoseUnschedulable(pod *coreAPI.Pod, reason string) (*Diagnosis, error) {
+	events, err := podEvents(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	if latest := latestEvent(events, "FailedScheduling"); latest != nil {
+		reason = latest.Message
+	}
+	if reason != "" {
+		reason = fmt.Sprintf(" (%s)", reason)
+	}
+
+	return &Diagnosis{
+		Reason:  coreAPI.PodReasonUnschedulable,
+		Message: fmt.Sprintf("There isn't enough capacity in the cluster to start your app yet%s. Waiting for capacity to become available...", reason),
+	}, nil
+}
+
+// podEvents returns the events about the given pod
+func podEvents(pod *coreAPI.Pod) ([]coreAPI.Event, error) {
+	start := time.Now()
+	events, err := k8sClient.CoreV1().Events(pod.Namespace).List(metaAPI.ListOptions{
+		FieldSelector: fmt.Sprintf("involvedObject.name=%s", pod.Name),
+	})
+	observeKubernetesRequest("list", "events", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing events: %s", err)
+	}
+
+	podEvents := []coreAPI.Event{}
+	for _, event := range events.Items {
+		if event.InvolvedObject.Name == pod.Name {
+			podEvents = append(podEvents, event)
+		}
+	}
+	return podEvents, nil
+}
+
+// latestEvent returns the most recent of the events with the given reason,
+// or nil if there are none
+func latestEvent(events []coreAPI.Event, reason string) *coreAPI.Event {
+	var latest *coreAPI.Event
+	for i, event := range events {
+		if event.Reason != reason {
+			continue
+		}
+		if latest == nil || latest.LastTimestamp.Before(&event.LastTimestamp) {
+			latest = &events[i]
+		}
+	}
+	return latest
+}
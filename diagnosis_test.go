@@ -0,0 +1,254 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	appsAPI "k8s.io/api/apps/v1"
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const DIAGNOSIS_NS = "diagnosis-ns"
+
+func TestDiagnoseProgressDeadlineExceeded(t *testing.T) {
+	dep := &appsAPI.Deployment{
+		Status: appsAPI.DeploymentStatus{
+			Conditions: []appsAPI.DeploymentCondition{
+				{
+					Type:    appsAPI.DeploymentProgressing,
+					Reason:  "ProgressDeadlineExceeded",
+					Message: `ReplicaSet "test-123" has timed out progressing.`,
+				},
+			},
+		},
+	}
+
+	diagnosis, err := Diagnose(dep, nil)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "ProgressDeadlineExceeded", diagnosis.Reason)
+	assert.True(t, diagnosis.Terminal)
+}
+
+func TestDiagnosePods(t *testing.T) {
+	testCases := []struct {
+		name     string
+		status   coreAPI.PodStatus
+		reason   string
+		terminal bool
+	}{
+		{
+			name:   "healthy",
+			status: coreAPI.PodStatus{Phase: coreAPI.PodRunning},
+		},
+		{
+			name:   "image-pull-backoff",
+			status: waitingPodStatus("ImagePullBackOff", nil),
+			reason: "ImagePullBackOff",
+		},
+		{
+			name:     "invalid-image-name",
+			status:   waitingPodStatus("InvalidImageName", nil),
+			reason:   "InvalidImageName",
+			terminal: true,
+		},
+		{
+			name:   "crash-loop-backoff",
+			status: restarted(waitingPodStatus("CrashLoopBackOff", nil), 1),
+			reason: "CrashLoopBackOff",
+		},
+		{
+			name:     "crash-loop-backoff-restarted",
+			status:   restarted(waitingPodStatus("CrashLoopBackOff", nil), CRASH_LOOP_RESTARTS),
+			reason:   "CrashLoopBackOff",
+			terminal: true,
+		},
+		{
+			name: "oom-killed",
+			status: waitingPodStatus("CrashLoopBackOff", &coreAPI.ContainerStateTerminated{
+				Reason: "OOMKilled",
+			}),
+			reason: "OOMKilled",
+		},
+		{
+			name: "oom-killed-restarted",
+			status: restarted(waitingPodStatus("CrashLoopBackOff", &coreAPI.ContainerStateTerminated{
+				Reason: "OOMKilled",
+			}), CRASH_LOOP_RESTARTS),
+			reason:   "OOMKilled",
+			terminal: true,
+		},
+		{
+			name: "unschedulable",
+			status: coreAPI.PodStatus{
+				Phase: coreAPI.PodPending,
+				Conditions: []coreAPI.PodCondition{
+					{
+						Type:   coreAPI.PodScheduled,
+						Status: coreAPI.ConditionFalse,
+						Reason: coreAPI.PodReasonUnschedulable,
+					},
+				},
+			},
+			reason: "Unschedulable",
+		},
+	}
+
+	for _, tc := range testCases {
+		dep := mockDiagnosedDeployment(tc.name, tc.status)
+
+		pods, err := deploymentPods(dep)
+		assert.Nil(t, err, tc.name)
+		assert.Equal(t, 1, len(pods), tc.name)
+
+		diagnosis, err := Diagnose(dep, pods)
+
+		assert.Nil(t, err, tc.name)
+		if tc.reason == "" {
+			assert.Nil(t, diagnosis, tc.name)
+			continue
+		}
+		assert.Equal(t, tc.reason, diagnosis.Reason, tc.name)
+		assert.Equal(t, tc.terminal, diagnosis.Terminal, tc.name)
+	}
+}
+
+func TestDiagnoseUnschedulableUsesFailedSchedulingEvent(t *testing.T) {
+	dep := mockDiagnosedDeployment("no-capacity", coreAPI.PodStatus{
+		Phase: coreAPI.PodPending,
+		Conditions: []coreAPI.PodCondition{
+			{
+				Type:   coreAPI.PodScheduled,
+				Status: coreAPI.ConditionFalse,
+				Reason: coreAPI.PodReasonUnschedulable,
+			},
+		},
+	})
+	k8sClient.CoreV1().Events(DIAGNOSIS_NS).Create(&coreAPI.Event{
+		ObjectMeta: metaAPI.ObjectMeta{Name: "no-capacity-pod.1"},
+		InvolvedObject: coreAPI.ObjectReference{
+			Kind: "Pod",
+			Name: "no-capacity-pod",
+		},
+		Reason:  "FailedScheduling",
+		Message: "0/3 nodes are available: 3 Insufficient memory.",
+	})
+
+	pods, _ := deploymentPods(dep)
+	diagnosis, err := Diagnose(dep, pods)
+
+	assert.Nil(t, err)
+	assert.False(t, diagnosis.Terminal)
+	assert.Contains(t, diagnosis.Message, "3 Insufficient memory")
+}
+
+func TestProgressReporterWaitsForBackOffs(t *testing.T) {
+	defer func(timeout time.Duration) { BackOffTimeout = timeout }(BackOffTimeout)
+	BackOffTimeout = 50 * time.Millisecond
+
+	dep := mockDiagnosedDeployment("backing-off", coreAPI.PodStatus{})
+	a := &App{host: HOST, workload: (*Deployment)(dep), logger: logger}
+	progress := a.progressReporter(a.workload, func(*Update) {})
+	status := &ReplicasStatus{Desired: 1}
+	check := func(podStatus coreAPI.PodStatus) error {
+		diagnosis, err := DiagnosePods([]coreAPI.Pod{{Status: podStatus}})
+		assert.Nil(t, err)
+		return progress(status, nil, diagnosis)
+	}
+
+	// The image pull backs off once, the app crashes once, then it recovers
+	assert.Nil(t, check(waitingPodStatus("ImagePullBackOff", nil)))
+	assert.Nil(t, check(restarted(waitingPodStatus("CrashLoopBackOff", nil), 1)))
+	assert.Nil(t, check(coreAPI.PodStatus{Phase: coreAPI.PodRunning}))
+
+	// Backing off for longer than BackOffTimeout is terminal
+	assert.Nil(t, check(waitingPodStatus("ImagePullBackOff", nil)))
+	time.Sleep(2 * BackOffTimeout)
+	err := check(waitingPodStatus("ImagePullBackOff", nil))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "could not be pulled")
+	}
+}
+
+// restarted sets the restart count of the pod's container
+func restarted(status coreAPI.PodStatus, count int32) coreAPI.PodStatus {
+	status.ContainerStatuses[0].RestartCount = count
+	return status
+}
+
+func waitingPodStatus(reason string, lastTerminated *coreAPI.ContainerStateTerminated) coreAPI.PodStatus {
+	return coreAPI.PodStatus{
+		Phase: coreAPI.PodPending,
+		ContainerStatuses: []coreAPI.ContainerStatus{
+			{
+				Name:  "app",
+				Image: "quay.io/mojanalytics/test:1.0",
+				State: coreAPI.ContainerState{
+					Waiting: &coreAPI.ContainerStateWaiting{Reason: reason},
+				},
+				LastTerminationState: coreAPI.ContainerState{
+					Terminated: lastTerminated,
+				},
+			},
+		},
+	}
+}
+
+// mockDiagnosedDeployment creates a Deployment, its ReplicaSet and a pod with
+// the given status. It also creates a pod from an old ReplicaSet which must
+// be ignored
+func mockDiagnosedDeployment(name string, status coreAPI.PodStatus) *appsAPI.Deployment {
+	selector := &metaAPI.LabelSelector{
+		MatchLabels: map[string]string{"app": name},
+	}
+	dep := &appsAPI.Deployment{
+		ObjectMeta: metaAPI.ObjectMeta{
+			Name:        name,
+			Namespace:   DIAGNOSIS_NS,
+			UID:         types.UID(name + "-uid"),
+			Annotations: map[string]string{RevisionAnnotation: "2"},
+		},
+		Spec: appsAPI.DeploymentSpec{Selector: selector},
+	}
+	k8sClient.AppsV1().Deployments(DIAGNOSIS_NS).Create(dep)
+
+	controller := true
+	for revision, hash := range map[string]string{"1": "old", "2": "new"} {
+		k8sClient.AppsV1().ReplicaSets(DIAGNOSIS_NS).Create(&appsAPI.ReplicaSet{
+			ObjectMeta: metaAPI.ObjectMeta{
+				Name:        name + "-" + hash,
+				Labels:      map[string]string{"app": name, "pod-template-hash": hash},
+				Annotations: map[string]string{RevisionAnnotation: revision},
+				OwnerReferences: []metaAPI.OwnerReference{
+					{Kind: "Deployment", Name: name, UID: dep.UID, Controller: &controller},
+				},
+			},
+			Spec: appsAPI.ReplicaSetSpec{
+				Selector: &metaAPI.LabelSelector{
+					MatchLabels: map[string]string{"app": name, "pod-template-hash": hash},
+				},
+			},
+		})
+	}
+
+	k8sClient.CoreV1().Pods(DIAGNOSIS_NS).Create(&coreAPI.Pod{
+		ObjectMeta: metaAPI.ObjectMeta{
+			Name:   name + "-pod",
+			Labels: map[string]string{"app": name, "pod-template-hash": "new"},
+		},
+		Status: status,
+	})
+	k8sClient.CoreV1().Pods(DIAGNOSIS_NS).Create(&coreAPI.Pod{
+		ObjectMeta: metaAPI.ObjectMeta{
+			Name:   name + "-old-pod",
+			Labels: map[string]string{"app": name, "pod-template-hash": "old"},
+		},
+		Status: waitingPodStatus("ImagePullBackOff", nil),
+	})
+
+	return dep
+}
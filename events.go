@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Reasons of the kubernetes Events recorded on the app's resources
+const (
+	EventUnidleStarted        = "UnidleStarted"
+	EventReplicasRestored     = "ReplicasRestored"
+	EventReady                = "Ready"
+	EventIdledMetadataRemoved = "IdledMetadataRemoved"
+	EventServiceRedirected    = "ServiceRedirected"
+	EventTrafficSwitched      = "TrafficSwitched"
+	EventUnidleFailed         = "UnidleFailed"
+	EventIdled                = "Idled"
+	EventWakeExpirySet        = "WakeExpirySet"
+	EventPinned               = "Pinned"
+	EventUnpinned             = "Unpinned"
+	EventPinExpired           = "PinExpired"
+)
+
+// recordEvent records a kubernetes Event on the given object of the app.
+// Failing to record it is logged but doesn't stop the unidling
+func (a *App) recordEvent(object *coreAPI.ObjectReference, eventType string, reason string, message string) {
+	now := metaAPI.NewTime(time.Now())
+	event := &coreAPI.Event{
+		ObjectMeta: metaAPI.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", object.Name, now.UnixNano()),
+			Namespace: object.Namespace,
+		},
+		InvolvedObject: *object,
+		Reason:         reason,
+		Message:        message,
+		Source:         coreAPI.EventSource{Component: UnidlerName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+
+	start := time.Now()
+	_, err := k8sClient.CoreV1().Events(object.Namespace).Create(event)
+	observeKubernetesRequest("create", "events", start, err)
+	if err != nil {
+		a.logError(err, "Failed to record %s Event on %s.", reason, object.Kind)
+	}
+}
+
+// RecordWorkloadEvent records a kubernetes Event on the App's workload
+func (a *App) RecordWorkloadEvent(eventType string, reason string, format string, args ...interface{}) {
+	a.recordWorkloadEvent(a.workload, eventType, reason, format, args...)
+}
+
+// recordWorkloadEvent records a kubernetes Event on one of the App's
+// workloads, see App.group
+func (a *App) recordWorkloadEvent(workload Workload, eventType string, reason string, format string, args ...interface{}) {
+	a.recordEvent(workload.Reference(), eventType, reason, fmt.Sprintf(format, args...))
+}
+
+// RecordServiceEvent records a kubernetes Event on the App's Service
+func (a *App) RecordServiceEvent(eventType string, reason string, format string, args ...interface{}) {
+	a.recordEvent(&coreAPI.ObjectReference{
+		APIVersion:      "v1",
+		Kind:            "Service",
+		Namespace:       a.service.Namespace,
+		Name:            a.service.Name,
+		UID:             a.service.UID,
+		ResourceVersion: a.service.ResourceVersion,
+	}, eventType, reason, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	appsAPI "k8s.io/api/apps/v1"
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUnidlingRecordsEvents(t *testing.T) {
+	const ns = "events-ns"
+	dep := mockDeployment(k8sClient, ns, NAME, HOST)
+	dep.Status.AvailableReplicas = 1
+	status := appsAPI.Deployment(dep)
+	k8sClient.Apps().Deployments(ns).UpdateStatus(&status)
+	service := mockService(k8sClient, ns, NAME, HOST)
+	a := &App{host: HOST, workload: &dep, service: &service, logger: app.logger}
+
+	assert.Nil(t, a.SetReplicas())
+	assert.Nil(t, a.WaitForWorkload(func(*Update) {}))
+	assert.Nil(t, a.RemoveIdledMetadata("test-request-id"))
+	assert.Nil(t, a.RedirectService())
+	a.RecordWorkloadEvent(coreAPI.EventTypeWarning, EventUnidleFailed, "Unidling failed at step %s: %s", StepWait, "boom")
+
+	events, err := k8sClient.CoreV1().Events(ns).List(metaAPI.ListOptions{})
+	assert.Nil(t, err)
+
+	deploymentEvents := map[string]coreAPI.Event{}
+	serviceEvents := map[string]coreAPI.Event{}
+	for _, event := range events.Items {
+		assert.Equal(t, UnidlerName, event.Source.Component)
+		assert.Equal(t, NAME, event.InvolvedObject.Name)
+		assert.Equal(t, ns, event.InvolvedObject.Namespace)
+		switch event.InvolvedObject.Kind {
+		case "Deployment":
+			deploymentEvents[event.Reason] = event
+		case "Service":
+			serviceEvents[event.Reason] = event
+		}
+	}
+
+	assert.Equal(t, "Restored replicas to 1.", deploymentEvents[EventReplicasRestored].Message)
+	assert.Equal(t, "App ready with 1 available replica(s).", deploymentEvents[EventReady].Message)
+	assert.Contains(t, deploymentEvents, EventIdledMetadataRemoved)
+	assert.Contains(t, deploymentEvents, EventServiceRedirected)
+	assert.Contains(t, serviceEvents, EventServiceRedirected)
+
+	failed := deploymentEvents[EventUnidleFailed]
+	assert.Equal(t, coreAPI.EventTypeWarning, failed.Type)
+	assert.Equal(t, "Unidling failed at step wait: boom", failed.Message)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnidleAfterAnnotation is a workload annotation with the comma-separated
+// names of the workloads of the app's group which must be ready before it's
+// started, e.g. `cache` on the web front end to start the cache first
+const UnidleAfterAnnotation = "mojanalytics.xyz/unidle-after"
+
+// States of the components of an app group, see ComponentStatus
+const (
+	ComponentIdled    = "idled"
+	ComponentStarting = "starting"
+	ComponentReady    = "ready"
+)
+
+// ComponentStatus is the state of one of the workloads of an app group
+type ComponentStatus struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// State is one of "idled", "starting" or "ready"
+	State string `json:"state"`
+}
+
+// unidleAfter returns the names of the workloads the workload depends on,
+// from its UnidleAfterAnnotation
+func unidleAfter(workload Workload) []string {
+	names := []string{}
+	for _, name := range strings.Split(workload.GetAnnotations()[UnidleAfterAnnotation], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// unidleOrder sorts the workloads of an app group in batches, started one
+// after the other: the workloads of a batch only depend on workloads of the
+// previous batches. It fails when a workload depends on one which isn't in
+// the group or when the dependencies are circular
+func unidleOrder(workloads []Workload) ([][]Workload, error) {
+	byName := map[string][]int{}
+	for i, workload := range workloads {
+		byName[workload.GetName()] = append(byName[workload.GetName()], i)
+	}
+	dependencies := make([][]int, len(workloads))
+	for i, workload := range workloads {
+		for _, name := range unidleAfter(workload) {
+			matches, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("%s %s depends on %s, which is not part of the app", workloadKind(workload), workload.GetName(), name)
+			}
+			dependencies[i] = append(dependencies[i], matches...)
+		}
+	}
+
+	started := make([]bool, len(workloads))
+	batches := [][]Workload{}
+	for remaining := len(workloads); remaining > 0; {
+		batch := []int{}
+		for i := range workloads {
+			if !started[i] && allStarted(dependencies[i], started) {
+				batch = append(batch, i)
+			}
+		}
+		if len(batch) == 0 {
+			names := []string{}
+			for i, workload := range workloads {
+				if !started[i] {
+					names = append(names, workload.GetName())
+				}
+			}
+			return nil, fmt.Errorf("circular dependencies between %s", strings.Join(names, ", "))
+		}
+
+		workloadsBatch := []Workload{}
+		for _, i := range batch {
+			started[i] = true
+			workloadsBatch = append(workloadsBatch, workloads[i])
+		}
+		batches = append(batches, workloadsBatch)
+		remaining -= len(batch)
+	}
+	return batches, nil
+}
+
+func allStarted(dependencies []int, started []bool) bool {
+	for _, i := range dependencies {
+		if !started[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// batches returns the App's workloads in the order they're started, see
+// unidleOrder. It's only the App's workload when it isn't part of a group
+func (a *App) batches() [][]Workload {
+	if len(a.group) == 0 {
+		return [][]Workload{{a.workload}}
+	}
+	return a.group
+}
+
+// grouped returns true if the App has other workloads than its own
+func (a *App) grouped() bool {
+	batches := a.batches()
+	return len(batches) > 1 || len(batches[0]) > 1
+}
+
+// describe returns how the workload is referred to in the logs: its kind,
+// followed by its name when it's not the App's workload
+func (a *App) describe(workload Workload) string {
+	if workload == a.workload {
+		return workloadKind(workload)
+	}
+	return fmt.Sprintf("%s %s", workloadKind(workload), workload.GetName())
+}
+
+// componentStatuses returns the state of each of the App's workloads, in
+// the order they're started. Those not in `states` are still idled
+func (a *App) componentStatuses(states map[Workload]string) []ComponentStatus {
+	statuses := []ComponentStatus{}
+	for _, batch := range a.batches() {
+		for _, workload := range batch {
+			state, ok := states[workload]
+			if !ok {
+				state = ComponentIdled
+			}
+			statuses = append(statuses, ComponentStatus{
+				Name:  workload.GetName(),
+				Kind:  workloadKind(workload),
+				State: state,
+			})
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	appsAPI "k8s.io/api/apps/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func batchNames(batches [][]Workload) [][]string {
+	names := [][]string{}
+	for _, batch := range batches {
+		batchNames := []string{}
+		for _, workload := range batch {
+			batchNames = append(batchNames, workload.GetName())
+		}
+		names = append(names, batchNames)
+	}
+	return names
+}
+
+func groupWorkload(name string, after string) Workload {
+	annotations := map[string]string{}
+	if after != "" {
+		annotations[UnidleAfterAnnotation] = after
+	}
+	return &Deployment{ObjectMeta: metaAPI.ObjectMeta{Name: name, Annotations: annotations}}
+}
+
+func TestUnidleOrder(t *testing.T) {
+	batches, err := unidleOrder([]Workload{
+		groupWorkload("web", "cache, worker"),
+		groupWorkload("worker", "cache"),
+		groupWorkload("cache", ""),
+		groupWorkload("metrics", ""),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"cache", "metrics"}, {"worker"}, {"web"}}, batchNames(batches))
+
+	_, err = unidleOrder([]Workload{groupWorkload("web", "cahce")})
+	assert.Equal(t, "Deployment web depends on cahce, which is not part of the app", err.Error())
+
+	_, err = unidleOrder([]Workload{
+		groupWorkload("web", "worker"),
+		groupWorkload("worker", "web"),
+		groupWorkload("cache", ""),
+	})
+	assert.Equal(t, "circular dependencies between web, worker", err.Error())
+}
+
+func TestUnidleAppGroup(t *testing.T) {
+	const host = "group.example.com"
+	const ns = "group-ns"
+	defer func(interval time.Duration) { DiagnosisInterval = interval }(DiagnosisInterval)
+	DiagnosisInterval = 10 * time.Millisecond
+
+	labels := map[string]string{UnidleKeyLabel: unidleKey(host), IdledLabel: "true"}
+	client, restore := withResolvers(&labelResolver{})
+	defer restore()
+	mockApp(client, ns, "web", host, "/", labels)
+
+	// The web front end starts after the cache, the worker straight away.
+	// The Deployments are already available
+	zero := int32(0)
+	for name, after := range map[string]string{"web": "cache", "worker": ""} {
+		client.AppsV1().Deployments(ns).Delete(name, nil)
+		client.AppsV1().Deployments(ns).Create(&appsAPI.Deployment{
+			ObjectMeta: metaAPI.ObjectMeta{
+				Namespace:   ns,
+				Name:        name,
+				Labels:      labels,
+				Annotations: map[string]string{UnidleAfterAnnotation: after},
+			},
+			Spec:   appsAPI.DeploymentSpec{Replicas: &zero},
+			Status: appsAPI.DeploymentStatus{AvailableReplicas: 1},
+		})
+	}
+	client.AppsV1().StatefulSets(ns).Create(&appsAPI.StatefulSet{
+		ObjectMeta: metaAPI.ObjectMeta{
+			Namespace:   ns,
+			Name:        "cache",
+			Labels:      labels,
+			Annotations: map[string]string{ReplicasWhenUnidledAnnotation: "2"},
+		},
+		Spec: appsAPI.StatefulSetSpec{Replicas: &zero},
+	})
+	replicas := func(kind string, name string) int32 {
+		if kind == "StatefulSet" {
+			sts, _ := client.AppsV1().StatefulSets(ns).Get(name, metaAPI.GetOptions{})
+			return *sts.Spec.Replicas
+		}
+		dep, _ := client.AppsV1().Deployments(ns).Get(name, metaAPI.GetOptions{})
+		return *dep.Spec.Replicas
+	}
+
+	a, err := NewApp(host, "/", logger, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "web", a.workload.GetName())
+	assert.Equal(t, [][]string{{"worker", "cache"}, {"web"}}, batchNames(a.batches()))
+
+	// Only the workloads without dependencies are started first
+	assert.Nil(t, a.SetReplicas())
+	assert.Equal(t, int32(1), replicas("Deployment", "worker"))
+	assert.Equal(t, int32(2), replicas("StatefulSet", "cache"))
+	assert.Equal(t, int32(0), replicas("Deployment", "web"))
+
+	// The web front end is started once the cache is ready
+	updates := []*Update{}
+	err = a.WaitForWorkload(func(update *Update) {
+		updates = append(updates, update)
+		cache, _ := client.AppsV1().StatefulSets(ns).Get("cache", metaAPI.GetOptions{})
+		cache.Status.ReadyReplicas = 1
+		client.AppsV1().StatefulSets(ns).UpdateStatus(cache)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), replicas("Deployment", "web"))
+	if assert.Len(t, updates, 1) {
+		assert.Equal(t, "cache: "+StartingMessage, updates[0].Message)
+		assert.Equal(t, []ComponentStatus{
+			{Name: "worker", Kind: "Deployment", State: ComponentReady},
+			{Name: "cache", Kind: "StatefulSet", State: ComponentStarting},
+			{Name: "web", Kind: "Deployment", State: ComponentIdled},
+		}, updates[0].Components)
+	}
+
+	// NOTE: The fake patch doesn't remove, the patches are checked instead
+	patches := countActions(client, "patch")
+	assert.Nil(t, a.RemoveIdledMetadata("test-request-id"))
+	assert.Equal(t, patches+3, countActions(client, "patch"))
+}
+
+func TestUnidleAppGroupWithInvalidDependencies(t *testing.T) {
+	const host = "cycle.example.com"
+	const ns = "cycle-ns"
+	labels := map[string]string{UnidleKeyLabel: unidleKey(host)}
+	client, restore := withResolvers(&labelResolver{})
+	defer restore()
+	mockApp(client, ns, "web", host, "/", labels)
+	client.AppsV1().Deployments(ns).Create(&appsAPI.Deployment{ObjectMeta: metaAPI.ObjectMeta{
+		Namespace:   ns,
+		Name:        "worker",
+		Labels:      labels,
+		Annotations: map[string]string{UnidleAfterAnnotation: "worker"},
+	}})
+
+	_, err := NewApp(host, "/", logger, nil)
+	assert.Equal(t, "Invalid dependencies between the components of your app: circular dependencies between worker. Please contact the Analytical Platform team.", err.Error())
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"mime"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // StreamingResponseWriter is a convenience interface
@@ -12,68 +18,426 @@ type StreamingResponseWriter interface {
 	http.Flusher
 }
 
+// IndexPage is the data of the index page
+type IndexPage struct {
+	// RedirectURL is the URL the user requested, which they're sent back to
+	// once the app is unidled
+	RedirectURL string
+	// WakeOptions are the times the user can choose to keep the app up for
+	WakeOptions []DurationOption
+}
+
+// appHandler serves the requests the Ingresses of the idled apps send to the
+// unidler, whatever their path. The events stream is served when asked for
+// by the page (`Accept: text/event-stream`), so that it's requested on the
+// same Ingress path as the page, and so is the time the user chooses to keep
+// the app up for (a form posted by the page). Otherwise the index page is
+// served
+func appHandler(index http.Handler) http.Handler {
+	wake := withTimeout(wakeHandler)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+			eventsHandler(w, req)
+			return
+		}
+		if req.Method == http.MethodPost && formPosted(req) {
+			wake.ServeHTTP(w, req)
+			return
+		}
+		index.ServeHTTP(w, req)
+	})
+}
+
+// formPosted returns true if the request's body is a form, as posted by the
+// pages' forms
+func formPosted(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
 // Index renders the index page
 func indexHandler(w http.ResponseWriter, req *http.Request) {
-	indexTemplates.ExecuteTemplate(w, "layout", req.Host)
+	w.Header().Set(RequestIDHeader, requestID(req))
+	indexTemplates.ExecuteTemplate(w, "layout", IndexPage{RedirectURL: redirectURL(req), WakeOptions: durationOptions(WakeDurations)})
 }
 
-// Unidles an app and sends status updates to the client as SSEs
-func eventsHandler(w http.ResponseWriter, req *http.Request) {
-	s, ok := w.(StreamingResponseWriter)
-	if !ok {
-		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
-		return
-	}
+// WakeResponse is the response to the time chosen by the user to keep their
+// app up for
+type WakeResponse struct {
+	// ExpiresAt is the time (RFC 3339) the app is idled again, empty when
+	// it stays up until idled for other reasons
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+// wakeHandler records the time the authenticated user chose to keep their app
+// being unidled up for (the `wake_for` field, one of WakeDurations, or empty
+// for no limit). The app is idled again once it's over, see WakeExpirer
+func wakeHandler(w http.ResponseWriter, req *http.Request) {
+	id := requestID(req)
+	w.Header().Set(RequestIDHeader, id)
+	w.Header().Set("Content-Type", "application/json")
+	path := appPath(req)
+	log := logger.With(Fields{"request_id": id, "host": req.Host, "path": path})
 
-	w.WriteHeader(http.StatusOK)
-	s.Flush()
+	respond := func(status int, response WakeResponse) {
+		response.RequestID = id
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+	}
 
-	sendMessage(s, "Starting unidling...")
+	// NOTE: Browsers send the `Origin` header with the requests of the page.
+	//       It only stops other sites' pages: other clients can set it, the
+	//       user is authenticated by the proxy's secret instead
+	if req.Header.Get("Origin") == "" || !sameOrigin(req) {
+		respond(http.StatusForbidden, WakeResponse{Message: "The request didn't come from this page."})
+		return
+	}
+	user := authenticatedUser(req)
+	if user == "" {
+		respond(http.StatusUnauthorized, WakeResponse{Message: "You need to be signed in to keep your app up."})
+		return
+	}
+	var duration time.Duration
+	if value := req.FormValue("wake_for"); value != "" {
+		var ok bool
+		duration, ok = chosenDuration(value, WakeDurations)
+		if !ok {
+			respond(http.StatusBadRequest, WakeResponse{Message: fmt.Sprintf("Your app can't be kept up for %s.", value)})
+			return
+		}
+	}
 
-	app, err := NewApp(req.Host)
+	span := startTrace("wake", traceParent(req))
+	span.SetAttributes(Fields{"host": req.Host, "path": path, "request_id": id, "user": user})
+	defer span.Finish()
+
+	app, status, err := userApp(req.Host, path, user, "keep up", log.With(Fields{"user": user}), span)
 	if err != nil {
-		sendError(s, err)
+		respond(status, WakeResponse{Message: err.Error()})
 		return
 	}
-	sendMessage(s, "App found. Unidling it...")
-
-	err = app.SetReplicas()
+	expiresAt := time.Time{}
+	if duration > 0 {
+		expiresAt = time.Now().UTC().Add(duration).Truncate(time.Second)
+	}
+	err = app.SetWakeExpiry(expiresAt)
 	if err != nil {
-		sendError(s, err)
+		span.SetError(err)
+		respond(http.StatusInternalServerError, WakeResponse{Message: err.Error()})
 		return
 	}
-	sendMessage(s, "Replicas restored. Starting app. This could take a few minutes...")
 
-	err = app.WaitForDeployment()
-	if err != nil {
-		sendError(s, err)
+	if expiresAt.IsZero() {
+		respond(http.StatusOK, WakeResponse{Message: "Your app will stay up until it's idled."})
 		return
 	}
-	sendMessage(s, "App ready. Removing idled metadata...")
+	respond(http.StatusOK, WakeResponse{
+		ExpiresAt: expiresAt.Format(time.RFC3339),
+		Message:   fmt.Sprintf("Your app will be idled again in %s.", humanDuration(duration)),
+	})
+}
 
-	err = app.RemoveIdledMetadata()
+// IdlePage is the data of the idle page
+type IdlePage struct {
+	// Host and Path are the URL of the app to idle
+	Host string
+	Path string
+	// Idled is true once the app was idled
+	Idled bool
+	// Error is the reason the app couldn't be idled
+	Error     string
+	RequestID string
+}
+
+// idleHandler lets the authenticated user idle one of their apps: the page
+// asks for confirmation and its form is posted back to the handler, which
+// idles the app (see App.Idle)
+func idleHandler(w http.ResponseWriter, req *http.Request) {
+	id := requestID(req)
+	w.Header().Set(RequestIDHeader, id)
+
+	page := IdlePage{
+		Host:      strings.TrimSpace(req.FormValue("host")),
+		Path:      req.FormValue("path"),
+		RequestID: id,
+	}
+	if page.Path == "" {
+		page.Path = "/"
+	}
+
+	status := http.StatusOK
+	user := authenticatedUser(req)
+	switch {
+	case user == "":
+		status, page.Error = http.StatusUnauthorized, "You need to be signed in to idle an app."
+	case page.Host == "":
+		status, page.Error = http.StatusBadRequest, "Missing the host of the app to idle."
+	case req.Method == http.MethodPost:
+		var err error
+		status, err = idleApp(req, page.Host, page.Path, user, id)
+		if err != nil {
+			page.Error = err.Error()
+		} else {
+			page.Idled = true
+		}
+	case req.Method != http.MethodGet:
+		w.Header().Set("Allow", "GET, POST")
+		status, page.Error = http.StatusMethodNotAllowed, "Method not allowed."
+	}
+
+	w.WriteHeader(status)
+	idleTemplates.ExecuteTemplate(w, "layout", page)
+}
+
+// idleApp idles the app for the given host and path on behalf of the user,
+// who must own it. It returns the HTTP status of the response
+func idleApp(req *http.Request, host string, path string, user string, id string) (int, error) {
+	if !sameOrigin(req) {
+		return http.StatusForbidden, fmt.Errorf("The request to idle your app didn't come from this page.")
+	}
+
+	span := startTrace("idle", traceParent(req))
+	span.SetAttributes(Fields{"host": host, "path": path, "request_id": id, "user": user, "trigger": IdleTriggerUser})
+	defer span.Finish()
+	log := logger.With(Fields{"request_id": id, "user": user})
+
+	app, status, err := userApp(host, path, user, "idle", log, span)
 	if err != nil {
-		sendError(s, err)
-		return
+		return status, err
+	}
+	if !jobs.ForgetCompleted(host, path) {
+		app.log("App is being unidled. Not idling it.")
+		return http.StatusConflict, fmt.Errorf("Your app is being unidled. Please try again once it's started.")
+	}
+
+	app.log("User asked to idle the app. Idling it.")
+	namespace := app.workload.GetNamespace()
+	err = app.Idle()
+	if err != nil {
+		span.SetError(err)
+		inc(idleFailures, namespace, IdleTriggerUser)
+		app.logError(err, "Idling failed.")
+		return http.StatusInternalServerError, err
+	}
+	inc(idled, namespace, IdleTriggerUser)
+	app.log("Idling succeeded.")
+	return http.StatusOK, nil
+}
+
+// userApp finds the app for the given host and path, which the user must
+// own to perform the action. It returns the HTTP status of the response when
+// it can't
+func userApp(host string, path string, user string, action string, log *Logger, span *Span) (*App, int, error) {
+	app, err := NewApp(host, path, log, span)
+	if err != nil {
+		span.SetError(err)
+		return nil, http.StatusNotFound, err
+	}
+	owner, err := ownsApp(user, app)
+	if err != nil {
+		span.SetError(err)
+		app.logError(err, "Failed to check the owner of the app.")
+		return nil, http.StatusInternalServerError, fmt.Errorf("Failed to %s your app.", action)
+	}
+	if !owner {
+		app.log("User doesn't own the app. Not allowing them to %s it.", action)
+		return nil, http.StatusForbidden, fmt.Errorf("You can only %s your own apps.", action)
+	}
+	return app, http.StatusOK, nil
+}
+
+// PinPage is the data of the pin page
+type PinPage struct {
+	// Host and Path are the URL of the app to pin
+	Host string
+	Path string
+	// Options are the times the user can pin the app for
+	Options []DurationOption
+	// PinnedUntil (UTC) and PinnedBy describe the app's pin, if pinned
+	PinnedUntil string
+	PinnedBy    string
+	// Message is the outcome of the form posted
+	Message string
+	// Error is the reason the app couldn't be pinned
+	Error     string
+	RequestID string
+}
+
+// pinHandler lets the authenticated user pin one of their apps, so that it's
+// not idled for the time they choose (see App.Pin), or unpin it. The page
+// shows the app's pin and its form is posted back to the handler
+func pinHandler(w http.ResponseWriter, req *http.Request) {
+	id := requestID(req)
+	w.Header().Set(RequestIDHeader, id)
+
+	page := PinPage{
+		Host:      strings.TrimSpace(req.FormValue("host")),
+		Path:      req.FormValue("path"),
+		Options:   durationOptions(PinDurations),
+		RequestID: id,
+	}
+	if page.Path == "" {
+		page.Path = "/"
 	}
-	sendMessage(s, "Redirecting app...")
 
-	err = app.RedirectService()
+	status := http.StatusOK
+	user := authenticatedUser(req)
+	switch {
+	case user == "":
+		status, page.Error = http.StatusUnauthorized, "You need to be signed in to pin an app."
+	case page.Host == "":
+		status, page.Error = http.StatusBadRequest, "Missing the host of the app to pin."
+	case req.Method == http.MethodGet || req.Method == http.MethodPost:
+		var err error
+		status, err = pinApp(req, &page, user)
+		if err != nil {
+			page.Error = err.Error()
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		status, page.Error = http.StatusMethodNotAllowed, "Method not allowed."
+	}
+
+	w.WriteHeader(status)
+	pinTemplates.ExecuteTemplate(w, "layout", page)
+}
+
+// pinApp shows the pin of the app of the page, pinning it for the time chosen
+// (the `pin_for` field, one of PinDurations, or empty to unpin it) when the
+// form is posted. It returns the HTTP status of the response
+func pinApp(req *http.Request, page *PinPage, user string) (int, error) {
+	var duration time.Duration
+	if req.Method == http.MethodPost {
+		if !sameOrigin(req) {
+			return http.StatusForbidden, fmt.Errorf("The request to pin your app didn't come from this page.")
+		}
+		if value := req.FormValue("pin_for"); value != "" {
+			var ok bool
+			duration, ok = chosenDuration(value, PinDurations)
+			if !ok {
+				return http.StatusBadRequest, fmt.Errorf("Your app can't be pinned for %s.", value)
+			}
+		}
+	}
+
+	span := startTrace("pin", traceParent(req))
+	span.SetAttributes(Fields{"host": page.Host, "path": page.Path, "request_id": page.RequestID, "user": user})
+	defer span.Finish()
+	log := logger.With(Fields{"request_id": page.RequestID, "user": user})
+
+	app, status, err := userApp(page.Host, page.Path, user, "pin", log, span)
 	if err != nil {
-		sendError(s, err)
+		return status, err
+	}
+
+	if req.Method == http.MethodPost {
+		until := time.Time{}
+		if duration > 0 {
+			until = time.Now().UTC().Add(duration).Truncate(time.Second)
+		}
+		err = app.Pin(until, user)
+		if err != nil {
+			span.SetError(err)
+			return http.StatusInternalServerError, err
+		}
+		if until.IsZero() {
+			page.Message = "Your app is no longer pinned. It can be idled again."
+			return http.StatusOK, nil
+		}
+		page.Message = fmt.Sprintf("Your app is pinned for %s: it won't be idled until then.", humanDuration(duration))
+		page.PinnedUntil, page.PinnedBy = until.Format(IdledAtFormat), user
+		return http.StatusOK, nil
+	}
+
+	if pinned(app.workload, time.Now().UTC()) {
+		annotations := app.workload.GetAnnotations()
+		page.PinnedUntil, page.PinnedBy = annotations[PinnedUntilAnnotation], annotations[PinnedByAnnotation]
+	}
+	return http.StatusOK, nil
+}
+
+// appPath returns the path of the app requested. It's the path of the
+// request, except on `/events/` (used by the pages loaded before apps could
+// be told apart by their path)
+func appPath(req *http.Request) string {
+	if strings.HasPrefix(req.URL.Path, "/events/") || req.URL.Path == "" {
+		return "/"
+	}
+	return req.URL.Path
+}
+
+// Subscribes to the unidling of an app and sends status updates to the
+// client as SSEs. Concurrent and reconnecting clients share the same Job
+func eventsHandler(w http.ResponseWriter, req *http.Request) {
+	s, ok := w.(StreamingResponseWriter)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
 		return
 	}
 
-	sendEvent(s, &Message{
-		event: "success",
-		data:  "Ready",
-	})
+	id := requestID(req)
+	w.Header().Set(RequestIDHeader, id)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	w.WriteHeader(http.StatusOK)
+	s.Flush()
+
+	openStreams.Inc()
+	defer openStreams.Dec()
+
+	path := appPath(req)
+	job := jobs.Unidle(req.Host, path, id, traceParent(req))
+	from := job.Resume(req.Header.Get("Last-Event-ID"))
+
+	log := logger.With(Fields{"request_id": id, "host": req.Host, "path": path, "unidle_request_id": job.RequestID()})
+	log.Info("Client subscribed to unidling.")
+	start := time.Now()
+	streamJob(s, job, from, req.Context().Done())
+	log.With(Fields{"duration": time.Since(start).Seconds()}).Info("Client stream ended.")
+}
+
+// streamJob sends the progress of an unidling Job to the client, starting
+// from the given position, until the Job is done or the client goes away.
+// Keep-alive comments are sent periodically so that the connection is not
+// closed as idle while the app takes its time to start
+func streamJob(s StreamingResponseWriter, job *Job, from int, closed <-chan struct{}) {
+	heartbeat := time.NewTicker(HeartbeatInterval)
+	defer heartbeat.Stop()
+	lifetime := time.NewTimer(StreamTimeout)
+	defer lifetime.Stop()
+
+	sent := from
+	for {
+		msgs, done, changed := job.Progress(sent)
+		for _, m := range msgs {
+			sendEvent(s, m)
+		}
+		sent += len(msgs)
+
+		if done {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			sendComment(s, "keep-alive")
+		case <-lifetime.C:
+			// The client will reconnect and resume from where it was
+			return
+		case <-closed:
+			return
+		}
+	}
 }
 
+// Exposes the unidler metrics in the Prometheus text-based format
+var metricsHandler = promhttp.Handler().ServeHTTP
+
 func healthzHandler(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprint(w, "Still OK")
 }
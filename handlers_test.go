@@ -4,11 +4,38 @@ import (
 	"bytes"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// authenticate sets the name of the user on the request, as the
+// authenticating proxy does
+func authenticate(req *http.Request, user string) {
+	req.Header.Set(AuthProxySecretHeader, AUTH_PROXY_SECRET)
+	req.Header.Set(AuthUserHeader, user)
+}
+
+func TestAuthenticatedUser(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/idle/", nil)
+	assert.Equal(t, "", authenticatedUser(req))
+	authenticate(req, " alice ")
+	assert.Equal(t, "alice", authenticatedUser(req))
+
+	// The user's header set by anyone else is ignored
+	req.Header.Set(AuthProxySecretHeader, "guessed")
+	assert.Equal(t, "", authenticatedUser(req))
+	req.Header.Del(AuthProxySecretHeader)
+	assert.Equal(t, "", authenticatedUser(req))
+
+	// No user is trusted without a secret
+	AuthProxySecret = ""
+	defer func() { AuthProxySecret = AUTH_PROXY_SECRET }()
+	assert.Equal(t, "", authenticatedUser(req))
+}
+
 func TestHealthCheckHandler(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/healthz", nil)
 
@@ -25,7 +52,7 @@ func TestIndexHandler(t *testing.T) {
 
 	// Render index template string
 	var expectedBody bytes.Buffer
-	err := indexTemplates.ExecuteTemplate(&expectedBody, "layout", HOST)
+	err := indexTemplates.ExecuteTemplate(&expectedBody, "layout", IndexPage{RedirectURL: "https://" + HOST + "/", WakeOptions: durationOptions(WakeDurations)})
 	assert.Nil(t, err)
 
 	req, _ := http.NewRequest("GET", "/", nil)
@@ -38,3 +65,103 @@ func TestIndexHandler(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rec.Code)
 	assert.Equal(t, expectedBody.String(), rec.Body.String(), "Response body didn't match template: '%s'", expectedBody.String())
 }
+
+func TestIndexHandlerKeepsURL(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/dashboard/page?tab=2&q=a+b", nil)
+	req.Host = HOST
+	req.Header.Set(ForwardedProtoHeader, "http")
+
+	rec := httptest.NewRecorder()
+	appHandler(http.HandlerFunc(indexHandler)).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `href="http://test-tool.example.com/dashboard/page?tab=2&amp;q=a&#43;b"`)
+}
+
+func TestServeMuxServesUnidlerPagesOnItsHost(t *testing.T) {
+	get := func(mux *http.ServeMux, host string, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	mux := newServeMux("unidler.example.com")
+
+	for _, path := range []string{"/idle/", "/pin/"} {
+		rec := get(mux, "unidler.example.com", path+"?host="+HOST)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, path)
+		// An idled app's deep links under these paths are the app's
+		rec = get(mux, HOST, path+"report")
+		assert.Equal(t, http.StatusOK, rec.Code, path)
+		assert.Contains(t, rec.Body.String(), `href="https://test-tool.example.com`+path+`report"`)
+	}
+	assert.Equal(t, http.StatusUnauthorized, get(mux, "unidler.example.com:8080", "/idle/").Code)
+
+	// Disabled without the unidler's host
+	rec := get(newServeMux(""), "unidler.example.com", "/idle/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "Idle my app now")
+}
+
+func TestAppPath(t *testing.T) {
+	testCases := map[string]string{
+		"/":                "/",
+		"/events/":         "/",
+		"/dashboard/page":  "/dashboard/page",
+		"/events/?foo=bar": "/",
+	}
+	for url, path := range testCases {
+		req, _ := http.NewRequest("GET", url, nil)
+		assert.Equal(t, path, appPath(req), url)
+	}
+}
+
+func TestIdleHandler(t *testing.T) {
+	const host = "alice-app.example.com"
+	const ns = "user-alice"
+	labels := map[string]string{UnidleKeyLabel: unidleKey(host)}
+	client, restore := withResolvers(&labelResolver{})
+	defer restore()
+	mockApp(client, ns, "web", host, "/", labels)
+	client.AppsV1().Deployments(ns).Delete("web", nil)
+	idleableDeployment(client, ns, "web", 2, labels)
+
+	idle := func(method string, user string, origin string) *httptest.ResponseRecorder {
+		form := url.Values{"host": {host}, "path": {"/"}}
+		req, _ := http.NewRequest(method, "/idle/", strings.NewReader(form.Encode()))
+		if method == "GET" {
+			// As linked to, e.g. from the control panel
+			req, _ = http.NewRequest(method, "/idle/?"+form.Encode(), nil)
+		}
+		req.Host = "unidler.example.com"
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if user != "" {
+			authenticate(req, user)
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		rec := httptest.NewRecorder()
+		http.HandlerFunc(idleHandler).ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, idle("POST", "", "").Code)
+	rec := idle("GET", "Alice", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Idle my app now")
+	rec = idle("POST", "bob", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "You can only idle your own apps.")
+	assert.Equal(t, http.StatusForbidden, idle("POST", "Alice", "https://evil.example.com").Code)
+	assert.Equal(t, int32(2), *getDeployment(ns, "web").Spec.Replicas)
+
+	rec = idle("POST", "Alice", "https://unidler.example.com")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "was idled")
+	dep := getDeployment(ns, "web")
+	assert.Equal(t, int32(0), *dep.Spec.Replicas)
+	assert.Equal(t, "true", dep.Labels[IdledLabel])
+	assert.Equal(t, "2", dep.Annotations[ReplicasWhenUnidledAnnotation])
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	coreAPI "k8s.io/api/core/v1"
+)
+
+const (
+	// IdledAtFormat is the format of the time in IdledAtAnnotation (UTC)
+	IdledAtFormat = "2006-01-02T15:04:05"
+	// UnidlerExternalName is the DNS name of the unidler's Service, which the
+	// Services of the idled apps are ExternalName Services of
+	UnidlerExternalName = UnidlerName + "." + UnidlerNs + ".svc.cluster.local"
+)
+
+// Idle idles the App, producing the state the unidling reverses: the
+// replicas of its workloads are recorded in the ReplicasWhenUnidledAnnotation
+// annotation (along with IdledAtAnnotation), its traffic is sent to the
+// unidler by its TrafficSwitch (e.g. its Service is pointed at the unidler,
+// see RedirectToUnidler) and its workloads are scaled to zero and
+// get the IdledLabel label. The label is written last, so that an idling
+// which failed midway isn't mistaken for a completed one. The wake expiry
+// chosen by the user, if any, is removed (see SetWakeExpiry)
+func (a *App) Idle() (err error) {
+	span := a.startSpan("Idle")
+	defer func() { finishSpan(span, err) }()
+
+	workloads := []Workload{}
+	for _, batch := range a.batches() {
+		workloads = append(workloads, batch...)
+	}
+
+	now := time.Now().UTC()
+	replicas := map[Workload]int32{}
+	for _, workload := range workloads {
+		replicas[workload], err = a.recordIdledAt(workload, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = a.SwitchTrafficToUnidler()
+	if err != nil {
+		return err
+	}
+
+	for _, workload := range workloads {
+		err = workload.Scale(0)
+		if err != nil {
+			a.logError(err, "Scale of %s to zero failed.", a.describe(workload))
+			return fmt.Errorf("Failed to scale down your app.")
+		}
+
+		err = workload.PatchMetadata([]byte(fmt.Sprintf(`{"metadata": {"labels": {"%s": "true", "%s": null}}}`, IdledLabel, WakeExpiresLabel)))
+		if err != nil {
+			a.logError(err, "Patch to add idled label to %s failed.", a.describe(workload))
+			return fmt.Errorf("Failed to mark your app as idled.")
+		}
+
+		a.log("Successfully idled %s, which had %d replica(s).", a.describe(workload), replicas[workload])
+		a.recordWorkloadEvent(workload, coreAPI.EventTypeNormal, EventIdled, "Idled, scaled down from %d replica(s).", replicas[workload])
+	}
+	return nil
+}
+
+// recordIdledAt records the replicas of the workload, to be restored when
+// unidled, and the time it's idled. It returns the replicas recorded
+func (a *App) recordIdledAt(workload Workload, now time.Time) (int32, error) {
+	replicas, err := workload.Replicas()
+	if err != nil {
+		a.logError(err, "Failed to get %s's replicas.", a.describe(workload))
+		return 0, fmt.Errorf("Failed to record your app's replicas.")
+	}
+	if replicas == 0 {
+		// e.g. scaled down by an idling which failed before completing
+		replicas = int32(a.GetReplicasWhenUnidled(workload))
+	}
+
+	patch := fmt.Sprintf(`{
+			"metadata": {
+				"annotations": {
+					"%s": "%s;%d",
+					"%s": "%d",
+					"%s": null
+				}
+			}
+		}`,
+		IdledAtAnnotation, now.Format(IdledAtFormat), replicas,
+		ReplicasWhenUnidledAnnotation, replicas,
+		WakeExpiresAtAnnotation,
+	)
+	err = workload.PatchMetadata([]byte(patch))
+	if err != nil {
+		a.logError(err, "Patch to add idled annotations to %s failed.", a.describe(workload))
+		return 0, fmt.Errorf("Failed to record your app's replicas.")
+	}
+	return replicas, nil
+}
+
+// RedirectToUnidler points the App's Service at the unidler, the mirror image
+// of RedirectService: it becomes an ExternalName Service of the unidler, with
+// a snapshot of its spec in the ServiceSpecWhenUnidledAnnotation annotation
+func (a *App) RedirectToUnidler() (err error) {
+	span := a.startSpan("RedirectToUnidler")
+	span.SetAttributes(Fields{"service": a.service.Name})
+	defer func() { finishSpan(span, err) }()
+
+	if a.service.Spec.Type == coreAPI.ServiceTypeExternalName {
+		a.log("Service is already an ExternalName Service (of '%s'). Assuming it's already redirected.", a.service.Spec.ExternalName)
+		return nil
+	}
+
+	patch, err := unidlerServicePatch(a.service)
+	if err != nil {
+		a.logError(err, "Failed to build Service patch.")
+		return fmt.Errorf("Failed to redirect your app to the unidler.")
+	}
+
+	err = a.service.Patch(patch)
+	if err != nil {
+		a.logError(err, "Patch to Service failed.")
+		return fmt.Errorf("Failed to redirect your app to the unidler.")
+	}
+
+	a.log("Successfully redirected Service to the unidler.")
+	a.RecordServiceEvent(coreAPI.EventTypeNormal, EventIdled, "Redirected from the app's pods to the unidler.")
+	return nil
+}
+
+// unidlerServicePatch returns the JSON patch turning the Service into an
+// ExternalName Service of the unidler, recording the snapshot of its spec
+// serviceSpecPatch restores. Its cluster IP is released, as ExternalName
+// Services can't have one
+func unidlerServicePatch(svc *Service) ([]byte, error) {
+	snapshot, err := json.Marshal(&coreAPI.ServiceSpec{
+		Type:                  svc.Spec.Type,
+		Selector:              svc.Spec.Selector,
+		Ports:                 svc.Spec.Ports,
+		SessionAffinity:       svc.Spec.SessionAffinity,
+		SessionAffinityConfig: svc.Spec.SessionAffinityConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	annotation := jsonPatchOperation{Op: "add", Path: annotationPath(ServiceSpecWhenUnidledAnnotation), Value: string(snapshot)}
+	if svc.Annotations == nil {
+		annotation = jsonPatchOperation{Op: "add", Path: "/metadata/annotations", Value: map[string]string{
+			ServiceSpecWhenUnidledAnnotation: string(snapshot),
+		}}
+	}
+	patch := []jsonPatchOperation{
+		annotation,
+		{Op: "add", Path: "/spec/type", Value: coreAPI.ServiceTypeExternalName},
+		{Op: "add", Path: "/spec/externalName", Value: UnidlerExternalName},
+	}
+	if svc.Spec.ClusterIP != "" {
+		patch = append(patch, jsonPatchOperation{Op: "remove", Path: "/spec/clusterIP"})
+		// NOTE: The API server sets `clusterIPs` along with `clusterIP`
+		if ServiceClusterIPs {
+			patch = append(patch, jsonPatchOperation{Op: "remove", Path: "/spec/clusterIPs"})
+		}
+	}
+	return json.Marshal(patch)
+}
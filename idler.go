@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// IdleableLabel is the label of the workloads the idler idles, see
+// `IDLER_SELECTOR`
+const IdleableLabel = "mojanalytics.xyz/idleable"
+
+// Names of the activity sources, used in `ACTIVITY_SOURCE`
+const (
+	ActivityLastUnidle = "last-unidle"
+	ActivityRequests   = "requests"
+)
+
+// What triggered the idling of an app, in the metrics
+const (
+	IdleTriggerInactivity = "inactivity"
+	// IdleTriggerUser is the user asking for their app to be idled, see
+	// idleHandler
+	IdleTriggerUser = "user"
+	// IdleTriggerWakeExpired is the end of the time the user chose to keep
+	// their app up for, see WakeExpirer
+	IdleTriggerWakeExpired = "wake-expired"
+)
+
+const (
+	DEFAULT_IDLER_ENABLED   = false
+	DEFAULT_IDLER_INTERVAL  = 10 * time.Minute
+	DEFAULT_IDLE_AFTER      = 1 * time.Hour
+	DEFAULT_IDLER_SELECTOR  = IdleableLabel + "=true"
+	DEFAULT_ACTIVITY_SOURCE = ActivityLastUnidle
+	// DEFAULT_ACTIVITY_QUERY is the number of requests to the app's Service
+	// counted by the NGINX ingress controller
+	DEFAULT_ACTIVITY_QUERY = `sum(increase(nginx_ingress_controller_requests{exported_namespace="{{.Namespace}}",exported_service="{{.Service}}"}[{{.Window}}]))`
+	// Timeout of the requests to Prometheus
+	ACTIVITY_TIMEOUT = 30 * time.Second
+)
+
+// ActivitySource tells whether an app was used recently
+type ActivitySource interface {
+	// Name is the name of the ActivitySource in the configuration
+	Name() string
+	// Active returns true if the app of the workload (and Service) was
+	// active during the given window, up to now
+	Active(workload Workload, svc *Service, window time.Duration) (bool, error)
+}
+
+// Idler idles the apps which haven't been active for a while, the
+// counterpart of the unidler. It's optional and runs in the background of
+// the unidler, see `IDLER_ENABLED`
+type Idler struct {
+	// selector selects the workloads which can be idled
+	selector  string
+	idleAfter time.Duration
+	interval  time.Duration
+	activity  ActivitySource
+}
+
+// NewIdler constructs a new Idler
+func NewIdler(selector string, idleAfter time.Duration, interval time.Duration, activity ActivitySource) *Idler {
+	return &Idler{
+		selector:  selector,
+		idleAfter: idleAfter,
+		interval:  interval,
+		activity:  activity,
+	}
+}
+
+// IdlerFromEnv configures the Idler from `IDLER_SELECTOR`, `IDLE_AFTER`,
+// `IDLER_INTERVAL` and the ActivitySource named in `ACTIVITY_SOURCE`
+func IdlerFromEnv() (*Idler, error) {
+	selector, ok := os.LookupEnv("IDLER_SELECTOR")
+	if !ok {
+		logger.Info("$IDLER_SELECTOR not set. Defaulting to '%s'", DEFAULT_IDLER_SELECTOR)
+		selector = DEFAULT_IDLER_SELECTOR
+	}
+	if _, err := labels.Parse(selector); err != nil {
+		return nil, fmt.Errorf("invalid $IDLER_SELECTOR: %s", err)
+	}
+
+	name, ok := os.LookupEnv("ACTIVITY_SOURCE")
+	if !ok {
+		logger.Info("$ACTIVITY_SOURCE not set. Defaulting to '%s'", DEFAULT_ACTIVITY_SOURCE)
+		name = DEFAULT_ACTIVITY_SOURCE
+	}
+	var activity ActivitySource
+	switch name {
+	case ActivityLastUnidle:
+		activity = &lastUnidleActivity{}
+	case ActivityRequests:
+		query, ok := os.LookupEnv("ACTIVITY_QUERY")
+		if !ok {
+			query = DEFAULT_ACTIVITY_QUERY
+		}
+		var err error
+		activity, err = NewRequestsActivity(os.Getenv("PROMETHEUS_URL"), query)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown activity source '%s' in $ACTIVITY_SOURCE", name)
+	}
+
+	return NewIdler(
+		selector,
+		durationFromEnv("IDLE_AFTER", DEFAULT_IDLE_AFTER),
+		durationFromEnv("IDLER_INTERVAL", DEFAULT_IDLER_INTERVAL),
+		activity,
+	), nil
+}
+
+// Start runs the Idler every interval, in the background, until the channel
+// is closed
+func (i *Idler) Start(stop <-chan struct{}) {
+	logger.Info("Starting idler: workloads with %s idled after %s without activity (%s), checked every %s.", i.selector, i.idleAfter, i.activity.Name(), i.interval)
+	go runEvery(i.interval, stop, func() { i.Run() })
+}
+
+// runEvery calls the function straight away and then every interval, until
+// the channel is closed
+func runEvery(interval time.Duration, stop <-chan struct{}, run func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		run()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run idles the inactive apps among the workloads selected by the Idler, of
+// all the `workloadKinds`. It returns the number of apps idled
+func (i *Idler) Run() int {
+	count := 0
+	for _, kind := range workloadKinds {
+		workloads, err := kind.List("", i.selector)
+		if err != nil {
+			logger.Error(err, "Idler failed to list %s.", kind.Name())
+			continue
+		}
+
+		for _, workload := range workloads {
+			if !idleable(workload) {
+				continue
+			}
+			ok, err := i.idleIfInactive(workload)
+			if err != nil {
+				inc(idleFailures, workload.GetNamespace(), IdleTriggerInactivity)
+				continue
+			}
+			if ok {
+				inc(idled, workload.GetNamespace(), IdleTriggerInactivity)
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// idleable returns true if the workload isn't idled: it doesn't have the
+// IdledLabel label and has replicas, or its replicas were recorded by an
+// idling which failed before completing. Workloads unidled recently or
+// pinned are left alone, see inGracePeriod and pinned
+func idleable(workload Workload) bool {
+	if _, ok := workload.GetLabels()[IdledLabel]; ok {
+		return false
+	}
+	if inGracePeriod(workload, time.Now()) || pinned(workload, time.Now()) {
+		return false
+	}
+	if replicas, err := workload.Replicas(); err == nil && replicas > 0 {
+		return true
+	}
+	_, ok := workload.GetAnnotations()[ReplicasWhenUnidledAnnotation]
+	return ok
+}
+
+// inGracePeriod returns true if the workload was unidled less than
+// UnidleGracePeriod ago, according to its UnidledAtAnnotation
+func inGracePeriod(workload Workload, now time.Time) bool {
+	value, ok := workload.GetAnnotations()[UnidledAtAnnotation]
+	if !ok {
+		return false
+	}
+	unidledAt, err := time.Parse(IdledAtFormat, value)
+	if err != nil {
+		return false
+	}
+	return now.Before(unidledAt.Add(UnidleGracePeriod))
+}
+
+// idleIfInactive idles the app of the workload if it wasn't active during
+// the last `idleAfter`. It returns true if it was idled
+func (i *Idler) idleIfInactive(workload Workload) (bool, error) {
+	log := logger.With(Fields{"namespace": workload.GetNamespace(), "workload": workload.GetName(), "kind": workloadKind(workload)})
+
+	svc, err := workloadService(workload)
+	if err != nil {
+		log.Error(err, "Idler couldn't find the Service of the workload.")
+		return false, err
+	}
+
+	active, err := i.activity.Active(workload, svc, i.idleAfter)
+	if err != nil {
+		log.Error(err, "Idler couldn't get the activity of the app (%s).", i.activity.Name())
+		return false, err
+	}
+	if active {
+		return false, nil
+	}
+
+	return idleWorkload(workload, svc, IdleTriggerInactivity, log, fmt.Sprintf("App inactive for %s (%s). Idling it.", i.idleAfter, i.activity.Name()))
+}
+
+// idleWorkload idles the app of the workload, in a new `idle` trace, logging
+// the reason why. The app is looked up from its route (see workloadApp), so
+// that its whole group is idled and its traffic is switched to the unidler,
+// and its completed unidling Job is forgotten, so that the next request
+// unidles it again. It returns false, idling nothing, when the app is being
+// unidled or when the workload is part of another app's group
+func idleWorkload(workload Workload, svc *Service, trigger string, log *Logger, reason string) (_ bool, err error) {
+	span := startTrace("idle", trace.SpanContext{})
+	span.SetAttributes(Fields{"namespace": workload.GetNamespace(), "app": workload.GetName(), "kind": workloadKind(workload), "trigger": trigger})
+	defer func() { finishSpan(span, err) }()
+
+	app, err := workloadApp(workload, svc, log, span)
+	if err != nil {
+		log.Error(err, "Idler couldn't find the app of the workload.")
+		return false, err
+	}
+	if !sameWorkload(app.workload, workload) {
+		app.log("Workload is part of the group of %s %s. Not idling it on its own.", workloadKind(app.workload), app.workload.GetName())
+		return false, nil
+	}
+	if app.host != "" && !jobs.ForgetCompleted(app.host, app.path) {
+		app.log("App is being unidled. Not idling it.")
+		return false, nil
+	}
+
+	app.log("%s", reason)
+	err = app.Idle()
+	if err != nil {
+		app.logError(err, "Idling failed.")
+		return false, err
+	}
+	app.log("Idling succeeded.")
+	return true, nil
+}
+
+// workloadApp returns the App of the workload, looked up like the unidler
+// does (see NewApp) from the first Ingress rule routing to its Service. It's
+// only the workload and its Service when no Ingress routes to it (e.g. it's
+// routed by an HTTPRoute)
+func workloadApp(workload Workload, svc *Service, log *Logger, span *Span) (*App, error) {
+	route, err := serviceRoute(svc)
+	if err != nil {
+		return nil, err
+	}
+	if route == nil {
+		return &App{logger: log, span: span, workload: workload, service: svc}, nil
+	}
+	return NewApp(route.Host, route.Path, log, span)
+}
+
+// serviceRoute returns the route of the first Ingress rule (in the Service's
+// namespace) routing to the Service, nil if none does
+func serviceRoute(svc *Service) (*Route, error) {
+	start := time.Now()
+	ings, _, err := ingressClient.List(svc.Namespace, metaAPI.ListOptions{})
+	observeKubernetesRequest("list", "ingresses", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing ingresses: %s", err)
+	}
+	for _, ing := range ings {
+		for _, rule := range ing.Rules {
+			for _, path := range rule.Paths {
+				if path.Backend.ServiceName != svc.Name {
+					continue
+				}
+				route := &Route{Host: rule.Host, Path: path.Path}
+				if route.Path == "" {
+					route.Path = "/"
+				}
+				return route, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// sameWorkload returns true if the workloads are the same resource
+func sameWorkload(a Workload, b Workload) bool {
+	return workloadKind(a) == workloadKind(b) && a.GetNamespace() == b.GetNamespace() && a.GetName() == b.GetName()
+}
+
+// workloadService returns the Service of the workload's app: the one with the
+// workload's name or else the only one selecting its pods
+func workloadService(workload Workload) (*Service, error) {
+	svc, err := findServiceByName(workload.GetNamespace(), workload.GetName())
+	if !isNotFound(err) {
+		return svc, err
+	}
+
+	start := time.Now()
+	svcs, err := k8sClient.CoreV1().Services(workload.GetNamespace()).List(metaAPI.ListOptions{})
+	observeKubernetesRequest("list", "services", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing services: %s", err)
+	}
+	matches := []Service{}
+	if template := workload.Template(); template != nil {
+		for _, item := range svcs.Items {
+			if len(item.Spec.Selector) > 0 && labels.SelectorFromSet(item.Spec.Selector).Matches(labels.Set(template.Labels)) {
+				matches = append(matches, Service(item))
+			}
+		}
+	}
+	if len(matches) != 1 {
+		return nil, fmt.Errorf("%d Services select the pods of %s %s", len(matches), workloadKind(workload), storeKey(workload.GetNamespace(), workload.GetName()))
+	}
+	return &matches[0], nil
+}
+
+// lastUnidleActivity considers the apps active for the window after they
+// were last unidled (or restarted), i.e. after their oldest pod was created
+type lastUnidleActivity struct{}
+
+func (s *lastUnidleActivity) Name() string {
+	return ActivityLastUnidle
+}
+
+func (s *lastUnidleActivity) Active(workload Workload, svc *Service, window time.Duration) (bool, error) {
+	if workload.Selector() == nil {
+		return false, nil
+	}
+	selector, err := metaAPI.LabelSelectorAsSelector(workload.Selector())
+	if err != nil {
+		return false, fmt.Errorf("invalid %s selector: %s", workloadKind(workload), err)
+	}
+	pods, err := listPods(workload.GetNamespace(), selector.String())
+	if err != nil {
+		return false, err
+	}
+	if len(pods) == 0 {
+		return false, nil
+	}
+
+	started := pods[0].CreationTimestamp.Time
+	for _, pod := range pods[1:] {
+		if pod.CreationTimestamp.Time.Before(started) {
+			started = pod.CreationTimestamp.Time
+		}
+	}
+	return time.Since(started) < window, nil
+}
+
+// requestsActivity considers the apps active when they received requests
+// during the window, counted by a Prometheus query. The query is a Go
+// template of the namespace, name of the workload and Service, and window
+// (e.g. `3600s`)
+type requestsActivity struct {
+	url    string
+	query  *template.Template
+	client *http.Client
+}
+
+// NewRequestsActivity constructs a new requestsActivity querying the
+// Prometheus at the given URL
+func NewRequestsActivity(prometheusURL string, query string) (*requestsActivity, error) {
+	if prometheusURL == "" {
+		return nil, fmt.Errorf("the '%s' activity source requires $PROMETHEUS_URL", ActivityRequests)
+	}
+	tmpl, err := template.New("query").Option("missingkey=error").Parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid $ACTIVITY_QUERY: %s", err)
+	}
+	return &requestsActivity{
+		url:    strings.TrimSuffix(prometheusURL, "/"),
+		query:  tmpl,
+		client: &http.Client{Timeout: ACTIVITY_TIMEOUT},
+	}, nil
+}
+
+func (s *requestsActivity) Name() string {
+	return ActivityRequests
+}
+
+// prometheusResponse is the part of the response of the Prometheus query API
+// which is used
+type prometheusResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		Result []struct {
+			Value []interface{} `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+func (s *requestsActivity) Active(workload Workload, svc *Service, window time.Duration) (bool, error) {
+	query := &bytes.Buffer{}
+	err := s.query.Execute(query, map[string]string{
+		"Namespace": workload.GetNamespace(),
+		"Workload":  workload.GetName(),
+		// NOTE: Kept for the queries written when only Deployments were idled
+		"Deployment": workload.GetName(),
+		"Service":    svc.Name,
+		"Window":     fmt.Sprintf("%ds", int(window.Seconds())),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed executing activity query template: %s", err)
+	}
+
+	resp, err := s.client.Get(s.url + "/api/v1/query?query=" + url.QueryEscape(query.String()))
+	if err != nil {
+		return false, fmt.Errorf("failed querying Prometheus: %s", err)
+	}
+	defer resp.Body.Close()
+
+	result := &prometheusResponse{}
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return false, fmt.Errorf("failed decoding Prometheus response (%s): %s", resp.Status, err)
+	}
+	if result.Status != "success" {
+		return false, fmt.Errorf("Prometheus query failed: %s", result.Error)
+	}
+
+	// Each sample value is a [<time>, "<value>"] pair
+	for _, sample := range result.Data.Result {
+		if len(sample.Value) != 2 {
+			continue
+		}
+		value, ok := sample.Value[1].(string)
+		if !ok {
+			continue
+		}
+		count, err := strconv.ParseFloat(value, 64)
+		if err == nil && count > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
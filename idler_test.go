@@ -0,0 +1,272 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+
+	appsAPI "k8s.io/api/apps/v1"
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/version"
+	discoveryFake "k8s.io/client-go/discovery/fake"
+	k8sFake "k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+// idleableDeployment creates a Deployment with the given replicas, whose
+// pods have the `app: <name>` label
+func idleableDeployment(client *k8sFake.Clientset, ns string, name string, replicas int32, labels map[string]string) {
+	selector := map[string]string{"app": name}
+	client.AppsV1().Deployments(ns).Create(&appsAPI.Deployment{
+		ObjectMeta: metaAPI.ObjectMeta{Namespace: ns, Name: name, Labels: labels},
+		Spec: appsAPI.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metaAPI.LabelSelector{MatchLabels: selector},
+			Template: coreAPI.PodTemplateSpec{ObjectMeta: metaAPI.ObjectMeta{Labels: selector}},
+		},
+	})
+}
+
+func TestIdleIsReversedByUnidling(t *testing.T) {
+	const host = "idle.example.com"
+	const ns = "idle-ns"
+	labels := map[string]string{UnidleKeyLabel: unidleKey(host)}
+	client, restore := withResolvers(&labelResolver{})
+	defer restore()
+	mockApp(client, ns, "web", host, "/", labels)
+	client.AppsV1().Deployments(ns).Delete("web", nil)
+	idleableDeployment(client, ns, "web", 2, labels)
+	client.CoreV1().Services(ns).Update(&coreAPI.Service{
+		ObjectMeta: metaAPI.ObjectMeta{Namespace: ns, Name: "web", Labels: labels},
+		Spec: coreAPI.ServiceSpec{
+			Type:      coreAPI.ServiceTypeClusterIP,
+			ClusterIP: "10.0.0.10",
+			Selector:  map[string]string{"app": "web"},
+			Ports:     []coreAPI.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080)}},
+		},
+	})
+
+	a, err := NewApp(host, "/", logger, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, a.Idle())
+
+	dep := getDeployment(ns, "web")
+	assert.Equal(t, int32(0), *dep.Spec.Replicas)
+	assert.Equal(t, "true", dep.Labels[IdledLabel])
+	assert.Equal(t, "2", dep.Annotations[ReplicasWhenUnidledAnnotation])
+	assert.Regexp(t, `^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d;2$`, dep.Annotations[IdledAtAnnotation])
+	svc, _ := client.CoreV1().Services(ns).Get("web", metaAPI.GetOptions{})
+	assert.Equal(t, coreAPI.ServiceTypeExternalName, svc.Spec.Type)
+	assert.Equal(t, UnidlerExternalName, svc.Spec.ExternalName)
+
+	// The unidling restores the replicas and the Service from the snapshot
+	a, err = NewApp(host, "/", logger, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, a.SetReplicas())
+	assert.Equal(t, int32(2), *getDeployment(ns, "web").Spec.Replicas)
+	spec, source := a.ServiceSpecWhenUnidled()
+	assert.Equal(t, ServiceSpecFromSnapshot, source)
+	assert.Nil(t, a.RedirectService())
+	svc, _ = client.CoreV1().Services(ns).Get("web", metaAPI.GetOptions{})
+	assert.Equal(t, coreAPI.ServiceTypeClusterIP, svc.Spec.Type)
+	// XXX fake patch doesn't remove the external name, see
+	//     TestRedirectServiceRestoresSnapshot
+	assert.Equal(t, spec.Ports, svc.Spec.Ports)
+	assert.Equal(t, intstr.FromInt(8080), svc.Spec.Ports[0].TargetPort)
+}
+
+func TestUnidlerServicePatchReleasesClusterIP(t *testing.T) {
+	defer func(previous bool) { ServiceClusterIPs = previous }(ServiceClusterIPs)
+	svc := &Service{Spec: coreAPI.ServiceSpec{Type: coreAPI.ServiceTypeClusterIP, ClusterIP: "10.0.0.10"}}
+
+	ServiceClusterIPs = true
+	patch, err := unidlerServicePatch(svc)
+	assert.Nil(t, err)
+	assert.Contains(t, string(patch), `{"op":"remove","path":"/spec/clusterIP"}`)
+	assert.Contains(t, string(patch), `{"op":"remove","path":"/spec/clusterIPs"}`)
+
+	// Older clusters have no `clusterIPs`
+	ServiceClusterIPs = false
+	patch, err = unidlerServicePatch(svc)
+	assert.Nil(t, err)
+	assert.Contains(t, string(patch), `{"op":"remove","path":"/spec/clusterIP"}`)
+	assert.NotContains(t, string(patch), "clusterIPs")
+
+	// Nothing to release
+	svc.Spec.ClusterIP = ""
+	patch, err = unidlerServicePatch(svc)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(patch), "clusterIP")
+}
+
+func TestDiscoverServiceClusterIPs(t *testing.T) {
+	for v, expected := range map[string]bool{"19": false, "20": true, "27+": true} {
+		d := &discoveryFake.FakeDiscovery{Fake: &k8sTesting.Fake{}, FakedServerVersion: &version.Info{Major: "1", Minor: v}}
+		assert.Equal(t, expected, DiscoverServiceClusterIPs(d), "version 1.%s", v)
+	}
+}
+
+func TestIdlerIdlesInactiveApps(t *testing.T) {
+	const ns = "idler-ns"
+	client, restore := withResolvers()
+	defer restore()
+
+	idleableLabels := map[string]string{IdleableLabel: "true"}
+	idleableDeployment(client, ns, "inactive", 1, idleableLabels)
+	idleableDeployment(client, ns, "active", 1, idleableLabels)
+	idleableDeployment(client, ns, "idled", 0, map[string]string{IdleableLabel: "true", IdledLabel: "true"})
+	idleableDeployment(client, ns, "other", 1, nil)
+	for _, name := range []string{"active", "other"} {
+		client.CoreV1().Services(ns).Create(&coreAPI.Service{ObjectMeta: metaAPI.ObjectMeta{Namespace: ns, Name: name}})
+	}
+	// The Service of the inactive app is the one selecting its pods
+	client.CoreV1().Services(ns).Create(&coreAPI.Service{
+		ObjectMeta: metaAPI.ObjectMeta{Namespace: ns, Name: "inactive-svc"},
+		Spec:       coreAPI.ServiceSpec{Selector: map[string]string{"app": "inactive"}},
+	})
+	// The active app was unidled recently
+	pod := readyPod(ns, "active-abc", map[string]string{"app": "active"})
+	pod.CreationTimestamp = metaAPI.NewTime(time.Now().Add(-10 * time.Minute))
+	client.CoreV1().Pods(ns).Create(pod)
+
+	idler := NewIdler(DEFAULT_IDLER_SELECTOR, time.Hour, time.Minute, &lastUnidleActivity{})
+	assert.Equal(t, 1, idler.Run())
+
+	assert.Equal(t, int32(0), *getDeployment(ns, "inactive").Spec.Replicas)
+	assert.Equal(t, "1", getDeployment(ns, "inactive").Annotations[ReplicasWhenUnidledAnnotation])
+	svc, _ := client.CoreV1().Services(ns).Get("inactive-svc", metaAPI.GetOptions{})
+	assert.Equal(t, coreAPI.ServiceTypeExternalName, svc.Spec.Type)
+	assert.Equal(t, int32(1), *getDeployment(ns, "active").Spec.Replicas)
+	assert.Equal(t, int32(1), *getDeployment(ns, "other").Spec.Replicas)
+
+	// Once idled, the app isn't idled again
+	assert.Equal(t, 0, idler.Run())
+}
+
+func TestIdlerIdlesAppGroups(t *testing.T) {
+	const host = "idler-group.example.com"
+	const ns = "idler-group-ns"
+	labels := map[string]string{UnidleKeyLabel: unidleKey(host)}
+	client, restore := withResolvers(&labelResolver{})
+	defer restore()
+	mockApp(client, ns, "web", host, "/", labels)
+	client.AppsV1().Deployments(ns).Delete("web", nil)
+	idleableDeployment(client, ns, "web", 1, map[string]string{UnidleKeyLabel: unidleKey(host), IdleableLabel: "true"})
+	replicas := int32(1)
+	client.AppsV1().StatefulSets(ns).Create(&appsAPI.StatefulSet{
+		ObjectMeta: metaAPI.ObjectMeta{Namespace: ns, Name: "cache", Labels: labels},
+		Spec:       appsAPI.StatefulSetSpec{Replicas: &replicas},
+	})
+
+	proceed := make(chan struct{})
+	defer func(previous *JobManager) { jobs = previous }(jobs)
+	jobs = NewJobManager(func(job *Job) {
+		<-proceed
+		job.Succeed()
+	})
+	unidling := jobs.Unidle(host, "/", "test-request-id", trace.SpanContext{})
+
+	// The app is being unidled
+	idler := NewIdler(DEFAULT_IDLER_SELECTOR, time.Hour, time.Minute, &lastUnidleActivity{})
+	assert.Equal(t, 0, idler.Run())
+	assert.Equal(t, int32(1), *getDeployment(ns, "web").Spec.Replicas)
+
+	close(proceed)
+	waitFor(t, unidling.Done, "unidling to complete")
+	assert.Equal(t, 1, idler.Run())
+
+	// The whole group is idled
+	assert.Equal(t, int32(0), *getDeployment(ns, "web").Spec.Replicas)
+	cache, _ := client.AppsV1().StatefulSets(ns).Get("cache", metaAPI.GetOptions{})
+	assert.Equal(t, int32(0), *cache.Spec.Replicas)
+	assert.Equal(t, "true", cache.Labels[IdledLabel])
+	// The next request unidles the app again
+	assert.False(t, unidling == jobs.Unidle(host, "/", "test-request-id", trace.SpanContext{}), "expected a new Job once idled")
+}
+
+func TestIdlerIdlesStatefulSets(t *testing.T) {
+	const ns = "idler-sts-ns"
+	client, restore := withResolvers()
+	defer restore()
+
+	replicas := int32(1)
+	client.AppsV1().StatefulSets(ns).Create(&appsAPI.StatefulSet{
+		ObjectMeta: metaAPI.ObjectMeta{Namespace: ns, Name: "db", Labels: map[string]string{IdleableLabel: "true"}},
+		Spec:       appsAPI.StatefulSetSpec{Replicas: &replicas},
+	})
+	client.CoreV1().Services(ns).Create(&coreAPI.Service{ObjectMeta: metaAPI.ObjectMeta{Namespace: ns, Name: "db"}})
+
+	idler := NewIdler(DEFAULT_IDLER_SELECTOR, time.Hour, time.Minute, &lastUnidleActivity{})
+	assert.Equal(t, 1, idler.Run())
+
+	sts, _ := client.AppsV1().StatefulSets(ns).Get("db", metaAPI.GetOptions{})
+	assert.Equal(t, int32(0), *sts.Spec.Replicas)
+	assert.Equal(t, "1", sts.Annotations[ReplicasWhenUnidledAnnotation])
+	svc, _ := client.CoreV1().Services(ns).Get("db", metaAPI.GetOptions{})
+	assert.Equal(t, coreAPI.ServiceTypeExternalName, svc.Spec.Type)
+}
+
+func TestIdlerHonoursGracePeriod(t *testing.T) {
+	const ns = "grace-ns"
+	client, restore := withResolvers()
+	defer restore()
+
+	idleableDeployment(client, ns, "web", 1, map[string]string{IdleableLabel: "true"})
+	client.CoreV1().Services(ns).Create(&coreAPI.Service{ObjectMeta: metaAPI.ObjectMeta{Namespace: ns, Name: "web"}})
+	dep := getDeployment(ns, "web")
+	dep.Annotations = map[string]string{UnidledAtAnnotation: time.Now().UTC().Add(-5 * time.Minute).Format(IdledAtFormat)}
+	client.AppsV1().Deployments(ns).Update((*appsAPI.Deployment)(&dep))
+
+	// Unidled 5 minutes ago, without any pod: it's inactive but still in its
+	// grace period
+	idler := NewIdler(DEFAULT_IDLER_SELECTOR, time.Minute, time.Minute, &lastUnidleActivity{})
+	assert.Equal(t, 0, idler.Run())
+
+	dep.Annotations[UnidledAtAnnotation] = time.Now().UTC().Add(-UnidleGracePeriod).Format(IdledAtFormat)
+	client.AppsV1().Deployments(ns).Update((*appsAPI.Deployment)(&dep))
+	assert.Equal(t, 1, idler.Run())
+}
+
+func TestRequestsActivity(t *testing.T) {
+	count := "0"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/api/v1/query", req.URL.Path)
+		assert.Equal(t, `sum(increase(nginx_ingress_controller_requests{exported_namespace="test-ns",exported_service="test-svc"}[3600s]))`, req.URL.Query().Get("query"))
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "vector", "result": [{"metric": {}, "value": [1546300800, "` + count + `"]}]}}`))
+	}))
+	defer server.Close()
+
+	activity, err := NewRequestsActivity(server.URL+"/", DEFAULT_ACTIVITY_QUERY)
+	assert.Nil(t, err)
+	dep := &Deployment{ObjectMeta: metaAPI.ObjectMeta{Namespace: NS, Name: NAME}}
+	svc := &Service{ObjectMeta: metaAPI.ObjectMeta{Namespace: NS, Name: "test-svc"}}
+
+	active, err := activity.Active(dep, svc, time.Hour)
+	assert.Nil(t, err)
+	assert.False(t, active)
+
+	count = "2.5"
+	active, err = activity.Active(dep, svc, time.Hour)
+	assert.Nil(t, err)
+	assert.True(t, active)
+}
+
+func TestIdlerFromEnv(t *testing.T) {
+	defer os.Unsetenv("ACTIVITY_SOURCE")
+
+	idler, err := IdlerFromEnv()
+	assert.Nil(t, err)
+	assert.Equal(t, ActivityLastUnidle, idler.activity.Name())
+	assert.Equal(t, "mojanalytics.xyz/idleable=true", idler.selector)
+
+	os.Setenv("ACTIVITY_SOURCE", ActivityRequests)
+	_, err = IdlerFromEnv()
+	assert.Contains(t, err.Error(), "requires $PROMETHEUS_URL")
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	extAPI "k8s.io/api/extensions/v1beta1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+// Ingress API versions, in order of preference
+const (
+	NetworkingV1      = "networking.k8s.io/v1"
+	NetworkingV1beta1 = "networking.k8s.io/v1beta1"
+	ExtensionsV1beta1 = "extensions/v1beta1"
+)
+
+// IngressAPIVersions are the Ingress API versions supported, in order of
+// preference
+var IngressAPIVersions = []string{NetworkingV1, NetworkingV1beta1, ExtensionsV1beta1}
+
+// ingressClient is the client of the Ingress API version served by the
+// cluster, see DiscoverIngressClient
+var ingressClient IngressClient = &extensionsIngressClient{}
+
+// Ingress is a version-neutral view of an Ingress: its metadata, hosts, paths
+// and backends, whichever API version the cluster serves
+type Ingress struct {
+	metaAPI.TypeMeta
+	metaAPI.ObjectMeta
+
+	// DefaultBackend is the backend of the requests not matching any rule
+	DefaultBackend *IngressBackend
+	Rules          []IngressRule
+}
+
+// IngressRule routes the requests for a host
+type IngressRule struct {
+	Host  string
+	Paths []IngressPath
+}
+
+// IngressPath routes the requests for a path of a host to a backend
+type IngressPath struct {
+	Path string
+	// PathType is empty for API versions which don't have it
+	PathType string
+	Backend  IngressBackend
+}
+
+// IngressBackend is the Service (and port) requests are routed to
+type IngressBackend struct {
+	ServiceName string
+	ServicePort intstr.IntOrString
+}
+
+// Hosts returns the hosts of the Ingress rules
+func (ing *Ingress) Hosts() []string {
+	hosts := []string{}
+	for _, rule := range ing.Rules {
+		if rule.Host != "" {
+			hosts = append(hosts, rule.Host)
+		}
+	}
+	return hosts
+}
+
+// Match returns the rule path routing the requests for the given host and
+// path: the longest one matching it, as the ingress controllers do. It's nil
+// when none matches
+func (ing *Ingress) Match(host string, path string) *IngressPath {
+	var match *IngressPath
+	for _, rule := range ing.Rules {
+		if rule.Host != host {
+			continue
+		}
+		for i := range rule.Paths {
+			candidate := &rule.Paths[i]
+			if pathMatches(candidate, path) && (match == nil || len(candidate.Path) > len(match.Path)) {
+				match = candidate
+			}
+		}
+	}
+	return match
+}
+
+// Backend returns the backend of the requests for the given host and path:
+// the one of the matching rule path, or else the default backend. It's nil
+// when there's neither
+func (ing *Ingress) Backend(host string, path string) *IngressBackend {
+	if match := ing.Match(host, path); match != nil {
+		return &match.Backend
+	}
+	return ing.DefaultBackend
+}
+
+// pathMatches returns true if the rule path matches the request path. `Exact`
+// paths must be equal, the others are prefixes of whole path elements (i.e.
+// `/foo` matches `/foo/bar` but not `/foobar`)
+func pathMatches(rule *IngressPath, path string) bool {
+	if rule.PathType == "Exact" {
+		return rule.Path == path
+	}
+	prefix := strings.TrimSuffix(rule.Path, "/")
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// DeepCopyObject implements runtime.Object, so that Ingresses can be watched
+// and cached
+func (ing *Ingress) DeepCopyObject() runtime.Object {
+	return ing.DeepCopy()
+}
+
+// DeepCopy returns a copy of the Ingress
+func (ing *Ingress) DeepCopy() *Ingress {
+	copied := &Ingress{TypeMeta: ing.TypeMeta}
+	ing.ObjectMeta.DeepCopyInto(&copied.ObjectMeta)
+	if ing.DefaultBackend != nil {
+		backend := *ing.DefaultBackend
+		copied.DefaultBackend = &backend
+	}
+	if ing.Rules != nil {
+		copied.Rules = make([]IngressRule, len(ing.Rules))
+		for i, rule := range ing.Rules {
+			copied.Rules[i] = IngressRule{
+				Host:  rule.Host,
+				Paths: append([]IngressPath(nil), rule.Paths...),
+			}
+		}
+	}
+	return copied
+}
+
+// IngressList is a list of Ingresses, as listed by the cache's informer
+type IngressList struct {
+	metaAPI.TypeMeta
+	metaAPI.ListMeta
+
+	Items []Ingress
+}
+
+// DeepCopyObject implements runtime.Object
+func (list *IngressList) DeepCopyObject() runtime.Object {
+	copied := &IngressList{TypeMeta: list.TypeMeta}
+	list.ListMeta.DeepCopyInto(&copied.ListMeta)
+	if list.Items != nil {
+		copied.Items = make([]Ingress, len(list.Items))
+		for i := range list.Items {
+			copied.Items[i] = *list.Items[i].DeepCopy()
+		}
+	}
+	return copied
+}
+
+// IngressClient lists and watches the Ingresses using one of the Ingress API
+// versions
+type IngressClient interface {
+	// APIVersion is the API version used, e.g. "networking.k8s.io/v1"
+	APIVersion() string
+	// List returns the Ingresses in the namespace (all if empty) and the
+	// resource version of the list
+	List(namespace string, opts metaAPI.ListOptions) ([]Ingress, string, error)
+	// Watch watches the Ingresses in the namespace (all if empty). The
+	// objects of the events are *Ingress
+	Watch(namespace string, opts metaAPI.ListOptions) (watch.Interface, error)
+	// Patch applies a JSON patch (RFC 6902) to the Ingress. Its paths are
+	// those of the API version used
+	Patch(namespace string, name string, patch []byte) error
+}
+
+// DiscoverIngressClient returns the client for the preferred Ingress API
+// version served by the cluster. The given REST client is used for the
+// `networking.k8s.io` versions, which aren't in the vendored client-go
+func DiscoverIngressClient(d discovery.DiscoveryInterface, client rest.Interface) IngressClient {
+	for _, version := range IngressAPIVersions {
+		resources, err := d.ServerResourcesForGroupVersion(version)
+		if err != nil {
+			// Not served by the cluster
+			continue
+		}
+		for _, resource := range resources.APIResources {
+			if resource.Name != "ingresses" {
+				continue
+			}
+			if version == ExtensionsV1beta1 {
+				return &extensionsIngressClient{}
+			}
+			return &networkingIngressClient{version: version, client: client}
+		}
+	}
+
+	logger.Info("No Ingress API version discovered. Defaulting to '%s'", ExtensionsV1beta1)
+	return &extensionsIngressClient{}
+}
+
+// extensionsIngressClient uses the `extensions/v1beta1` Ingress API
+type extensionsIngressClient struct{}
+
+func (c *extensionsIngressClient) APIVersion() string {
+	return ExtensionsV1beta1
+}
+
+func (c *extensionsIngressClient) List(namespace string, opts metaAPI.ListOptions) ([]Ingress, string, error) {
+	list, err := k8sClient.ExtensionsV1beta1().Ingresses(namespace).List(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	ings := []Ingress{}
+	for i := range list.Items {
+		ings = append(ings, *ingressFromExtensions(&list.Items[i]))
+	}
+	return ings, list.ResourceVersion, nil
+}
+
+func (c *extensionsIngressClient) Watch(namespace string, opts metaAPI.ListOptions) (watch.Interface, error) {
+	w, err := k8sClient.ExtensionsV1beta1().Ingresses(namespace).Watch(opts)
+	if err != nil {
+		return nil, err
+	}
+	return watch.Filter(w, func(event watch.Event) (watch.Event, bool) {
+		if ing, ok := event.Object.(*extAPI.Ingress); ok {
+			event.Object = ingressFromExtensions(ing)
+		}
+		return event, true
+	}), nil
+}
+
+func (c *extensionsIngressClient) Patch(namespace string, name string, patch []byte) error {
+	_, err := k8sClient.ExtensionsV1beta1().Ingresses(namespace).Patch(name, types.JSONPatchType, patch)
+	return err
+}
+
+// ingressFromExtensions returns the version-neutral view of an
+// `extensions/v1beta1` Ingress
+func ingressFromExtensions(ing *extAPI.Ingress) *Ingress {
+	neutral := &Ingress{
+		TypeMeta:   metaAPI.TypeMeta{APIVersion: ExtensionsV1beta1, Kind: "Ingress"},
+		ObjectMeta: *ing.ObjectMeta.DeepCopy(),
+	}
+	if ing.Spec.Backend != nil {
+		neutral.DefaultBackend = &IngressBackend{
+			ServiceName: ing.Spec.Backend.ServiceName,
+			ServicePort: ing.Spec.Backend.ServicePort,
+		}
+	}
+	for _, rule := range ing.Spec.Rules {
+		neutralRule := IngressRule{Host: rule.Host}
+		if rule.HTTP != nil {
+			for _, path := range rule.HTTP.Paths {
+				neutralRule.Paths = append(neutralRule.Paths, IngressPath{
+					Path: path.Path,
+					Backend: IngressBackend{
+						ServiceName: path.Backend.ServiceName,
+						ServicePort: path.Backend.ServicePort,
+					},
+				})
+			}
+		}
+		neutral.Rules = append(neutral.Rules, neutralRule)
+	}
+	return neutral
+}
+
+// networkingIngressClient uses one of the `networking.k8s.io` Ingress APIs,
+// decoding their JSON
+type networkingIngressClient struct {
+	version string
+	client  rest.Interface
+}
+
+func (c *networkingIngressClient) APIVersion() string {
+	return c.version
+}
+
+func (c *networkingIngressClient) path(namespace string) string {
+	if namespace == "" {
+		return fmt.Sprintf("/apis/%s/ingresses", c.version)
+	}
+	return fmt.Sprintf("/apis/%s/namespaces/%s/ingresses", c.version, namespace)
+}
+
+// request builds the request of the Ingresses in the namespace (all of them
+// when empty), with all the ListOptions as query parameters
+func (c *networkingIngressClient) request(namespace string, opts metaAPI.ListOptions) *rest.Request {
+	// NOTE: Encoded in their own `meta.k8s.io/v1` version, as the REST client
+	//       isn't one of the Ingress APIs
+	return c.client.Get().
+		AbsPath(c.path(namespace)).
+		SpecificallyVersionedParams(&opts, metaAPI.ParameterCodec, metaAPI.SchemeGroupVersion)
+}
+
+func (c *networkingIngressClient) List(namespace string, opts metaAPI.ListOptions) ([]Ingress, string, error) {
+	body, err := c.request(namespace, opts).DoRaw()
+	if err != nil {
+		return nil, "", err
+	}
+
+	list := networkingIngressList{}
+	err = json.Unmarshal(body, &list)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed decoding %s Ingresses: %s", c.version, err)
+	}
+	ings := []Ingress{}
+	for i := range list.Items {
+		ings = append(ings, *list.Items[i].neutral(c.version))
+	}
+	return ings, list.Metadata.ResourceVersion, nil
+}
+
+func (c *networkingIngressClient) Watch(namespace string, opts metaAPI.ListOptions) (watch.Interface, error) {
+	opts.Watch = true
+	stream, err := c.request(namespace, opts).Stream()
+	if err != nil {
+		return nil, err
+	}
+	return watch.NewStreamWatcher(&networkingIngressDecoder{
+		version: c.version,
+		stream:  stream,
+		decoder: json.NewDecoder(stream),
+	}), nil
+}
+
+func (c *networkingIngressClient) Patch(namespace string, name string, patch []byte) error {
+	return c.client.Patch(types.JSONPatchType).
+		AbsPath(c.path(namespace), name).
+		Body(patch).
+		Do().
+		Error()
+}
+
+// networkingIngressDecoder decodes the events of a watch on `networking.k8s.io`
+// Ingresses
+type networkingIngressDecoder struct {
+	version string
+	stream  io.ReadCloser
+	decoder *json.Decoder
+}
+
+func (d *networkingIngressDecoder) Decode() (watch.EventType, runtime.Object, error) {
+	event := struct {
+		Type   watch.EventType `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}{}
+	err := d.decoder.Decode(&event)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if event.Type == watch.Error {
+		status := &metaAPI.Status{}
+		err = json.Unmarshal(event.Object, status)
+		return event.Type, status, err
+	}
+
+	ing := networkingIngress{}
+	err = json.Unmarshal(event.Object, &ing)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed decoding %s Ingress: %s", d.version, err)
+	}
+	return event.Type, ing.neutral(d.version), nil
+}
+
+func (d *networkingIngressDecoder) Close() {
+	d.stream.Close()
+}
+
+// networkingIngressList is a list of `networking.k8s.io/v1` or
+// `networking.k8s.io/v1beta1` Ingresses
+type networkingIngressList struct {
+	Metadata metaAPI.ListMeta    `json:"metadata"`
+	Items    []networkingIngress `json:"items"`
+}
+
+// networkingIngress is a `networking.k8s.io/v1` or `networking.k8s.io/v1beta1`
+// Ingress. Their backends differ: v1beta1 has `serviceName`/`servicePort`, v1
+// has `service.name`/`service.port`
+type networkingIngress struct {
+	Metadata metaAPI.ObjectMeta `json:"metadata"`
+	Spec     struct {
+		DefaultBackend *networkingBackend `json:"defaultBackend"`
+		Backend        *networkingBackend `json:"backend"`
+		Rules          []struct {
+			Host string `json:"host"`
+			HTTP *struct {
+				Paths []struct {
+					Path     string            `json:"path"`
+					PathType string            `json:"pathType"`
+					Backend  networkingBackend `json:"backend"`
+				} `json:"paths"`
+			} `json:"http"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+type networkingBackend struct {
+	// v1beta1
+	ServiceName string             `json:"serviceName"`
+	ServicePort intstr.IntOrString `json:"servicePort"`
+	// v1
+	Service *struct {
+		Name string `json:"name"`
+		Port struct {
+			Name   string `json:"name"`
+			Number int32  `json:"number"`
+		} `json:"port"`
+	} `json:"service"`
+}
+
+func (b *networkingBackend) neutral() IngressBackend {
+	if b.Service == nil {
+		return IngressBackend{ServiceName: b.ServiceName, ServicePort: b.ServicePort}
+	}
+	port := intstr.FromInt(int(b.Service.Port.Number))
+	if b.Service.Port.Name != "" {
+		port = intstr.FromString(b.Service.Port.Name)
+	}
+	return IngressBackend{ServiceName: b.Service.Name, ServicePort: port}
+}
+
+func (ing *networkingIngress) neutral(version string) *Ingress {
+	neutral := &Ingress{
+		TypeMeta:   metaAPI.TypeMeta{APIVersion: version, Kind: "Ingress"},
+		ObjectMeta: ing.Metadata,
+	}
+	defaultBackend := ing.Spec.DefaultBackend
+	if defaultBackend == nil {
+		defaultBackend = ing.Spec.Backend
+	}
+	if defaultBackend != nil {
+		backend := defaultBackend.neutral()
+		neutral.DefaultBackend = &backend
+	}
+	for _, rule := range ing.Spec.Rules {
+		neutralRule := IngressRule{Host: rule.Host}
+		if rule.HTTP != nil {
+			for _, path := range rule.HTTP.Paths {
+				neutralRule.Paths = append(neutralRule.Paths, IngressPath{
+					Path:     path.Path,
+					PathType: path.PathType,
+					Backend:  path.Backend.neutral(),
+				})
+			}
+		}
+		neutral.Rules = append(neutral.Rules, neutralRule)
+	}
+	return neutral
+}
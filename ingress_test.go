@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
+	discoveryFake "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+const networkingV1Ingress = `{
+	"metadata": {"name": "%s", "namespace": "%s", "resourceVersion": "7", "labels": {"unidle-key": "%s"}},
+	"spec": {
+		"ingressClassName": "nginx",
+		"rules": [{
+			"host": "%s",
+			"http": {"paths": [{"path": "/", "pathType": "Prefix", "backend": {"service": {"name": "%s", "port": {"number": 80}}}}]}
+		}]
+	}
+}`
+
+const networkingV1beta1Ingress = `{
+	"metadata": {"name": "%s", "namespace": "%s", "resourceVersion": "7", "labels": {"unidle-key": "%s"}},
+	"spec": {
+		"backend": {"serviceName": "default-backend", "servicePort": "http"},
+		"rules": [{
+			"host": "%s",
+			"http": {"paths": [{"path": "/", "backend": {"serviceName": "%s", "servicePort": 80}}]}
+		}]
+	}
+}`
+
+// fakeIngressAPI serves a `networking.k8s.io` Ingress API with a single
+// Ingress (the test app's one) and returns a client for it
+func fakeIngressAPI(t *testing.T, version string, ingress string) (IngressClient, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		encoded := fmt.Sprintf(ingress, NAME, NS, UNIDLE_KEY, HOST, NAME)
+		assert.Contains(t, []string{
+			fmt.Sprintf("/apis/%s/ingresses", version),
+			fmt.Sprintf("/apis/%s/namespaces/%s/ingresses", version, NS),
+		}, req.URL.Path)
+
+		if req.URL.Query().Get("watch") == "true" {
+			fmt.Fprintf(w, `{"type": "MODIFIED", "object": %s}`+"\n", encoded)
+			fmt.Fprintf(w, `{"type": "ERROR", "object": {"kind": "Status", "code": 410, "reason": "Expired"}}`+"\n")
+			return
+		}
+		selector := req.URL.Query().Get("labelSelector")
+		if selector != "" && selector != fmt.Sprintf("%s=%s", UnidleKeyLabel, UNIDLE_KEY) {
+			fmt.Fprintf(w, `{"metadata": {"resourceVersion": "8"}, "items": []}`)
+			return
+		}
+		fmt.Fprintf(w, `{"metadata": {"resourceVersion": "8"}, "items": [%s]}`, encoded)
+	}))
+
+	discovery := &discoveryFake.FakeDiscovery{Fake: &k8sTesting.Fake{Resources: []*metaAPI.APIResourceList{
+		{GroupVersion: version, APIResources: []metaAPI.APIResource{{Name: "ingresses"}}},
+	}}}
+	return DiscoverIngressClient(discovery, restClientFor(t, server)), server.Close
+}
+
+// restClientFor returns a REST client of the given test server
+func restClientFor(t *testing.T, server *httptest.Server) rest.Interface {
+	client, err := rest.RESTClientFor(&rest.Config{
+		Host: server.URL,
+		ContentConfig: rest.ContentConfig{
+			GroupVersion:         &schema.GroupVersion{},
+			NegotiatedSerializer: scheme.Codecs,
+		},
+	})
+	assert.Nil(t, err)
+	return client
+}
+
+func TestDiscoverIngressClient(t *testing.T) {
+	ingresses := []metaAPI.APIResource{{Name: "networkpolicies"}, {Name: "ingresses"}}
+	// e.g. kubernetes 1.13, which serves NetworkPolicies but no Ingresses
+	networkPolicies := []metaAPI.APIResource{{Name: "networkpolicies"}}
+
+	testCases := []struct {
+		served   map[string][]metaAPI.APIResource
+		expected string
+	}{
+		{
+			served:   map[string][]metaAPI.APIResource{ExtensionsV1beta1: ingresses, NetworkingV1beta1: ingresses, NetworkingV1: ingresses},
+			expected: NetworkingV1,
+		},
+		{
+			served:   map[string][]metaAPI.APIResource{ExtensionsV1beta1: ingresses, NetworkingV1beta1: ingresses, NetworkingV1: networkPolicies},
+			expected: NetworkingV1beta1,
+		},
+		{
+			served:   map[string][]metaAPI.APIResource{ExtensionsV1beta1: ingresses, NetworkingV1: networkPolicies},
+			expected: ExtensionsV1beta1,
+		},
+		{
+			served:   map[string][]metaAPI.APIResource{},
+			expected: ExtensionsV1beta1,
+		},
+	}
+
+	for _, tc := range testCases {
+		resources := []*metaAPI.APIResourceList{}
+		for version, served := range tc.served {
+			resources = append(resources, &metaAPI.APIResourceList{GroupVersion: version, APIResources: served})
+		}
+		discovery := &discoveryFake.FakeDiscovery{Fake: &k8sTesting.Fake{Resources: resources}}
+		assert.Equal(t, tc.expected, DiscoverIngressClient(discovery, nil).APIVersion(), "%v", tc.served)
+	}
+}
+
+func TestExtensionsIngressClient(t *testing.T) {
+	client := &extensionsIngressClient{}
+	ings, _, err := client.List(NS, metaAPI.ListOptions{})
+	assert.Nil(t, err)
+	if assert.Len(t, ings, 1) {
+		assert.Equal(t, ExtensionsV1beta1, ings[0].APIVersion)
+		assert.Equal(t, []string{HOST}, ings[0].Hosts())
+	}
+
+	w, err := client.Watch("extensions-watch-ns", metaAPI.ListOptions{})
+	assert.Nil(t, err)
+	defer w.Stop()
+	go mockIngress(k8sClient, "extensions-watch-ns", NAME, HOST)
+	event := <-w.ResultChan()
+	assert.Equal(t, watch.Added, event.Type)
+	if assert.IsType(t, &Ingress{}, event.Object) {
+		assert.Equal(t, "extensions-watch-ns", event.Object.(*Ingress).Namespace)
+	}
+	k8sClient.ExtensionsV1beta1().Ingresses("extensions-watch-ns").Delete(NAME, &metaAPI.DeleteOptions{})
+}
+
+func TestNetworkingIngressClient(t *testing.T) {
+	testCases := []struct {
+		version        string
+		ingress        string
+		pathType       string
+		defaultBackend *IngressBackend
+	}{
+		{version: NetworkingV1, ingress: networkingV1Ingress, pathType: "Prefix"},
+		{
+			version:        NetworkingV1beta1,
+			ingress:        networkingV1beta1Ingress,
+			defaultBackend: &IngressBackend{ServiceName: "default-backend", ServicePort: intstr.FromString("http")},
+		},
+	}
+
+	for _, tc := range testCases {
+		client, stop := fakeIngressAPI(t, tc.version, tc.ingress)
+		assert.Equal(t, tc.version, client.APIVersion())
+
+		ings, resourceVersion, err := client.List("", metaAPI.ListOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, "8", resourceVersion)
+		assert.Equal(t, []Ingress{{
+			TypeMeta: metaAPI.TypeMeta{APIVersion: tc.version, Kind: "Ingress"},
+			ObjectMeta: metaAPI.ObjectMeta{
+				Name:            NAME,
+				Namespace:       NS,
+				ResourceVersion: "7",
+				Labels:          map[string]string{"unidle-key": UNIDLE_KEY},
+			},
+			DefaultBackend: tc.defaultBackend,
+			Rules: []IngressRule{{
+				Host: HOST,
+				Paths: []IngressPath{{
+					Path:     "/",
+					PathType: tc.pathType,
+					Backend:  IngressBackend{ServiceName: NAME, ServicePort: intstr.FromInt(80)},
+				}},
+			}},
+		}}, ings, tc.version)
+
+		w, err := client.Watch("", metaAPI.ListOptions{ResourceVersion: "8"})
+		assert.Nil(t, err)
+		event := <-w.ResultChan()
+		assert.Equal(t, watch.Modified, event.Type)
+		assert.Equal(t, &ings[0], event.Object)
+		event = <-w.ResultChan()
+		assert.Equal(t, watch.Error, event.Type)
+		assert.Equal(t, int32(410), event.Object.(*metaAPI.Status).Code)
+		w.Stop()
+
+		stop()
+	}
+}
+
+func TestNetworkingIngressClientPassesListOptions(t *testing.T) {
+	queries := []url.Values{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		queries = append(queries, req.URL.Query())
+		fmt.Fprintf(w, `{"metadata": {"resourceVersion": "8"}, "items": []}`)
+	}))
+	defer server.Close()
+	client := &networkingIngressClient{version: NetworkingV1, client: restClientFor(t, server)}
+
+	timeout := int64(300)
+	_, _, err := client.List(NS, metaAPI.ListOptions{
+		LabelSelector:   "app=test",
+		FieldSelector:   "metadata.name=test",
+		ResourceVersion: "7",
+		TimeoutSeconds:  &timeout,
+		Limit:           500,
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, []url.Values{{
+		"labelSelector":   {"app=test"},
+		"fieldSelector":   {"metadata.name=test"},
+		"resourceVersion": {"7"},
+		"timeoutSeconds":  {"300"},
+		"limit":           {"500"},
+	}}, queries)
+}
+
+func TestNewAppWithNetworkingIngress(t *testing.T) {
+	defer func(previous IngressClient) { ingressClient = previous }(ingressClient)
+	ingresses := map[string]string{
+		NetworkingV1:      networkingV1Ingress,
+		NetworkingV1beta1: networkingV1beta1Ingress,
+	}
+
+	for version, ingress := range ingresses {
+		client, stop := fakeIngressAPI(t, version, ingress)
+		ingressClient = client
+
+		a, err := NewApp(HOST, "/", logger, nil)
+		assert.Nil(t, err)
+		if assert.NotNil(t, a) {
+			assert.Equal(t, version, a.ingress.APIVersion)
+			assert.Equal(t, NS, a.ingress.Namespace)
+			assert.Equal(t, &deploy, a.workload)
+			assert.Equal(t, &svc, a.service)
+		}
+
+		stop()
+	}
+}
+
+func TestIngressMatch(t *testing.T) {
+	ing := &Ingress{Rules: []IngressRule{
+		{Host: "other.example.com", Paths: []IngressPath{{Path: "/"}}},
+		{Host: HOST, Paths: []IngressPath{
+			{Path: "/", Backend: IngressBackend{ServiceName: "root"}},
+			{Path: "/foo", PathType: "Prefix", Backend: IngressBackend{ServiceName: "foo"}},
+			{Path: "/foo/bar/", Backend: IngressBackend{ServiceName: "bar"}},
+			{Path: "/exact", PathType: "Exact", Backend: IngressBackend{ServiceName: "exact"}},
+		}},
+	}}
+
+	testCases := map[string]string{
+		"/":             "root",
+		"/foo":          "foo",
+		"/foo/":         "foo",
+		"/foobar":       "root",
+		"/foo/bar":      "bar",
+		"/foo/bar/baz":  "bar",
+		"/exact":        "exact",
+		"/exact/nested": "root",
+	}
+	for path, service := range testCases {
+		assert.Equal(t, service, ing.Match(HOST, path).Backend.ServiceName, path)
+	}
+	assert.Nil(t, ing.Match("unknown.example.com", "/"))
+
+	ing.DefaultBackend = &IngressBackend{ServiceName: "default"}
+	assert.Equal(t, "default", ing.Backend("unknown.example.com", "/").ServiceName)
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	coreAPI "k8s.io/api/core/v1"
+)
+
+// JobRetention is how long a successfully completed Job is kept around so
+// that clients reconnecting after the end of the unidling still get the
+// outcome instead of starting a new Job
+const JobRetention = 1 * time.Minute
+
+// RetryInterval is the time clients should wait before reconnecting when
+// their connection is lost, sent with each progress message
+const RetryInterval = 3 * time.Second
+
+// Job is a single run of the unidling of an app. It runs in the background,
+// independently of any request, and records its progress messages so that
+// any number of clients can follow it
+type Job struct {
+	host      string
+	path      string
+	key       string
+	id        string
+	requestID string
+	// trace is the trace context of the request which started the Job
+	trace trace.SpanContext
+
+	mu       sync.Mutex
+	messages []*Message
+	done     bool
+	changed  chan struct{}
+}
+
+// JobManager runs unidling Jobs, making sure there is at most one Job
+// running for the same app at any time
+type JobManager struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+	// routes are the Jobs by route requested, so that reconnecting clients
+	// find their Job without looking the app up again
+	routes map[Route]*Job
+	run    func(*Job)
+}
+
+// NewJobManager constructs a new JobManager which will use the given function
+// to run its Jobs
+func NewJobManager(run func(*Job)) *JobManager {
+	return &JobManager{
+		jobs:   make(map[string]*Job),
+		routes: make(map[Route]*Job),
+		run:    run,
+	}
+}
+
+// Unidle returns the Job unidling the app for the given host and path,
+// starting a new one if there isn't one already. The new Job is correlated to
+// the request with the given ID and trace context.
+// The requests for the paths of the same app (i.e. matching the same Ingress
+// rule path) share the same Job
+func (m *JobManager) Unidle(host string, path string, requestID string, parent trace.SpanContext) *Job {
+	route := Route{Host: host, Path: path}
+
+	m.mu.Lock()
+	job, ok := m.routes[route]
+	m.mu.Unlock()
+	if ok {
+		return job
+	}
+
+	key := jobKey(route)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if job, ok := m.jobs[key]; ok {
+		m.routes[route] = job
+		return job
+	}
+
+	job = &Job{
+		host:      host,
+		path:      path,
+		key:       key,
+		id:        newJobID(),
+		requestID: requestID,
+		trace:     parent,
+		changed:   make(chan struct{}),
+	}
+	m.jobs[key] = job
+	m.routes[route] = job
+
+	go func() {
+		m.run(job)
+		m.finished(job)
+	}()
+
+	return job
+}
+
+// finished forgets about a completed Job. Failed Jobs are forgotten straight
+// away so that refreshing the page retries the unidling, successful ones
+// are kept for a while for the benefit of reconnecting clients
+func (m *JobManager) finished(job *Job) {
+	// Make sure a Job which didn't explicitly finish is marked as such
+	job.finish(nil)
+
+	if job.Failed() {
+		m.forget(job)
+		return
+	}
+
+	time.AfterFunc(JobRetention, func() {
+		m.forget(job)
+	})
+}
+
+// ForgetCompleted prepares for the app for the given host and path being
+// idled: its completed Job (kept for reconnecting clients) is forgotten, so
+// that the next request unidles it again. It returns false, forgetting
+// nothing, when the app is being unidled
+func (m *JobManager) ForgetCompleted(host string, path string) bool {
+	key := jobKey(Route{Host: host, Path: path})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[key]
+	if !ok {
+		return true
+	}
+	if !job.Done() {
+		return false
+	}
+	m.remove(job)
+	return true
+}
+
+func (m *JobManager) forget(job *Job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.jobs[job.key] == job {
+		m.remove(job)
+	}
+}
+
+// remove removes the Job and its routes. The caller must hold the lock
+func (m *JobManager) remove(job *Job) {
+	delete(m.jobs, job.key)
+	for route, j := range m.routes {
+		if j == job {
+			delete(m.routes, route)
+		}
+	}
+}
+
+// jobKey returns the key of the Job unidling the app for the route: its host
+// and the Ingress rule path it matches, in the Ingress found by the
+// `appResolvers`. Routes with no Ingress are keyed as they are, their Job
+// fails anyway
+func jobKey(route Route) string {
+	ing, _, err := appResolvers.FindIngress(route)
+	if err != nil {
+		return route.String()
+	}
+	if match := ing.Match(route.Host, route.Path); match != nil {
+		return route.Host + match.Path
+	}
+	return route.Host
+}
+
+// Host returns the host of the app being unidled
+func (j *Job) Host() string {
+	return j.host
+}
+
+// Path returns the path requested when the Job was started
+func (j *Job) Path() string {
+	return j.path
+}
+
+// RequestID returns the ID of the request which started the Job, used to
+// correlate its logs
+func (j *Job) RequestID() string {
+	return j.requestID
+}
+
+// Report records a progress update for the given step of the unidling
+func (j *Job) Report(step string, update *Update) {
+	update.RequestID = j.requestID
+	j.publish(newMessage("", step, update), false)
+}
+
+// Message records a progress message for the given step of the unidling
+func (j *Job) Message(step string, msg string) {
+	j.Report(step, &Update{Message: msg})
+}
+
+// Fail records the error which stopped the unidling at the given step and
+// terminates the Job
+func (j *Job) Fail(step string, err error) {
+	j.finish(newMessage("error", step, &Update{Message: err.Error(), RequestID: j.requestID}))
+}
+
+// Succeed records the successful unidling of the app and terminates the Job
+func (j *Job) Succeed() {
+	j.SucceedUntil(time.Time{})
+}
+
+// SucceedUntil records the successful unidling of the app, which is
+// guaranteed to stay up until the given time (if not zero), and terminates
+// the Job
+func (j *Job) SucceedUntil(upUntil time.Time) {
+	update := &Update{Message: "Ready", RequestID: j.requestID}
+	if !upUntil.IsZero() {
+		update.UpUntil = upUntil.UTC().Format(time.RFC3339)
+	}
+	j.finish(newMessage("success", StepDone, update))
+}
+
+// Done returns true if the Job terminated
+func (j *Job) Done() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.done
+}
+
+// Failed returns true if the Job terminated with an error
+func (j *Job) Failed() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.done || len(j.messages) == 0 {
+		return false
+	}
+	return j.messages[len(j.messages)-1].event == "error"
+}
+
+func (j *Job) finish(m *Message) {
+	j.publish(m, true)
+}
+
+func (j *Job) publish(m *Message, done bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.done {
+		return
+	}
+
+	if m != nil {
+		// Each message's ID identifies both the Job and the position of the
+		// message in it, so that clients can resume from where they were
+		m.id = fmt.Sprintf("%s-%d", j.id, len(j.messages)+1)
+		m.retry = int(RetryInterval / time.Millisecond)
+		j.messages = append(j.messages, m)
+	}
+	j.done = done
+
+	// Wake up all the subscribers and prepare for the next change
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// Resume returns the position from which to send progress messages to a
+// client which last received the message with the given ID, as sent back by
+// the browser in the `Last-Event-ID` header when reconnecting.
+// Clients which haven't received any message from this Job yet get all of them
+func (j *Job) Resume(lastEventID string) int {
+	prefix := j.id + "-"
+	if !strings.HasPrefix(lastEventID, prefix) {
+		return 0
+	}
+
+	pos, err := strconv.Atoi(strings.TrimPrefix(lastEventID, prefix))
+	if err != nil || pos < 0 {
+		return 0
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if pos > len(j.messages) {
+		return 0
+	}
+	return pos
+}
+
+// Progress returns the messages recorded since the given position, whether
+// the Job is done and a channel which is closed on the next change
+func (j *Job) Progress(from int) (msgs []*Message, done bool, changed <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if from < len(j.messages) {
+		msgs = j.messages[from:]
+	}
+	return msgs, j.done, j.changed
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// unidle runs the unidling of the app for the Job's host and path
+func unidle(job *Job) {
+	unidlesInFlight.Inc()
+	defer unidlesInFlight.Dec()
+
+	start := time.Now()
+	namespace := ""
+	span := startTrace("unidle", job.trace)
+	span.SetAttributes(Fields{"host": job.Host(), "path": job.Path(), "request_id": job.RequestID()})
+	defer span.Finish()
+	log := logger.With(Fields{"request_id": job.RequestID(), "host": job.Host(), "path": job.Path()})
+	if traceID := span.TraceID(); traceID != "" {
+		log = log.With(Fields{"trace_id": traceID})
+	}
+
+	var app *App
+
+	// step runs a step of the unidling, recording its duration and failure
+	step := func(name string, run func() error) bool {
+		stepStart := time.Now()
+		err := run()
+		duration := time.Since(stepStart)
+		observe(unidleStepDuration, duration.Seconds(), namespace, name)
+
+		stepLog := log.With(Fields{"step": name, "duration": duration.Seconds()})
+		if err != nil {
+			inc(unidleFailures, namespace, name)
+			observe(unidleDuration, time.Since(start).Seconds(), namespace, "failure")
+			stepLog.Error(err, "Unidling failed.")
+			span.SetAttributes(Fields{"step": name})
+			span.SetError(err)
+			if app != nil {
+				app.RecordWorkloadEvent(coreAPI.EventTypeWarning, EventUnidleFailed, "Unidling failed at step %s: %s", name, err)
+			}
+			job.Fail(name, err)
+			return false
+		}
+		stepLog.Info("Unidling step completed.")
+		return true
+	}
+
+	log.Info("Unidling started.")
+	job.Message(StepFind, "Starting unidling...")
+
+	found := step(StepFind, func() (err error) {
+		app, err = NewApp(job.Host(), job.Path(), log, span)
+		return err
+	})
+	if found {
+		namespace = app.ingress.Namespace
+		log = app.logger
+	}
+	inc(unidleAttempts, namespace)
+	if !found {
+		return
+	}
+	app.RecordWorkloadEvent(coreAPI.EventTypeNormal, EventUnidleStarted, "Unidling started for %s%s (request ID %s).", job.Host(), job.Path(), job.RequestID())
+	job.Message(StepRestoreReplicas, "App found. Unidling it...")
+
+	if !step(StepRestoreReplicas, app.SetReplicas) {
+		return
+	}
+
+	waited := step(StepWait, func() error {
+		return app.WaitForWorkload(func(update *Update) {
+			job.Report(StepWait, update)
+		})
+	})
+	if !waited {
+		return
+	}
+	app.RecordColdStart()
+	job.Message(StepRemoveIdledMetadata, "App ready. Removing idled metadata...")
+
+	removed := step(StepRemoveIdledMetadata, func() error {
+		return app.RemoveIdledMetadata(job.RequestID())
+	})
+	if !removed {
+		return
+	}
+	job.Message(StepRedirect, "Redirecting app...")
+
+	if !step(StepRedirect, app.SwitchTraffic) {
+		return
+	}
+
+	duration := time.Since(start)
+	inc(unidleSuccesses, namespace)
+	observe(unidleDuration, duration.Seconds(), namespace, "success")
+	log.With(Fields{"duration": duration.Seconds()}).Info("Unidling succeeded.")
+	job.SucceedUntil(app.UpUntil())
+}
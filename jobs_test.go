@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestJobManagerSharesRunningJob(t *testing.T) {
+	var runs int32
+	proceed := make(chan struct{})
+	manager := NewJobManager(func(job *Job) {
+		atomic.AddInt32(&runs, 1)
+		job.Message(StepFind, "Starting unidling...")
+		<-proceed
+		job.Succeed()
+	})
+
+	job1 := manager.Unidle(HOST, "/", "test-request-id", trace.SpanContext{})
+	job2 := manager.Unidle(HOST, "/", "other-request-id", trace.SpanContext{})
+	assert.True(t, job1 == job2, "expected concurrent clients to share the same Job")
+
+	rec1 := httptest.NewRecorder()
+	rec2 := httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		streamJob(rec1, job1, 0, nil)
+		streamJob(rec2, job2, 0, nil)
+		close(finished)
+	}()
+	close(proceed)
+	<-finished
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&runs))
+	assert.Equal(t, rec1.Body.String(), rec2.Body.String())
+	assert.Contains(t, rec1.Body.String(), `"message":"Starting unidling..."`)
+	assert.Contains(t, rec1.Body.String(), "event: success")
+	// Updates are correlated to the request which started the job
+	assert.Contains(t, rec1.Body.String(), `"request_id":"test-request-id"`)
+
+	// Successful job is kept for reconnecting clients
+	assert.True(t, job1 == manager.Unidle(HOST, "/", "test-request-id", trace.SpanContext{}))
+}
+
+func TestJobManagerSharesJobBetweenPathsOfApp(t *testing.T) {
+	const host = "shared-jobs.example.com"
+	client, restore := withResolvers(&ingressHostResolver{})
+	defer restore()
+	mockApp(client, "shared-ns", "dashboard", host, "/dashboard", nil)
+	mockApp(client, "shared-ns", "api", host, "/api", nil)
+
+	proceed := make(chan struct{})
+	defer close(proceed)
+	manager := NewJobManager(func(job *Job) {
+		<-proceed
+	})
+
+	dashboard := manager.Unidle(host, "/dashboard/page", "test-request-id", trace.SpanContext{})
+	assert.True(t, dashboard == manager.Unidle(host, "/dashboard/other", "test-request-id", trace.SpanContext{}))
+	assert.False(t, dashboard == manager.Unidle(host, "/api", "test-request-id", trace.SpanContext{}))
+	assert.Equal(t, "/dashboard/page", dashboard.Path())
+
+	// Reconnecting clients don't look the app up again
+	lists := countActions(client, "list")
+	assert.True(t, dashboard == manager.Unidle(host, "/dashboard/page", "test-request-id", trace.SpanContext{}))
+	assert.Equal(t, lists, countActions(client, "list"))
+}
+
+func TestJobManagerForgetsFailedJob(t *testing.T) {
+	manager := NewJobManager(func(job *Job) {
+		job.Fail(StepFind, errors.New("Deployment for your app not found."))
+	})
+
+	job := manager.Unidle(HOST, "/", "test-request-id", trace.SpanContext{})
+	rec := httptest.NewRecorder()
+	streamJob(rec, job, 0, nil)
+
+	assert.True(t, job.Failed())
+	assert.Contains(t, rec.Body.String(), "event: error")
+	assert.Contains(t, rec.Body.String(), `"message":"Deployment for your app not found."`)
+
+	// Retrying after a failure starts a new job
+	retried := manager.Unidle(HOST, "/", "test-request-id", trace.SpanContext{})
+	for i := 0; retried == job && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		retried = manager.Unidle(HOST, "/", "test-request-id", trace.SpanContext{})
+	}
+	assert.False(t, retried == job, "expected a new Job after a failure")
+}
+
+func TestJobManagerForgetsCompletedJobWhenIdled(t *testing.T) {
+	proceed := make(chan struct{})
+	manager := NewJobManager(func(job *Job) {
+		<-proceed
+		job.Succeed()
+	})
+
+	job := manager.Unidle(HOST, "/", "test-request-id", trace.SpanContext{})
+	assert.False(t, manager.ForgetCompleted(HOST, "/"), "expected a running Job not to be forgotten")
+	close(proceed)
+	streamJob(httptest.NewRecorder(), job, 0, nil)
+
+	assert.True(t, manager.ForgetCompleted(HOST, "/"))
+	assert.False(t, job == manager.Unidle(HOST, "/", "test-request-id", trace.SpanContext{}), "expected a new Job once idled")
+}
+
+func TestStreamJobStopsWhenClientGoesAway(t *testing.T) {
+	proceed := make(chan struct{})
+	defer close(proceed)
+	manager := NewJobManager(func(job *Job) {
+		job.Message(StepFind, "Starting unidling...")
+		<-proceed
+	})
+
+	closed := make(chan struct{})
+	close(closed)
+	job := manager.Unidle("other-tool.example.com", "/", "test-request-id", trace.SpanContext{})
+
+	rec := httptest.NewRecorder()
+	streamJob(rec, job, 0, closed)
+
+	_, done, _ := job.Progress(0)
+	assert.False(t, done, "expected Job to carry on without clients")
+}
+
+func TestStreamJobResumesFromLastEventID(t *testing.T) {
+	manager := NewJobManager(func(job *Job) {
+		job.Message(StepFind, "Starting unidling...")
+		job.Message(StepRestoreReplicas, "App found. Unidling it...")
+		job.Succeed()
+	})
+
+	job := manager.Unidle("resumed-tool.example.com", "/", "test-request-id", trace.SpanContext{})
+	rec := httptest.NewRecorder()
+	streamJob(rec, job, 0, nil)
+
+	msgs, _, _ := job.Progress(0)
+	assert.Equal(t, 3, len(msgs))
+	assert.Contains(t, rec.Body.String(), "id: "+msgs[0].id+"\nretry: 3000\n")
+
+	// Reconnecting client only gets the messages it missed
+	from := job.Resume(msgs[0].id)
+	assert.Equal(t, 1, from)
+	rec = httptest.NewRecorder()
+	streamJob(rec, job, from, nil)
+	assert.NotContains(t, rec.Body.String(), "Starting unidling...")
+	assert.Contains(t, rec.Body.String(), `"message":"App found. Unidling it..."`)
+	assert.Contains(t, rec.Body.String(), "event: success")
+
+	// IDs from other Jobs or malformed ones replay everything
+	assert.Equal(t, 0, job.Resume(""))
+	assert.Equal(t, 0, job.Resume("0123456789abcdef-2"))
+	assert.Equal(t, 0, job.Resume(job.id+"-foo"))
+	assert.Equal(t, 0, job.Resume(job.id+"-42"))
+}
+
+func TestStreamJobSendsHeartbeats(t *testing.T) {
+	defer func(interval time.Duration) { HeartbeatInterval = interval }(HeartbeatInterval)
+	HeartbeatInterval = 10 * time.Millisecond
+
+	proceed := make(chan struct{})
+	manager := NewJobManager(func(job *Job) {
+		<-proceed
+		job.Succeed()
+	})
+	job := manager.Unidle("slow-tool.example.com", "/", "test-request-id", trace.SpanContext{})
+
+	time.AfterFunc(50*time.Millisecond, func() { close(proceed) })
+	rec := httptest.NewRecorder()
+	streamJob(rec, job, 0, nil)
+
+	assert.Contains(t, rec.Body.String(), ": keep-alive\n\n")
+	assert.Contains(t, rec.Body.String(), "event: success")
+}
+
+func TestStreamJobEndsAfterStreamTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { StreamTimeout = timeout }(StreamTimeout)
+	StreamTimeout = 10 * time.Millisecond
+
+	proceed := make(chan struct{})
+	defer close(proceed)
+	manager := NewJobManager(func(job *Job) {
+		job.Message(StepFind, "Starting unidling...")
+		<-proceed
+	})
+	job := manager.Unidle("very-slow-tool.example.com", "/", "test-request-id", trace.SpanContext{})
+
+	rec := httptest.NewRecorder()
+	streamJob(rec, job, 0, nil)
+
+	assert.Contains(t, rec.Body.String(), `"message":"Starting unidling..."`)
+	assert.NotContains(t, rec.Body.String(), "event: success")
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	appsAPI "k8s.io/api/apps/v1"
 	coreAPI "k8s.io/api/core/v1"
-	extAPI "k8s.io/api/extensions/v1beta1"
 	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
 	k8s "k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
 	"k8s.io/client-go/rest"
@@ -19,19 +23,54 @@ type (
 	// Deployment wraps appsAPI.Deployment to add methods
 	Deployment appsAPI.Deployment
 
-	// Ingress wraps extAPI.Ingress to add methods
-	Ingress extAPI.Ingress
+	// StatefulSet wraps appsAPI.StatefulSet to add methods
+	StatefulSet appsAPI.StatefulSet
 
 	// Service wraps coreAPI.Service to add methods
 	Service coreAPI.Service
 )
 
+// jsonPatchOperation is an operation of a JSON patch (RFC 6902)
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// ServiceClusterIPs is true when the cluster's Services have the `clusterIPs`
+// field (kubernetes 1.20 and later), which isn't in the vendored client-go.
+// See DiscoverServiceClusterIPs
+var ServiceClusterIPs = false
+
+// DiscoverServiceClusterIPs returns true if the cluster's Services have the
+// `clusterIPs` field, according to the version of the kubernetes API server
+func DiscoverServiceClusterIPs(d discovery.ServerVersionInterface) bool {
+	info, err := d.ServerVersion()
+	if err != nil {
+		logger.Error(err, "Failed to get the kubernetes version. Assuming Services have no 'clusterIPs'.")
+		return false
+	}
+	// NOTE: Some providers add a suffix to the minor version, e.g. "20+"
+	major, _ := strconv.Atoi(strings.TrimRight(info.Major, "+"))
+	minor, _ := strconv.Atoi(strings.TrimRight(info.Minor, "+"))
+	return major > 1 || (major == 1 && minor >= 20)
+}
+
+// annotationPath returns the JSON patch path of an annotation
+func annotationPath(annotation string) string {
+	return "/metadata/annotations/" + strings.Replace(annotation, "/", "~1", -1)
+}
+
 // KubernetesClient constructs a new Kubernetes client
 func KubernetesClient(path string) (k k8s.Interface, err error) {
 	config, err := loadConfig(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load k8s config: %s", err)
 	}
+	// Propagates the traces of the operations to the kubernetes API
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		return &tracingTransport{next: rt}
+	}
 	client, err := k8s.NewForConfig(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new client from config: %s", err)
@@ -53,11 +92,13 @@ func loadConfig(path string) (config *rest.Config, err error) {
 
 // Patch applies a JSON patch to a Deployment
 func (d *Deployment) Patch(patch []byte) error {
+	start := time.Now()
 	_, err := k8sClient.Apps().Deployments(d.Namespace).Patch(
 		d.Name,
 		types.StrategicMergePatchType,
 		patch,
 	)
+	observeKubernetesRequest("patch", "deployments", start, err)
 	if err != nil {
 		return fmt.Errorf("Patch on Deployment failed: %s", err)
 	}
@@ -65,22 +106,57 @@ func (d *Deployment) Patch(patch []byte) error {
 	return nil
 }
 
-// Patch applies a JSON patch to a Service
+// Patch applies a JSON patch (RFC 6902) to a Service, so that its selector
+// and ports are replaced rather than merged
 func (svc *Service) Patch(patch []byte) error {
+	start := time.Now()
 	_, err := k8sClient.CoreV1().Services(svc.Namespace).Patch(
 		svc.Name,
-		types.StrategicMergePatchType,
+		types.JSONPatchType,
 		patch,
 	)
+	observeKubernetesRequest("patch", "services", start, err)
 	if err != nil {
 		return fmt.Errorf("Patch on Service failed: %s", err)
 	}
 	return nil
 }
 
-// Watch gets a channel to watch a Deployment
-func (dep *Deployment) Watch() (watch.Interface, error) {
-	return k8sClient.Apps().Deployments(dep.Namespace).Watch(metaAPI.ListOptions{
+// Get fetches the latest version of a Deployment
+func (dep *Deployment) Get() (*appsAPI.Deployment, error) {
+	start := time.Now()
+	latest, err := k8sClient.Apps().Deployments(dep.Namespace).Get(dep.Name, metaAPI.GetOptions{})
+	observeKubernetesRequest("get", "deployments", start, err)
+	return latest, err
+}
+
+// List fetches the latest version of a Deployment, along with the resource
+// version of the list, to watch it from
+func (dep *Deployment) List() (*appsAPI.Deployment, string, error) {
+	start := time.Now()
+	list, err := k8sClient.Apps().Deployments(dep.Namespace).List(metaAPI.ListOptions{
 		FieldSelector: fmt.Sprintf("metadata.name==%s", dep.Name),
 	})
+	observeKubernetesRequest("list", "deployments", start, err)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range list.Items {
+		if list.Items[i].Name == dep.Name {
+			return &list.Items[i], list.ResourceVersion, nil
+		}
+	}
+	return nil, "", fmt.Errorf("Deployment %s/%s not found", dep.Namespace, dep.Name)
+}
+
+// Watch gets a channel to watch a Deployment, starting from the given
+// resource version
+func (dep *Deployment) Watch(resourceVersion string) (watch.Interface, error) {
+	start := time.Now()
+	w, err := k8sClient.Apps().Deployments(dep.Namespace).Watch(metaAPI.ListOptions{
+		FieldSelector:   fmt.Sprintf("metadata.name==%s", dep.Name),
+		ResourceVersion: resourceVersion,
+	})
+	observeKubernetesRequest("watch", "deployments", start, err)
+	return w, err
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// RequestIDHeader is the header containing the ID used to correlate the logs
+// of a request
+const RequestIDHeader = "X-Request-ID"
+
+// Fields are the structured fields of a log line, e.g. "host", "namespace",
+// "workload", "step", "duration" (in seconds), "request_id"
+type Fields map[string]interface{}
+
+// Logger writes structured logs, as one JSON object per line
+type Logger struct {
+	out    io.Writer
+	mu     *sync.Mutex
+	fields Fields
+}
+
+// NewLogger constructs a new Logger writing to the given io.Writer
+func NewLogger(out io.Writer) *Logger {
+	return &Logger{
+		out:    out,
+		mu:     &sync.Mutex{},
+		fields: Fields{},
+	}
+}
+
+// With returns a new Logger which adds the given fields to all its log lines
+func (l *Logger) With(fields Fields) *Logger {
+	merged := Fields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	return &Logger{
+		out:    l.out,
+		mu:     l.mu,
+		fields: merged,
+	}
+}
+
+// Info logs an informational message
+func (l *Logger) Info(format string, args ...interface{}) {
+	l.write("info", nil, fmt.Sprintf(format, args...))
+}
+
+// Error logs a message about the given error, in the "error" field
+func (l *Logger) Error(err error, format string, args ...interface{}) {
+	l.write("error", err, fmt.Sprintf(format, args...))
+}
+
+// Fatal logs an error message and exits
+func (l *Logger) Fatal(format string, args ...interface{}) {
+	l.write("fatal", nil, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+func (l *Logger) write(level string, err error, msg string) {
+	line := Fields{}
+	for k, v := range l.fields {
+		line[k] = v
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level
+	line["msg"] = msg
+	if err != nil {
+		line["error"] = err.Error()
+	}
+
+	encoded, encodeErr := json.Marshal(line)
+	if encodeErr != nil {
+		encoded, _ = json.Marshal(Fields{"level": level, "msg": msg, "error": encodeErr.Error()})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(encoded, '\n'))
+}
+
+// Request IDs coming from clients are only trusted if they're reasonably
+// short and can't be used to inject content in the SSE messages or logs
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID returns the ID used to correlate the logs of the request, taken
+// from its `X-Request-ID` header or generated if missing/invalid
+func requestID(req *http.Request) string {
+	id := req.Header.Get(RequestIDHeader)
+	if validRequestID.MatchString(id) {
+		return id
+	}
+	return newRequestID()
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerWritesJSONWithFields(t *testing.T) {
+	out := &bytes.Buffer{}
+	log := NewLogger(out).With(Fields{"host": HOST, "request_id": "abc"})
+	log.With(Fields{"step": StepWait, "duration": 1.5}).Error(errors.New("boom"), "Step %s failed.", StepWait)
+
+	line := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &line))
+	assert.Equal(t, HOST, line["host"])
+	assert.Equal(t, "abc", line["request_id"])
+	assert.Equal(t, StepWait, line["step"])
+	assert.Equal(t, 1.5, line["duration"])
+	assert.Equal(t, "error", line["level"])
+	assert.Equal(t, "Step wait failed.", line["msg"])
+	assert.Equal(t, "boom", line["error"])
+	assert.NotEmpty(t, line["time"])
+}
+
+func TestLoggerWithDoesNotModifyParent(t *testing.T) {
+	out := &bytes.Buffer{}
+	parent := NewLogger(out)
+	parent.With(Fields{"namespace": "user-alice"})
+	parent.Info("Hello")
+
+	line := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &line))
+	assert.NotContains(t, line, "namespace")
+}
+
+func TestRequestID(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(RequestIDHeader, "req-123.abc_DEF")
+	assert.Equal(t, "req-123.abc_DEF", requestID(req))
+
+	req.Header.Set(RequestIDHeader, "bad\nid")
+	id := requestID(req)
+	assert.NotEqual(t, "bad\nid", id)
+	assert.Len(t, id, 32)
+
+	req.Header.Del(RequestIDHeader)
+	assert.Len(t, requestID(req), 32)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	coreAPI "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Lookups of the apps' resources used by the AppResolvers. They're served by
+// the cache when enabled (and filled), or else by the kubernetes API
+
+func cacheReady() bool {
+	return appCache != nil && appCache.Synced()
+}
+
+func findIngressByLabel(route Route, label string, value string) (*Ingress, error) {
+	var ings []Ingress
+	if cacheReady() {
+		inc(cacheLookups, "ingresses", "hit")
+		ings = appCache.IngressesByLabel(label, value)
+	} else {
+		start := time.Now()
+		var err error
+		ings, _, err = ingressClient.List("", metaAPI.ListOptions{
+			LabelSelector: fmt.Sprintf("%s=%s", label, value),
+		})
+		observeKubernetesRequest("list", "ingresses", start, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed listing ingresses: %s", err)
+		}
+	}
+	return oneIngress(route, ings, fmt.Sprintf("with label %s=%s", label, value))
+}
+
+func findIngressByHost(route Route) (*Ingress, error) {
+	ings, err := ingressesByHost(route.Host)
+	if err != nil {
+		return nil, err
+	}
+	return oneIngress(route, ings, fmt.Sprintf("with host %s", route.Host))
+}
+
+// ingressesByHost returns the Ingresses with a rule for the host
+func ingressesByHost(host string) ([]Ingress, error) {
+	if cacheReady() {
+		inc(cacheLookups, "ingresses", "hit")
+		return appCache.IngressesByHost(host), nil
+	}
+
+	// NOTE: Without the cache, all the Ingresses are listed
+	start := time.Now()
+	all, _, err := ingressClient.List("", metaAPI.ListOptions{})
+	observeKubernetesRequest("list", "ingresses", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing ingresses: %s", err)
+	}
+	ings := []Ingress{}
+	for _, ing := range all {
+		for _, ingHost := range ing.Hosts() {
+			if ingHost == host {
+				ings = append(ings, ing)
+				break
+			}
+		}
+	}
+	return ings, nil
+}
+
+// oneIngress returns the only Ingress found, or an error if there's none or
+// several. When several are found (e.g. apps sharing the host on different
+// paths) only the ones with the longest path matching the route are kept
+func oneIngress(route Route, ings []Ingress, criteria string) (*Ingress, error) {
+	if len(ings) > 1 {
+		ings = longestMatches(route, ings)
+	}
+	switch len(ings) {
+	case 0:
+		return nil, notFound("no Ingress %s", criteria)
+	case 1:
+		return &ings[0], nil
+	}
+	objects := []metaAPI.Object{}
+	for i := range ings {
+		objects = append(objects, &ings[i])
+	}
+	return nil, ambiguous(route, "Ingresses", objects)
+}
+
+// longestMatches returns the Ingresses with the longest path matching the
+// route, or all of them when none matches
+func longestMatches(route Route, ings []Ingress) []Ingress {
+	longest := -1
+	matches := []Ingress{}
+	for _, ing := range ings {
+		match := ing.Match(route.Host, route.Path)
+		if match == nil {
+			continue
+		}
+		if len(match.Path) > longest {
+			longest = len(match.Path)
+			matches = matches[:0]
+		}
+		if len(match.Path) == longest {
+			matches = append(matches, ing)
+		}
+	}
+	if len(matches) == 0 {
+		return ings
+	}
+	return matches
+}
+
+// cacheResult is the result of a lookup by name in the cache, for the
+// cacheLookups metric. Resources not matching the cache selector are missed
+// and looked up in the kubernetes API
+func cacheResult(hit bool) string {
+	if hit {
+		return "hit"
+	}
+	return "miss"
+}
+
+func findIngressByName(namespace string, name string) (*Ingress, error) {
+	if cacheReady() {
+		ing := appCache.Ingress(namespace, name)
+		inc(cacheLookups, "ingresses", cacheResult(ing != nil))
+		if ing != nil {
+			return ing, nil
+		}
+	}
+
+	start := time.Now()
+	ings, _, err := ingressClient.List(namespace, metaAPI.ListOptions{})
+	observeKubernetesRequest("list", "ingresses", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing ingresses: %s", err)
+	}
+	for i := range ings {
+		if ings[i].Name == name {
+			return &ings[i], nil
+		}
+	}
+	return nil, notFound("no Ingress %s", storeKey(namespace, name))
+}
+
+// findWorkloadByLabel finds the workload with the label in the namespace of
+// the Ingress, looking up each of the workloadKinds in turn. When several of a
+// kind have it (e.g. apps sharing the host on different paths), it's the one
+// named after the Service the route is routed to
+func findWorkloadByLabel(route Route, ing *Ingress, label string, value string) (Workload, error) {
+	for _, kind := range workloadKinds {
+		items, err := kind.FindByLabel(ing.Namespace, label, value)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(items) > 1 {
+			name := route.backendName(ing)
+			for _, item := range items {
+				if item.GetName() == name {
+					items = []Workload{item}
+					break
+				}
+			}
+		}
+
+		switch len(items) {
+		case 0:
+			continue
+		case 1:
+			return items[0], nil
+		}
+		objects := []metaAPI.Object{}
+		for _, item := range items {
+			objects = append(objects, item)
+		}
+		return nil, ambiguous(route, workloadKind(items[0])+"s", objects)
+	}
+	return nil, notFound("no workload (%s) with label %s=%s", workloadKindNames(), label, value)
+}
+
+// findWorkloadGroup finds the workloads with the label in the namespace of
+// the Ingress, of all the workloadKinds: the app's group, starting with its
+// workload. The workloads named after the Service another path of the host is
+// routed to are other apps sharing the host, not part of the group
+func findWorkloadGroup(route Route, ing *Ingress, workload Workload, label string, value string) ([]Workload, error) {
+	others, err := otherBackends(route, ing)
+	if err != nil {
+		return nil, err
+	}
+
+	group := []Workload{workload}
+	for _, kind := range workloadKinds {
+		items, err := kind.FindByLabel(ing.Namespace, label, value)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			if others[item.GetName()] || (workloadKind(item) == workloadKind(workload) && item.GetName() == workload.GetName()) {
+				continue
+			}
+			group = append(group, item)
+		}
+	}
+	return group, nil
+}
+
+// findGroupByWorkloadLabel finds the group of a workload found by name: the
+// workloads with the same `UnidleKeyLabel` label, see findWorkloadGroup. It's
+// only the workload when it doesn't have the label
+func findGroupByWorkloadLabel(route Route, ing *Ingress, workload Workload) ([]Workload, error) {
+	value, ok := workload.GetLabels()[UnidleKeyLabel]
+	if !ok {
+		return []Workload{workload}, nil
+	}
+	return findWorkloadGroup(route, ing, workload, UnidleKeyLabel, value)
+}
+
+// otherBackends returns the names of the Services the other paths of the
+// route's host are routed to, in the namespace of the Ingress
+func otherBackends(route Route, ing *Ingress) (map[string]bool, error) {
+	ings, err := ingressesByHost(route.Host)
+	if err != nil {
+		return nil, err
+	}
+	own := route.backendName(ing)
+	names := map[string]bool{}
+	for _, other := range ings {
+		if other.Namespace != ing.Namespace {
+			continue
+		}
+		for _, rule := range other.Rules {
+			if rule.Host != route.Host {
+				continue
+			}
+			for _, path := range rule.Paths {
+				if path.Backend.ServiceName != own {
+					names[path.Backend.ServiceName] = true
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+// findWorkloadByName finds the workload with the name, in the first of the
+// workloadKinds which has one
+func findWorkloadByName(namespace string, name string) (Workload, error) {
+	for _, kind := range workloadKinds {
+		found, err := kind.FindByName(namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		if found != nil {
+			return found, nil
+		}
+	}
+	return nil, notFound("no workload (%s) %s", workloadKindNames(), storeKey(namespace, name))
+}
+
+func workloadKindNames() string {
+	names := []string{}
+	for _, kind := range workloadKinds {
+		names = append(names, kind.Name())
+	}
+	return strings.Join(names, ", ")
+}
+
+// findServiceByLabel finds the Service with the label in the namespace of the
+// Ingress. When several have it (e.g. apps sharing the host on different
+// paths), it's the one named after the Service the route is routed to
+func findServiceByLabel(route Route, ing *Ingress, label string, value string) (*Service, error) {
+	namespace := ing.Namespace
+	var items []coreAPI.Service
+	if cacheReady() {
+		inc(cacheLookups, "services", "hit")
+		items = appCache.ServicesByLabel(namespace, label, value)
+	} else {
+		start := time.Now()
+		svcs, err := k8sClient.CoreV1().Services(namespace).List(metaAPI.ListOptions{
+			LabelSelector: fmt.Sprintf("%s=%s", label, value),
+		})
+		observeKubernetesRequest("list", "services", start, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed listing services: %s", err)
+		}
+		items = svcs.Items
+	}
+
+	if len(items) > 1 {
+		name := route.backendName(ing)
+		for _, item := range items {
+			if item.Name == name {
+				items = []coreAPI.Service{item}
+				break
+			}
+		}
+	}
+
+	switch len(items) {
+	case 0:
+		return nil, notFound("no Service with label %s=%s", label, value)
+	case 1:
+		svc := Service(items[0])
+		return &svc, nil
+	}
+	objects := []metaAPI.Object{}
+	for i := range items {
+		objects = append(objects, &items[i])
+	}
+	return nil, ambiguous(route, "Services", objects)
+}
+
+func findServiceByName(namespace string, name string) (*Service, error) {
+	var found *coreAPI.Service
+	if cacheReady() {
+		found = appCache.Service(namespace, name)
+		inc(cacheLookups, "services", cacheResult(found != nil))
+	}
+	if found == nil {
+		start := time.Now()
+		var err error
+		found, err = k8sClient.CoreV1().Services(namespace).Get(name, metaAPI.GetOptions{})
+		observeKubernetesRequest("get", "services", start, err)
+		if errors.IsNotFound(err) {
+			found = nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed getting service: %s", err)
+		}
+	}
+
+	if found == nil {
+		return nil, notFound("no Service %s", storeKey(namespace, name))
+	}
+	svc := Service(*found)
+	return &svc, nil
+}
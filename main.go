@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"html/template"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"syscall"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	k8s "k8s.io/client-go/kubernetes"
 )
 
@@ -16,17 +21,39 @@ const DEFAULT_PORT = ":8080"
 // TODO: Remove once `alpha` cease to exist
 const DEFAULT_UNIDLE_KEY_LABEL = "host"
 
+const (
+	DEFAULT_HEARTBEAT_INTERVAL = 15 * time.Second
+	DEFAULT_STREAM_TIMEOUT     = 30 * time.Minute
+	DEFAULT_WAIT_TIMEOUT       = 10 * time.Minute
+	// Time after an app is unidled during which idlers leave it alone
+	DEFAULT_UNIDLE_GRACE_PERIOD = 30 * time.Minute
+	// Interval at which pods are inspected while waiting for an app
+	DIAGNOSIS_INTERVAL = 10 * time.Second
+	// Timeout of the requests other than the (long-lived) events stream
+	REQUEST_TIMEOUT = 2 * time.Minute
+	// Time given to the requests in flight, then to the export of the
+	// remaining spans, when the unidler is stopped
+	SHUTDOWN_TIMEOUT = 10 * time.Second
+)
+
 var (
-	logger         *log.Logger
-	k8sClient      k8s.Interface
-	indexTemplates *template.Template
-	err            error
-	UnidleKeyLabel string
+	logger            = NewLogger(os.Stdout)
+	k8sClient         k8s.Interface
+	indexTemplates    *template.Template
+	idleTemplates     *template.Template
+	pinTemplates      *template.Template
+	err               error
+	UnidleKeyLabel    string
+	HeartbeatInterval = DEFAULT_HEARTBEAT_INTERVAL
+	StreamTimeout     = DEFAULT_STREAM_TIMEOUT
+	WaitTimeout       = DEFAULT_WAIT_TIMEOUT
+	UnidleGracePeriod = DEFAULT_UNIDLE_GRACE_PERIOD
+	DiagnosisInterval = DIAGNOSIS_INTERVAL
+
+	jobs = NewJobManager(unidle)
 )
 
 func init() {
-	logger = log.New(os.Stdout, "", log.LstdFlags|log.Lshortfile)
-
 	// parse HTML template
 	indexTemplates, err = template.New("").ParseFiles(
 		"templates/content.html",
@@ -35,19 +62,33 @@ func init() {
 		"templates/layout.html",
 	)
 	if err != nil {
-		logger.Fatalf("Error parsing template: %s", err)
+		logger.Fatal("Error parsing template: %s", err)
+	}
+	idleTemplates, err = template.New("").ParseFiles(
+		"templates/idle.html",
+		"templates/layout.html",
+	)
+	if err != nil {
+		logger.Fatal("Error parsing template: %s", err)
+	}
+	pinTemplates, err = template.New("").ParseFiles(
+		"templates/pin.html",
+		"templates/layout.html",
+	)
+	if err != nil {
+		logger.Fatal("Error parsing template: %s", err)
 	}
 }
 
 func main() {
 	port, ok := os.LookupEnv("PORT")
 	if !ok {
-		logger.Printf("$PORT not set. Defaulting to '%s'", DEFAULT_PORT)
+		logger.Info("$PORT not set. Defaulting to '%s'", DEFAULT_PORT)
 		port = DEFAULT_PORT
 	}
 	home, ok := os.LookupEnv("HOME")
 	if !ok {
-		logger.Fatalf("$HOME not set. It couldn't determine HOME directory.")
+		logger.Fatal("$HOME not set. It couldn't determine HOME directory.")
 	}
 
 	// NOTE: Default to `host` for retro-compatibility with `alpha` cluster
@@ -55,25 +96,220 @@ func main() {
 	//       `prod`/new domain is completed
 	UnidleKeyLabel, ok = os.LookupEnv("UNIDLE_KEY_LABEL")
 	if !ok {
-		logger.Printf("$UNIDLE_KEY_LABEL not set. Defaulting to '%s'", DEFAULT_UNIDLE_KEY_LABEL)
+		logger.Info("$UNIDLE_KEY_LABEL not set. Defaulting to '%s'", DEFAULT_UNIDLE_KEY_LABEL)
 		UnidleKeyLabel = DEFAULT_UNIDLE_KEY_LABEL
 	}
 
+	HeartbeatInterval = durationFromEnv("HEARTBEAT_INTERVAL", DEFAULT_HEARTBEAT_INTERVAL)
+	StreamTimeout = durationFromEnv("STREAM_TIMEOUT", DEFAULT_STREAM_TIMEOUT)
+	WaitTimeout = durationFromEnv("WAIT_TIMEOUT", DEFAULT_WAIT_TIMEOUT)
+	UnidleGracePeriod = durationFromEnv("UNIDLE_GRACE_PERIOD", DEFAULT_UNIDLE_GRACE_PERIOD)
+	BackOffTimeout = durationFromEnv("BACKOFF_TIMEOUT", DEFAULT_BACKOFF_TIMEOUT)
+	RedirectScheme = redirectSchemeFromEnv()
+
+	tracerProvider, err := TracerProviderFromEnv(context.Background())
+	if err != nil {
+		logger.Fatal("Failed to configure tracing: %s", err)
+	}
+	if tracerProvider != nil {
+		otel.SetTracerProvider(tracerProvider)
+	}
+
 	k8sClient, err = KubernetesClient(filepath.Join(home, ".kube", "config"))
 	if err != nil {
-		log.Fatalf("Failed to create k8s client: %s", err)
+		logger.Fatal("Failed to create k8s client: %s", err)
+	}
+
+	ingressClient = DiscoverIngressClient(k8sClient.Discovery(), k8sClient.Discovery().RESTClient())
+	logger.Info("Using Ingress API version '%s'", ingressClient.APIVersion())
+	ServiceClusterIPs = DiscoverServiceClusterIPs(k8sClient.Discovery())
+
+	appResolvers, err = ResolversFromEnv()
+	if err != nil {
+		logger.Fatal("Failed to configure app resolvers: %s", err)
+	}
+	workloadKinds, err = WorkloadKindsFromEnv(k8sClient.Discovery().RESTClient())
+	if err != nil {
+		logger.Fatal("Failed to configure workload kinds: %s", err)
+	}
+
+	DefaultTrafficSwitch, ok = os.LookupEnv("TRAFFIC_SWITCH")
+	if !ok {
+		logger.Info("$TRAFFIC_SWITCH not set. Defaulting to '%s'", DEFAULT_TRAFFIC_SWITCH)
+		DefaultTrafficSwitch = DEFAULT_TRAFFIC_SWITCH
+	}
+	if _, ok := trafficSwitches[DefaultTrafficSwitch]; !ok {
+		logger.Fatal("Unknown traffic switch '%s' in $TRAFFIC_SWITCH", DefaultTrafficSwitch)
+	}
+	IngressUnidlerService, ok = os.LookupEnv("INGRESS_UNIDLER_SERVICE")
+	if !ok {
+		logger.Info("$INGRESS_UNIDLER_SERVICE not set. Defaulting to '%s'", DEFAULT_INGRESS_UNIDLER_SERVICE)
+		IngressUnidlerService = DEFAULT_INGRESS_UNIDLER_SERVICE
+	}
+	gatewayAPIVersion, ok := os.LookupEnv("GATEWAY_API_VERSION")
+	if !ok {
+		logger.Info("$GATEWAY_API_VERSION not set. Defaulting to '%s'", DEFAULT_GATEWAY_API_VERSION)
+		gatewayAPIVersion = DEFAULT_GATEWAY_API_VERSION
+	}
+	unidlerNamespace, ok := os.LookupEnv("POD_NAMESPACE")
+	if !ok {
+		logger.Info("$POD_NAMESPACE not set. Defaulting to '%s'", UnidlerNs)
+		unidlerNamespace = UnidlerNs
+	}
+	trafficSwitches[TrafficSwitchHTTPRoute] = NewHTTPRouteSwitch(k8sClient.Discovery().RESTClient(), gatewayAPIVersion, unidlerNamespace)
+
+	if boolFromEnv("CACHE_ENABLED", DEFAULT_CACHE_ENABLED) {
+		selector, err := CacheSelectorFromEnv(appResolvers)
+		if err != nil {
+			logger.Fatal("Failed to configure the cache: %s", err)
+		}
+		appCache = NewAppCache(durationFromEnv("NEGATIVE_CACHE_TTL", DEFAULT_NEGATIVE_CACHE_TTL), selector)
+		appCache.Start(make(chan struct{}))
+	}
+
+	AuthUserHeader, ok = os.LookupEnv("AUTH_USER_HEADER")
+	if !ok {
+		logger.Info("$AUTH_USER_HEADER not set. Defaulting to '%s'", DEFAULT_AUTH_USER_HEADER)
+		AuthUserHeader = DEFAULT_AUTH_USER_HEADER
+	}
+	AuthProxySecretHeader, ok = os.LookupEnv("AUTH_PROXY_SECRET_HEADER")
+	if !ok {
+		logger.Info("$AUTH_PROXY_SECRET_HEADER not set. Defaulting to '%s'", DEFAULT_AUTH_PROXY_SECRET_HEADER)
+		AuthProxySecretHeader = DEFAULT_AUTH_PROXY_SECRET_HEADER
+	}
+	AuthProxySecret = os.Getenv("AUTH_PROXY_SECRET")
+	if AuthProxySecret == "" {
+		logger.Info("$AUTH_PROXY_SECRET not set. No user can be authenticated: idling, pinning and keeping apps up are refused")
+	}
+	userNamespace, err = UserNamespaceFromEnv()
+	if err != nil {
+		logger.Fatal("Failed to configure the users' namespace: %s", err)
+	}
+
+	WakeDurations, err = WakeDurationsFromEnv()
+	if err != nil {
+		logger.Fatal("Failed to configure the wake durations: %s", err)
+	}
+	NewWakeExpirer(durationFromEnv("WAKE_EXPIRY_INTERVAL", DEFAULT_WAKE_EXPIRY_INTERVAL)).Start(make(chan struct{}))
+	PinDurations, err = PinDurationsFromEnv()
+	if err != nil {
+		logger.Fatal("Failed to configure the pin durations: %s", err)
+	}
+	NewPinExpirer(durationFromEnv("PIN_EXPIRY_INTERVAL", DEFAULT_PIN_EXPIRY_INTERVAL)).Start(make(chan struct{}))
+
+	if boolFromEnv("IDLER_ENABLED", DEFAULT_IDLER_ENABLED) {
+		idler, err := IdlerFromEnv()
+		if err != nil {
+			logger.Fatal("Failed to configure the idler: %s", err)
+		}
+		idler.Start(make(chan struct{}))
 	}
 
-	http.HandleFunc("/", indexHandler)
-	http.HandleFunc("/events/", eventsHandler)
-	http.HandleFunc("/healthz", healthzHandler)
+	unidlerHost, ok := os.LookupEnv("UNIDLER_HOST")
+	if !ok {
+		logger.Info("$UNIDLER_HOST not set. /idle/ and /pin/ are disabled")
+	}
 
-	logger.Printf("Starting server on port %s...", port)
+	logger.Info("Starting server on port %s...", port)
 	server := &http.Server{
-		Addr:         port,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 2 * time.Minute,
-		IdleTimeout:  2 * time.Minute,
+		Addr:        port,
+		Handler:     newServeMux(unidlerHost),
+		ReadTimeout: 5 * time.Second,
+		IdleTimeout: 2 * time.Minute,
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		shutdown(server, tracerProvider)
+	}()
+
+	err = server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		logger.Fatal("Server stopped: %s", err)
+	}
+	<-stopped
+}
+
+// shutdown stops the server, giving the requests in flight time to complete,
+// then exports the spans not exported yet
+func shutdown(server *http.Server, tracerProvider *sdktrace.TracerProvider) {
+	logger.Info("Shutting down server...")
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	// NOTE: The open events streams are cut off once the timeout is over
+	err := server.Shutdown(ctx)
+	if err != nil {
+		logger.Error(err, "Failed to shut down server gracefully.")
+	}
+
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	err = tracerProvider.Shutdown(ctx)
+	if err != nil {
+		logger.Error(err, "Failed to export the remaining spans.")
+	}
+}
+
+// newServeMux routes the requests to the handlers. The unidler's own pages
+// (`/idle/` and `/pin/`) are only served on its host, behind the
+// authenticating proxy, and not at all when it's empty: on the other hosts
+// (the idled apps'), any path is the app's
+func newServeMux(unidlerHost string) *http.ServeMux {
+	mux := http.NewServeMux()
+	// NOTE: The events stream is long-lived (apps could take several minutes
+	//       to start) so the server has no write timeout. The other handlers
+	//       are wrapped in a timeout handler instead.
+	mux.Handle("/", appHandler(withTimeout(indexHandler)))
+	mux.HandleFunc("/events/", eventsHandler)
+	if unidlerHost != "" {
+		mux.Handle(unidlerHost+"/idle/", withTimeout(idleHandler))
+		mux.Handle(unidlerHost+"/pin/", withTimeout(pinHandler))
+	}
+	mux.Handle("/healthz", withTimeout(healthzHandler))
+	mux.Handle("/metrics", withTimeout(metricsHandler))
+	return mux
+}
+
+func withTimeout(handler http.HandlerFunc) http.Handler {
+	return http.TimeoutHandler(handler, REQUEST_TIMEOUT, "Request timed out")
+}
+
+// durationFromEnv reads a duration (e.g. "90s", "5m") from the given
+// environment variable, defaulting to the given value when not set or invalid
+func durationFromEnv(name string, defaultValue time.Duration) time.Duration {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		logger.Info("$%s not set. Defaulting to '%s'", name, defaultValue)
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		logger.Info("$%s has invalid duration '%s'. Defaulting to '%s'", name, value, defaultValue)
+		return defaultValue
+	}
+	return duration
+}
+
+// boolFromEnv reads a boolean (e.g. "true", "false") from the given
+// environment variable, defaulting to the given value when not set or invalid
+func boolFromEnv(name string, defaultValue bool) bool {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		logger.Info("$%s not set. Defaulting to '%t'", name, defaultValue)
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		logger.Info("$%s has invalid boolean '%s'. Defaulting to '%t'", name, value, defaultValue)
+		return defaultValue
 	}
-	log.Fatal(server.ListenAndServe())
+	return b
 }
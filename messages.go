@@ -1,6 +1,10 @@
 package main
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
 
 // Message represents a Server Sent Event message
 type Message struct {
@@ -20,20 +24,35 @@ data: %s
 `, m.id, m.retry, m.event, m.data)
 }
 
-func sendEvent(s StreamingResponseWriter, m *Message) {
-	fmt.Fprintf(s, m.String())
-	s.Flush()
+// newMessage constructs a new Message with the given progress update, for the
+// given step of the unidling, as data
+func newMessage(event string, step string, update *Update) *Message {
+	update.Step = step
+	update.StepIndex = stepIndex(step)
+	update.StepTotal = len(Steps)
+
+	data, err := json.Marshal(update)
+	if err != nil {
+		// Can't really happen, but the human-readable message is better than nothing
+		data = []byte(update.Message)
+	}
+
+	return &Message{
+		event: event,
+		data:  string(data),
+	}
 }
 
-func sendMessage(s StreamingResponseWriter, msg string) {
-	sendEvent(s, &Message{
-		data: msg,
-	})
+// sendEvent sends the SSE message to the client. Its data is written as is:
+// it can contain any text, e.g. kubernetes error messages
+func sendEvent(s StreamingResponseWriter, m *Message) {
+	io.WriteString(s, m.String())
+	s.Flush()
 }
 
-func sendError(s StreamingResponseWriter, err error) {
-	sendEvent(s, &Message{
-		event: "error",
-		data:  err.Error(),
-	})
+// sendComment sends a SSE comment, ignored by clients but useful to keep the
+// connection alive
+func sendComment(s StreamingResponseWriter, comment string) {
+	fmt.Fprintf(s, ": %s\n\n", comment)
+	s.Flush()
 }
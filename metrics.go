@@ -0,0 +1,99 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics of the unidler, exposed on `/metrics` by promhttp along
+// with the Go runtime and process metrics
+
+var (
+	// DurationBuckets are the histogram buckets (in seconds) used for the
+	// unidling durations
+	DurationBuckets = []float64{1, 5, 10, 20, 30, 60, 120, 180, 300, 600, 1200}
+	// LatencyBuckets are the histogram buckets (in seconds) used for the
+	// kubernetes API requests latency
+	LatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	unidleAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "unidler_unidle_attempts_total",
+		Help: "Number of apps unidling attempted.",
+	}, []string{"namespace"})
+	unidleSuccesses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "unidler_unidle_successes_total",
+		Help: "Number of apps successfully unidled.",
+	}, []string{"namespace"})
+	unidleFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "unidler_unidle_failures_total",
+		Help: "Number of apps which failed to unidle, by step at which it failed.",
+	}, []string{"namespace", "step"})
+	unidleDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "unidler_unidle_duration_seconds",
+		Help:    "End-to-end duration of the unidling of apps.",
+		Buckets: DurationBuckets,
+	}, []string{"namespace", "result"})
+	unidleStepDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "unidler_unidle_step_duration_seconds",
+		Help:    "Duration of each step of the unidling of apps.",
+		Buckets: DurationBuckets,
+	}, []string{"namespace", "step"})
+	idled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "unidler_idled_total",
+		Help: "Number of apps idled, by what triggered the idling.",
+	}, []string{"namespace", "trigger"})
+	idleFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "unidler_idle_failures_total",
+		Help: "Number of apps which failed to idle, by what triggered the idling.",
+	}, []string{"namespace", "trigger"})
+	unidlesInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "unidler_unidles_in_flight",
+		Help: "Number of apps currently being unidled.",
+	})
+	openStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "unidler_sse_streams_open",
+		Help: "Number of open Server Sent Events streams.",
+	})
+	kubernetesRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "unidler_kubernetes_request_duration_seconds",
+		Help:    "Latency of the requests to the kubernetes API.",
+		Buckets: LatencyBuckets,
+	}, []string{"operation", "resource"})
+	kubernetesRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "unidler_kubernetes_request_errors_total",
+		Help: "Number of failed requests to the kubernetes API.",
+	}, []string{"operation", "resource"})
+)
+
+// inc increments the counter for the given label values. A wrong number of
+// label values is logged, instead of panicking like WithLabelValues
+func inc(counter *prometheus.CounterVec, labelValues ...string) {
+	c, err := counter.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		logger.Error(err, "Failed to increment metric.")
+		return
+	}
+	c.Inc()
+}
+
+// observe records a value in the histogram for the given label values. A wrong
+// number of label values is logged, instead of panicking like WithLabelValues
+func observe(histogram *prometheus.HistogramVec, value float64, labelValues ...string) {
+	h, err := histogram.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		logger.Error(err, "Failed to observe metric.")
+		return
+	}
+	h.Observe(value)
+}
+
+// observeKubernetesRequest records the latency and outcome of a request to the
+// kubernetes API started at the given time
+func observeKubernetesRequest(operation string, resource string, start time.Time, err error) {
+	observe(kubernetesRequestDuration, time.Since(start).Seconds(), operation, resource)
+	if err != nil {
+		inc(kubernetesRequestErrors, operation, resource)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// histogramCount returns the number of values observed by the histogram for
+// the given label values
+func histogramCount(t *testing.T, histogram *prometheus.HistogramVec, labelValues ...string) uint64 {
+	metric := &dto.Metric{}
+	err := histogram.WithLabelValues(labelValues...).(prometheus.Histogram).Write(metric)
+	assert.Nil(t, err)
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestObserveKubernetesRequest(t *testing.T) {
+	before := testutil.ToFloat64(kubernetesRequestErrors.WithLabelValues("patch", "services"))
+
+	observeKubernetesRequest("patch", "services", time.Now(), nil)
+	observeKubernetesRequest("patch", "services", time.Now(), errors.New("boom"))
+
+	assert.Equal(t, before+1, testutil.ToFloat64(kubernetesRequestErrors.WithLabelValues("patch", "services")))
+	assert.True(t, histogramCount(t, kubernetesRequestDuration, "patch", "services") >= 2)
+}
+
+func TestMetricsWithWrongLabelValues(t *testing.T) {
+	before := testutil.ToFloat64(idled.WithLabelValues("metrics-ns", IdleTriggerUser))
+
+	// Logged rather than panicking
+	inc(idled, "metrics-ns")
+	observe(unidleDuration, 1, "metrics-ns", "success", "extra")
+
+	assert.Equal(t, before, testutil.ToFloat64(idled.WithLabelValues("metrics-ns", IdleTriggerUser)))
+}
+
+func TestMetricsHandler(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+
+	rec := httptest.NewRecorder()
+	handler := http.HandlerFunc(metricsHandler)
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "# TYPE unidler_unidles_in_flight gauge")
+	assert.Contains(t, rec.Body.String(), "unidler_sse_streams_open 0")
+	// Go runtime metrics
+	assert.Contains(t, rec.Body.String(), "# TYPE go_goroutines gauge")
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	coreAPI "k8s.io/api/core/v1"
+)
+
+const (
+	// PinnedLabel is a metadata label which indicates the workload is pinned:
+	// idlers must not idle it until PinnedUntilAnnotation
+	PinnedLabel = "mojanalytics.xyz/pinned"
+	// PinnedUntilAnnotation is a metadata annotation which indicates the time
+	// (UTC) the workload is pinned until, eg: "2018-11-29T17:55:02"
+	PinnedUntilAnnotation = "mojanalytics.xyz/pinned-until"
+	// PinnedByAnnotation contains the name of the user who pinned the workload
+	PinnedByAnnotation = "mojanalytics.xyz/pinned-by"
+)
+
+const (
+	// DEFAULT_PIN_DURATIONS are the times the user can pin their app for
+	DEFAULT_PIN_DURATIONS = "24h,72h,168h"
+	// Interval between the checks of the pins which expired
+	DEFAULT_PIN_EXPIRY_INTERVAL = 10 * time.Minute
+)
+
+// PinDurations are the times the user can pin their app for, on the `/pin/`
+// page, see `PIN_DURATIONS`
+var PinDurations = []time.Duration{24 * time.Hour, 72 * time.Hour, 168 * time.Hour}
+
+// PinDurationsFromEnv parses the comma-separated durations in
+// `PIN_DURATIONS`
+func PinDurationsFromEnv() ([]time.Duration, error) {
+	durations, err := durationsFromEnv("PIN_DURATIONS", DEFAULT_PIN_DURATIONS)
+	if err == nil && len(durations) == 0 {
+		err = fmt.Errorf("no duration in $PIN_DURATIONS")
+	}
+	return durations, err
+}
+
+// pinnedUntil returns the time the workload is pinned until, according to its
+// PinnedUntilAnnotation. It's zero when the workload isn't pinned
+func pinnedUntil(workload Workload) (time.Time, error) {
+	value, ok := workload.GetAnnotations()[PinnedUntilAnnotation]
+	if !ok {
+		return time.Time{}, nil
+	}
+	until, err := time.Parse(IdledAtFormat, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s annotation '%s': %s", PinnedUntilAnnotation, value, err)
+	}
+	return until, nil
+}
+
+// pinned returns true if the workload is pinned at the given time: idlers
+// must leave it alone. An invalid pin doesn't count
+func pinned(workload Workload, now time.Time) bool {
+	until, err := pinnedUntil(workload)
+	if err != nil {
+		return false
+	}
+	return now.Before(until)
+}
+
+// Pin pins the App's workload until the given time on behalf of the user, so
+// that idlers leave it alone. A zero time unpins it
+func (a *App) Pin(until time.Time, user string) (err error) {
+	span := a.startSpan("Pin")
+	defer func() { finishSpan(span, err) }()
+
+	if until.IsZero() {
+		err = unpin(a.workload)
+		if err != nil {
+			a.logError(err, "Patch to unpin %s failed.", a.describe(a.workload))
+			return fmt.Errorf("Failed to unpin your app.")
+		}
+		a.log("Successfully unpinned app.")
+		a.RecordWorkloadEvent(coreAPI.EventTypeNormal, EventUnpinned, "Unpinned by %q.", user)
+		return nil
+	}
+
+	// NOTE: The user's name comes from a request header, it's escaped by
+	//       encoding the patch
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				PinnedUntilAnnotation: until.UTC().Format(IdledAtFormat),
+				PinnedByAnnotation:    user,
+			},
+			"labels": map[string]string{
+				PinnedLabel: "true",
+			},
+		},
+	})
+	if err != nil {
+		a.logError(err, "Failed to encode patch to pin %s.", a.describe(a.workload))
+		return fmt.Errorf("Failed to pin your app.")
+	}
+	err = a.workload.PatchMetadata(patch)
+	if err != nil {
+		a.logError(err, "Patch to pin %s failed.", a.describe(a.workload))
+		return fmt.Errorf("Failed to pin your app.")
+	}
+	a.log("Successfully pinned app until %s.", until.UTC().Format(IdledAtFormat))
+	a.RecordWorkloadEvent(coreAPI.EventTypeNormal, EventPinned, "Pinned by %q until %s (UTC).", user, until.UTC().Format(IdledAtFormat))
+	return nil
+}
+
+// unpin removes the pin label and annotations from the workload
+func unpin(workload Workload) error {
+	patch := fmt.Sprintf(`{
+			"metadata": {
+				"annotations": {
+					"%s": null,
+					"%s": null
+				},
+				"labels": {
+					"%s": null
+				}
+			}
+		}`,
+		PinnedUntilAnnotation,
+		PinnedByAnnotation,
+		PinnedLabel,
+	)
+	return workload.PatchMetadata([]byte(patch))
+}
+
+// PinExpirer removes the pins once they expire. It runs in the background of
+// the unidler
+type PinExpirer struct {
+	interval time.Duration
+}
+
+// NewPinExpirer constructs a new PinExpirer
+func NewPinExpirer(interval time.Duration) *PinExpirer {
+	return &PinExpirer{interval: interval}
+}
+
+// Start runs the PinExpirer every interval, in the background, until the
+// channel is closed
+func (e *PinExpirer) Start(stop <-chan struct{}) {
+	logger.Info("Starting pin expirer: workloads with %s checked every %s.", PinnedLabel, e.interval)
+	go runEvery(e.interval, stop, func() { e.Run() })
+}
+
+// Run removes the pins which expired (or are invalid), from the workloads of
+// all the `workloadKinds`. It returns the number of pins removed
+func (e *PinExpirer) Run() int {
+	count := 0
+	now := time.Now().UTC()
+	for _, kind := range workloadKinds {
+		workloads, err := kind.List("", PinnedLabel+"=true")
+		if err != nil {
+			logger.Error(err, "Pin expirer failed to list %s.", kind.Name())
+			continue
+		}
+
+		for _, workload := range workloads {
+			if e.expire(workload, now) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// expire removes the pin of the workload if it expired (or is invalid). It
+// returns true if it was removed
+func (e *PinExpirer) expire(workload Workload, now time.Time) bool {
+	log := logger.With(Fields{"namespace": workload.GetNamespace(), "workload": workload.GetName(), "kind": workloadKind(workload)})
+	app := &App{logger: log, workload: workload}
+
+	until, err := pinnedUntil(workload)
+	if err != nil {
+		app.logError(err, "Pin is invalid. Removing it.")
+	} else if now.Before(until) {
+		return false
+	}
+
+	err = unpin(workload)
+	if err != nil {
+		app.logError(err, "Patch to remove expired pin failed.")
+		return false
+	}
+	annotations := workload.GetAnnotations()
+	app.log("Successfully removed pin by %q, expired at %s.", annotations[PinnedByAnnotation], annotations[PinnedUntilAnnotation])
+	app.RecordWorkloadEvent(coreAPI.EventTypeNormal, EventPinExpired, "Pin by %q expired at %s (UTC).", annotations[PinnedByAnnotation], annotations[PinnedUntilAnnotation])
+	return true
+}
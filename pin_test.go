@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	appsAPI "k8s.io/api/apps/v1"
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sFake "k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+// annotateDeployment adds the annotations to the Deployment
+func annotateDeployment(client *k8sFake.Clientset, ns string, name string, annotations map[string]string) {
+	dep := getDeployment(ns, name)
+	if dep.Annotations == nil {
+		dep.Annotations = map[string]string{}
+	}
+	for key, value := range annotations {
+		dep.Annotations[key] = value
+	}
+	client.AppsV1().Deployments(ns).Update((*appsAPI.Deployment)(&dep))
+}
+
+func TestPinHandler(t *testing.T) {
+	const host = "alice-demo.example.com"
+	const ns = "user-alice"
+	labels := map[string]string{UnidleKeyLabel: unidleKey(host)}
+	client, restore := withResolvers(&labelResolver{})
+	defer restore()
+	mockApp(client, ns, "demo", host, "/", labels)
+
+	pin := func(method string, user string, value string) *httptest.ResponseRecorder {
+		form := url.Values{"host": {host}, "path": {"/"}, "pin_for": {value}}
+		req, _ := http.NewRequest(method, "/pin/", strings.NewReader(form.Encode()))
+		if method == "GET" {
+			req, _ = http.NewRequest(method, "/pin/?"+form.Encode(), nil)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		authenticate(req, user)
+		rec := httptest.NewRecorder()
+		http.HandlerFunc(pinHandler).ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, pin("POST", "", "72h0m0s").Code)
+	rec := pin("POST", "bob", "72h0m0s")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "You can only pin your own apps.")
+	assert.Equal(t, http.StatusBadRequest, pin("POST", "alice", "1h").Code)
+	rec = pin("GET", "alice", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Keep my app awake")
+	assert.NotContains(t, rec.Body.String(), "is pinned by")
+
+	rec = pin("POST", "alice", "72h0m0s")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Your app is pinned for 3 days")
+	dep := getDeployment(ns, "demo")
+	assert.Equal(t, "true", dep.Labels[PinnedLabel])
+	assert.Equal(t, "alice", dep.Annotations[PinnedByAnnotation])
+	until, err := pinnedUntil(&dep)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(72*time.Hour), until, time.Minute)
+	assert.True(t, pinned(&dep, time.Now()))
+	assert.Contains(t, pin("GET", "alice", "").Body.String(), "is pinned by alice until "+until.Format(IdledAtFormat))
+
+	// NOTE: The fake patch doesn't remove, the patches are checked instead
+	patches := countActions(client, "patch")
+	rec = pin("POST", "alice", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "no longer pinned")
+	assert.Equal(t, patches+1, countActions(client, "patch"))
+}
+
+func TestPinEscapesUser(t *testing.T) {
+	const ns = "pin-escape-ns"
+	client, restore := withResolvers()
+	defer restore()
+	idleableDeployment(client, ns, "web", 1, map[string]string{})
+	dep := getDeployment(ns, "web")
+	a := &App{logger: logger, workload: &dep}
+
+	// Would inject an annotation if not escaped
+	const user = `mallory", "mojanalytics.xyz/pinned-until": "2999-01-01T00:00:00\\`
+	until := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	assert.Nil(t, a.Pin(until, user))
+
+	dep = getDeployment(ns, "web")
+	assert.Equal(t, user, dep.Annotations[PinnedByAnnotation])
+	assert.Equal(t, until.Format(IdledAtFormat), dep.Annotations[PinnedUntilAnnotation])
+	events, _ := client.CoreV1().Events(ns).List(metaAPI.ListOptions{})
+	if assert.Len(t, events.Items, 1) {
+		assert.Contains(t, events.Items[0].Message, `Pinned by "mallory\", \"mojanalytics.xyz/pinned-until\"`)
+	}
+}
+
+func TestPinnedAppsAreNotIdled(t *testing.T) {
+	const ns = "pinned-ns"
+	client, restore := withResolvers()
+	defer restore()
+
+	pinnedLabels := map[string]string{IdleableLabel: "true", PinnedLabel: "true", WakeExpiresLabel: "true"}
+	idleableDeployment(client, ns, "web", 1, pinnedLabels)
+	client.CoreV1().Services(ns).Create(&coreAPI.Service{ObjectMeta: metaAPI.ObjectMeta{Namespace: ns, Name: "web"}})
+	annotateDeployment(client, ns, "web", map[string]string{
+		PinnedUntilAnnotation:   time.Now().UTC().Add(time.Hour).Format(IdledAtFormat),
+		PinnedByAnnotation:      "alice",
+		WakeExpiresAtAnnotation: time.Now().UTC().Add(-time.Minute).Format(IdledAtFormat),
+	})
+
+	// Inactive and its wake expired, but pinned
+	assert.Equal(t, 0, NewIdler(DEFAULT_IDLER_SELECTOR, time.Minute, time.Minute, &lastUnidleActivity{}).Run())
+	assert.Equal(t, 0, NewWakeExpirer(time.Minute).Run())
+	assert.Equal(t, int32(1), *getDeployment(ns, "web").Spec.Replicas)
+
+	annotateDeployment(client, ns, "web", map[string]string{
+		PinnedUntilAnnotation: time.Now().UTC().Add(-time.Minute).Format(IdledAtFormat),
+	})
+	assert.Equal(t, 1, NewWakeExpirer(time.Minute).Run())
+}
+
+func TestPinExpirerRemovesExpiredPins(t *testing.T) {
+	const ns = "pin-expirer-ns"
+	client, restore := withResolvers()
+	defer restore()
+
+	pins := map[string]string{
+		"expired": time.Now().UTC().Add(-time.Minute).Format(IdledAtFormat),
+		"invalid": "next week",
+		"pinned":  time.Now().UTC().Add(time.Hour).Format(IdledAtFormat),
+	}
+	for name, until := range pins {
+		idleableDeployment(client, ns, name, 1, map[string]string{PinnedLabel: "true"})
+		annotateDeployment(client, ns, name, map[string]string{PinnedUntilAnnotation: until, PinnedByAnnotation: "alice"})
+	}
+
+	patches := countActions(client, "patch")
+	assert.Equal(t, 2, NewPinExpirer(time.Minute).Run())
+	assert.Equal(t, patches+2, countActions(client, "patch"))
+}
+
+func TestPinExpirerRemovesExpiredPinsOfStatefulSets(t *testing.T) {
+	const ns = "pin-expirer-sts-ns"
+	client, restore := withResolvers()
+	defer restore()
+
+	pins := map[string]string{
+		"expired": time.Now().UTC().Add(-time.Minute).Format(IdledAtFormat),
+		"pinned":  time.Now().UTC().Add(time.Hour).Format(IdledAtFormat),
+	}
+	for name, until := range pins {
+		client.AppsV1().StatefulSets(ns).Create(&appsAPI.StatefulSet{ObjectMeta: metaAPI.ObjectMeta{
+			Namespace:   ns,
+			Name:        name,
+			Labels:      map[string]string{PinnedLabel: "true"},
+			Annotations: map[string]string{PinnedUntilAnnotation: until, PinnedByAnnotation: "alice"},
+		}})
+	}
+
+	assert.Equal(t, 1, NewPinExpirer(time.Minute).Run())
+	patched := []string{}
+	for _, action := range client.Actions() {
+		if patch, ok := action.(k8sTesting.PatchAction); ok && action.GetResource().Resource == "statefulsets" {
+			patched = append(patched, patch.GetName())
+		}
+	}
+	assert.Equal(t, []string{"expired"}, patched)
+}
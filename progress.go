@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sort"
+
+	appsAPI "k8s.io/api/apps/v1"
+	coreAPI "k8s.io/api/core/v1"
+)
+
+// Steps of the unidling, in order
+const (
+	StepFind                = "find"
+	StepRestoreReplicas     = "restore-replicas"
+	StepWait                = "wait"
+	StepRemoveIdledMetadata = "remove-idled-metadata"
+	StepRedirect            = "redirect"
+	StepDone                = "done"
+)
+
+// Steps lists the steps of the unidling in the order they're performed
+var Steps = []string{
+	StepFind,
+	StepRestoreReplicas,
+	StepWait,
+	StepRemoveIdledMetadata,
+	StepRedirect,
+}
+
+// Update is the machine-readable progress of the unidling, sent to the
+// clients as JSON in the data of the SSE messages
+type Update struct {
+	Step      string `json:"step"`
+	StepIndex int    `json:"step_index"`
+	StepTotal int    `json:"step_total"`
+	// Message is the human-readable description of the progress
+	Message  string          `json:"message"`
+	Replicas *ReplicasStatus `json:"replicas,omitempty"`
+	Pods     []PodStatus     `json:"pods,omitempty"`
+	// Components is the state of each workload when the app is a group
+	Components []ComponentStatus `json:"components,omitempty"`
+	// RequestID is the ID used to correlate the logs of the unidling
+	RequestID string `json:"request_id,omitempty"`
+	// UpUntil is the time (RFC 3339) until which the unidled app is
+	// guaranteed to stay up, see UNIDLE_GRACE_PERIOD
+	UpUntil string `json:"up_until,omitempty"`
+}
+
+// ReplicasStatus is the number of replicas of the app's Deployment
+type ReplicasStatus struct {
+	Desired   int32 `json:"desired"`
+	Ready     int32 `json:"ready"`
+	Available int32 `json:"available"`
+}
+
+// PodStatus is the status of one of the app's pods
+type PodStatus struct {
+	Name       string            `json:"name"`
+	Phase      string            `json:"phase"`
+	Containers []ContainerStatus `json:"containers"`
+}
+
+// ContainerStatus is the status of one of the containers of an app's pod
+type ContainerStatus struct {
+	Name string `json:"name"`
+	// State is one of "waiting", "running" or "terminated"
+	State        string `json:"state"`
+	Reason       string `json:"reason,omitempty"`
+	Ready        bool   `json:"ready"`
+	RestartCount int32  `json:"restart_count"`
+}
+
+// stepIndex returns the (1-based) position of the step of the unidling
+func stepIndex(step string) int {
+	if step == StepDone {
+		return len(Steps)
+	}
+	for i, s := range Steps {
+		if s == step {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func replicasStatus(dep *appsAPI.Deployment) *ReplicasStatus {
+	status := &ReplicasStatus{
+		Ready:     dep.Status.ReadyReplicas,
+		Available: dep.Status.AvailableReplicas,
+	}
+	if dep.Spec.Replicas != nil {
+		status.Desired = *dep.Spec.Replicas
+	}
+	return status
+}
+
+func podStatuses(pods []coreAPI.Pod) []PodStatus {
+	statuses := make([]PodStatus, 0, len(pods))
+	for _, pod := range pods {
+		status := PodStatus{
+			Name:       pod.Name,
+			Phase:      string(pod.Status.Phase),
+			Containers: []ContainerStatus{},
+		}
+		for _, c := range pod.Status.ContainerStatuses {
+			status.Containers = append(status.Containers, containerStatus(&c))
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+func containerStatus(c *coreAPI.ContainerStatus) ContainerStatus {
+	status := ContainerStatus{
+		Name:         c.Name,
+		Ready:        c.Ready,
+		RestartCount: c.RestartCount,
+	}
+	switch {
+	case c.State.Waiting != nil:
+		status.State = "waiting"
+		status.Reason = c.State.Waiting.Reason
+	case c.State.Running != nil:
+		status.State = "running"
+	case c.State.Terminated != nil:
+		status.State = "terminated"
+		status.Reason = c.State.Terminated.Reason
+	}
+	return status
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	appsAPI "k8s.io/api/apps/v1"
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewMessageEncodesUpdate(t *testing.T) {
+	replicas := int32(2)
+	dep := &appsAPI.Deployment{
+		Spec:   appsAPI.DeploymentSpec{Replicas: &replicas},
+		Status: appsAPI.DeploymentStatus{ReadyReplicas: 1},
+	}
+	pods := []coreAPI.Pod{
+		{
+			ObjectMeta: metaAPI.ObjectMeta{Name: "test-2"},
+			Status: coreAPI.PodStatus{
+				Phase: coreAPI.PodPending,
+				ContainerStatuses: []coreAPI.ContainerStatus{
+					{
+						Name:  "app",
+						State: coreAPI.ContainerState{Waiting: &coreAPI.ContainerStateWaiting{Reason: "ContainerCreating"}},
+					},
+				},
+			},
+		},
+		{
+			ObjectMeta: metaAPI.ObjectMeta{Name: "test-1"},
+			Status:     coreAPI.PodStatus{Phase: coreAPI.PodRunning},
+		},
+	}
+
+	m := newMessage("", StepWait, &Update{
+		Message:  StartingMessage,
+		Replicas: replicasStatus(dep),
+		Pods:     podStatuses(pods),
+	})
+
+	var update Update
+	err := json.Unmarshal([]byte(m.data), &update)
+	assert.Nil(t, err)
+	assert.Equal(t, StepWait, update.Step)
+	assert.Equal(t, 3, update.StepIndex)
+	assert.Equal(t, 5, update.StepTotal)
+	assert.Equal(t, StartingMessage, update.Message)
+	assert.Equal(t, &ReplicasStatus{Desired: 2, Ready: 1, Available: 0}, update.Replicas)
+	assert.Equal(t, "test-1", update.Pods[0].Name)
+	assert.Equal(t, "test-2", update.Pods[1].Name)
+	assert.Equal(t, "Pending", update.Pods[1].Phase)
+	assert.Equal(t, ContainerStatus{Name: "app", State: "waiting", Reason: "ContainerCreating"}, update.Pods[1].Containers[0])
+}
+
+func TestSendEventKeepsPercentSigns(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sendEvent(rec, newMessage("error", StepWait, &Update{Message: "Disk 100% full"}))
+
+	data := strings.TrimPrefix(strings.Split(rec.Body.String(), "\n")[3], "data: ")
+	var update Update
+	assert.Nil(t, json.Unmarshal([]byte(data), &update))
+	assert.Equal(t, "Disk 100% full", update.Message)
+}
+
+func TestStepIndex(t *testing.T) {
+	assert.Equal(t, 1, stepIndex(StepFind))
+	assert.Equal(t, 5, stepIndex(StepRedirect))
+	assert.Equal(t, 5, stepIndex(StepDone))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const DEFAULT_REDIRECT_SCHEME = "https"
+
+// ForwardedProtoHeader is the header set by proxies to the scheme of the
+// original request
+const ForwardedProtoHeader = "X-Forwarded-Proto"
+
+// RedirectScheme is the scheme of the redirect back to the app, used when
+// the request doesn't have the `X-Forwarded-Proto` header
+var RedirectScheme = DEFAULT_REDIRECT_SCHEME
+
+// validScheme returns true for the schemes the user can be redirected to
+func validScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https"
+}
+
+// redirectURL returns the URL the user is sent back to once the app is
+// unidled: the URL of the original request (path and query), on the app's
+// host. It's the root of the current host when that URL can't be trusted
+func redirectURL(req *http.Request) string {
+	scheme := RedirectScheme
+	// NOTE: The header can have the schemes of several proxies, the first
+	//       one is the client's
+	forwarded := strings.TrimSpace(strings.Split(req.Header.Get(ForwardedProtoHeader), ",")[0])
+	if validScheme(strings.ToLower(forwarded)) {
+		scheme = strings.ToLower(forwarded)
+	}
+
+	// NOTE: Only the path and query are taken from the request, the host
+	//       being the app's, even when the request URI has another one
+	target := &url.URL{
+		Scheme:   scheme,
+		Host:     req.Host,
+		Path:     req.URL.Path,
+		RawPath:  req.URL.RawPath,
+		RawQuery: req.URL.RawQuery,
+	}
+	if target.Path == "" {
+		target.Path = "/"
+	}
+
+	if !validRedirect(target.String(), req.Host) {
+		return "/"
+	}
+	return target.String()
+}
+
+// validRedirect returns true if the target is an absolute http(s) URL on the
+// given host
+func validRedirect(target string, host string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	return validScheme(u.Scheme) && u.User == nil && u.Host != "" && u.Host == host && strings.HasPrefix(u.Path, "/")
+}
+
+// redirectSchemeFromEnv reads the scheme of the redirects from
+// `REDIRECT_SCHEME`, defaulting to `https` when not set or invalid
+func redirectSchemeFromEnv() string {
+	scheme, ok := os.LookupEnv("REDIRECT_SCHEME")
+	if !ok {
+		logger.Info("$REDIRECT_SCHEME not set. Defaulting to '%s'", DEFAULT_REDIRECT_SCHEME)
+		return DEFAULT_REDIRECT_SCHEME
+	}
+	if !validScheme(scheme) {
+		logger.Info("$REDIRECT_SCHEME has invalid scheme '%s'. Defaulting to '%s'", scheme, DEFAULT_REDIRECT_SCHEME)
+		return DEFAULT_REDIRECT_SCHEME
+	}
+	return scheme
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectURL(t *testing.T) {
+	testCases := []struct {
+		url       string
+		host      string
+		forwarded string
+		expected  string
+	}{
+		{url: "/", host: HOST, expected: "https://test-tool.example.com/"},
+		{url: "/project/notebook.ipynb?kernel=python3", host: HOST, expected: "https://test-tool.example.com/project/notebook.ipynb?kernel=python3"},
+		{url: "/a%2Fb/c", host: HOST, expected: "https://test-tool.example.com/a%2Fb/c"},
+		{url: "/", host: HOST, forwarded: "http", expected: "http://test-tool.example.com/"},
+		{url: "/", host: HOST, forwarded: "HTTPS, http", expected: "https://test-tool.example.com/"},
+		{url: "/", host: HOST, forwarded: "javascript", expected: "https://test-tool.example.com/"},
+		// The host is always the app's
+		{url: "http://evil.example.com/path", host: HOST, expected: "https://test-tool.example.com/path"},
+		{url: "//evil.example.com/path", host: HOST, expected: "https://test-tool.example.com//evil.example.com/path"},
+		{url: "/", host: "test-tool.example.com@evil.example.com", expected: "/"},
+		{url: "/", host: "", expected: "/"},
+	}
+
+	for _, tc := range testCases {
+		req, _ := http.NewRequest("GET", "/", nil)
+		// Parsed as the server does
+		req.URL, _ = url.ParseRequestURI(tc.url)
+		req.Host = tc.host
+		if tc.forwarded != "" {
+			req.Header.Set(ForwardedProtoHeader, tc.forwarded)
+		}
+		assert.Equal(t, tc.expected, redirectURL(req), tc.url)
+	}
+}
+
+func TestValidRedirect(t *testing.T) {
+	assert.True(t, validRedirect("https://test-tool.example.com/path?q=1", HOST))
+	assert.False(t, validRedirect("https://evil.example.com/", HOST))
+	assert.False(t, validRedirect("javascript://test-tool.example.com/", HOST))
+	assert.False(t, validRedirect("/relative", HOST))
+	assert.False(t, validRedirect("https://user@test-tool.example.com/", HOST))
+}
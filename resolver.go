@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Names of the app resolvers, used in `APP_RESOLVERS`
+const (
+	ResolverLabel       = "label"
+	ResolverIngressHost = "ingress-host"
+	ResolverHashedLabel = "hashed-label"
+	ResolverTemplate    = "template"
+)
+
+const (
+	DEFAULT_APP_RESOLVERS = ResolverLabel
+	// DEFAULT_HASHED_LABEL is the label used by the `hashed-label` resolver
+	DEFAULT_HASHED_LABEL = "mojanalytics.xyz/unidle-key-hash"
+)
+
+// appResolvers finds the app's resources for a host, see ResolversFromEnv
+var appResolvers = ResolverChain{&labelResolver{}}
+
+// Route is the host and path requested by the user, which the app is found for
+type Route struct {
+	Host string
+	Path string
+}
+
+func (r Route) String() string {
+	return r.Host + r.Path
+}
+
+// backendName returns the name of the Service the Ingress routes the route
+// to, empty if none
+func (r Route) backendName(ing *Ingress) string {
+	if backend := ing.Backend(r.Host, r.Path); backend != nil {
+		return backend.ServiceName
+	}
+	return ""
+}
+
+// AppResolver finds the kubernetes resources of the app for a route.
+// FindIngress is called first, then the App's workload (and the other
+// workloads of its group) and Service are looked up by the same AppResolver
+type AppResolver interface {
+	// Name is the name of the AppResolver in the configuration
+	Name() string
+	FindIngress(route Route) (*Ingress, error)
+	FindWorkload(route Route, ing *Ingress) (Workload, error)
+	// FindGroup returns the workloads unidled together with the App's
+	// workload, which comes first
+	FindGroup(route Route, ing *Ingress, workload Workload) ([]Workload, error)
+	FindService(route Route, ing *Ingress) (*Service, error)
+}
+
+// notFoundError is returned by an AppResolver which can't find the app
+type notFoundError struct {
+	message string
+}
+
+func (e *notFoundError) Error() string {
+	return e.message
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &notFoundError{message: fmt.Sprintf(format, args...)}
+}
+
+// isNotFound returns true if the error means an AppResolver can't find the app
+func isNotFound(err error) bool {
+	_, ok := err.(*notFoundError)
+	return ok
+}
+
+// AmbiguousAppError is returned when a route matches several apps' resources
+type AmbiguousAppError struct {
+	Route    string
+	Resource string
+	// Matches are the namespace/name of the matching resources
+	Matches []string
+}
+
+func (e *AmbiguousAppError) Error() string {
+	return fmt.Sprintf("%s matches %d %s: %s", e.Route, len(e.Matches), e.Resource, strings.Join(e.Matches, ", "))
+}
+
+func ambiguous(route Route, resource string, objects []metaAPI.Object) error {
+	matches := []string{}
+	for _, obj := range objects {
+		matches = append(matches, storeKey(obj.GetNamespace(), obj.GetName()))
+	}
+	sort.Strings(matches)
+	return &AmbiguousAppError{Route: route.String(), Resource: resource, Matches: matches}
+}
+
+// ResolverChain tries each AppResolver in turn, until one finds the app's
+// Ingress. Errors other than not finding it stop the chain
+type ResolverChain []AppResolver
+
+// FindIngress returns the app's Ingress and the AppResolver which found it
+func (c ResolverChain) FindIngress(route Route) (*Ingress, AppResolver, error) {
+	reasons := []string{}
+	for _, resolver := range c {
+		ing, err := resolver.FindIngress(route)
+		if err == nil {
+			return ing, resolver, nil
+		}
+		if !isNotFound(err) {
+			return nil, resolver, err
+		}
+		reasons = append(reasons, fmt.Sprintf("%s: %s", resolver.Name(), err))
+	}
+	return nil, nil, notFound("no Ingress found (%s)", strings.Join(reasons, "; "))
+}
+
+// ResolversFromEnv configures the ResolverChain from the comma-separated
+// AppResolver names in `APP_RESOLVERS` and their own environment variables
+func ResolversFromEnv() (ResolverChain, error) {
+	names, ok := os.LookupEnv("APP_RESOLVERS")
+	if !ok {
+		logger.Info("$APP_RESOLVERS not set. Defaulting to '%s'", DEFAULT_APP_RESOLVERS)
+		names = DEFAULT_APP_RESOLVERS
+	}
+
+	chain := ResolverChain{}
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case ResolverLabel:
+			chain = append(chain, &labelResolver{})
+		case ResolverIngressHost:
+			chain = append(chain, &ingressHostResolver{})
+		case ResolverHashedLabel:
+			label, ok := os.LookupEnv("HASHED_LABEL")
+			if !ok {
+				label = DEFAULT_HASHED_LABEL
+			}
+			chain = append(chain, &hashedLabelResolver{label: label})
+		case ResolverTemplate:
+			resolver, err := NewTemplateResolver(os.Getenv("HOST_PATTERN"), os.Getenv("NAMESPACE_TEMPLATE"), os.Getenv("NAME_TEMPLATE"))
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, resolver)
+		default:
+			return nil, fmt.Errorf("unknown app resolver '%s' in $APP_RESOLVERS", name)
+		}
+	}
+	return chain, nil
+}
+
+// labelResolver finds the app's resources by their `UnidleKeyLabel` label
+type labelResolver struct{}
+
+func (r *labelResolver) Name() string {
+	return ResolverLabel
+}
+
+func (r *labelResolver) FindIngress(route Route) (*Ingress, error) {
+	return findIngressByLabel(route, UnidleKeyLabel, unidleKey(route.Host))
+}
+
+func (r *labelResolver) FindWorkload(route Route, ing *Ingress) (Workload, error) {
+	return findWorkloadByLabel(route, ing, UnidleKeyLabel, unidleKey(route.Host))
+}
+
+func (r *labelResolver) FindGroup(route Route, ing *Ingress, workload Workload) ([]Workload, error) {
+	return findWorkloadGroup(route, ing, workload, UnidleKeyLabel, unidleKey(route.Host))
+}
+
+func (r *labelResolver) FindService(route Route, ing *Ingress) (*Service, error) {
+	return findServiceByLabel(route, ing, UnidleKeyLabel, unidleKey(route.Host))
+}
+
+// hashedLabelResolver finds the app's resources by a label whose value is
+// derived from the host and always a valid label value, see hashedLabelValue
+type hashedLabelResolver struct {
+	label string
+}
+
+func (r *hashedLabelResolver) Name() string {
+	return ResolverHashedLabel
+}
+
+func (r *hashedLabelResolver) FindIngress(route Route) (*Ingress, error) {
+	return findIngressByLabel(route, r.label, hashedLabelValue(route.Host))
+}
+
+func (r *hashedLabelResolver) FindWorkload(route Route, ing *Ingress) (Workload, error) {
+	return findWorkloadByLabel(route, ing, r.label, hashedLabelValue(route.Host))
+}
+
+func (r *hashedLabelResolver) FindGroup(route Route, ing *Ingress, workload Workload) ([]Workload, error) {
+	return findWorkloadGroup(route, ing, workload, r.label, hashedLabelValue(route.Host))
+}
+
+func (r *hashedLabelResolver) FindService(route Route, ing *Ingress) (*Service, error) {
+	return findServiceByLabel(route, ing, r.label, hashedLabelValue(route.Host))
+}
+
+var invalidLabelValueChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// hashedLabelValue returns the host when it's a valid label value. Otherwise
+// (e.g. longer than 63 characters) it's truncated and suffixed with a hash of
+// the whole host, so that hosts with the same prefix don't collide
+func hashedLabelValue(host string) string {
+	if len(validation.IsValidLabelValue(host)) == 0 {
+		return host
+	}
+
+	sum := sha256.Sum256([]byte(host))
+	hash := hex.EncodeToString(sum[:])[:10]
+	prefix := host
+	if len(prefix) > validation.LabelValueMaxLength-len(hash)-1 {
+		prefix = prefix[:validation.LabelValueMaxLength-len(hash)-1]
+	}
+	// Label values must start and end with an alphanumeric character
+	prefix = strings.Trim(invalidLabelValueChars.ReplaceAllString(prefix, "-"), "._-")
+	if prefix == "" {
+		return hash
+	}
+	return prefix + "-" + hash
+}
+
+// ingressHostResolver finds the Ingress with a rule for the host (and path).
+// The Service is the backend of that rule and the workload has the Service's
+// name
+type ingressHostResolver struct{}
+
+func (r *ingressHostResolver) Name() string {
+	return ResolverIngressHost
+}
+
+func (r *ingressHostResolver) FindIngress(route Route) (*Ingress, error) {
+	return findIngressByHost(route)
+}
+
+// backendService returns the name of the Service the route is routed to
+func (r *ingressHostResolver) backendService(route Route, ing *Ingress) (string, error) {
+	name := route.backendName(ing)
+	if name == "" {
+		return "", notFound("Ingress %s has no backend for %s", storeKey(ing.Namespace, ing.Name), route)
+	}
+	return name, nil
+}
+
+func (r *ingressHostResolver) FindWorkload(route Route, ing *Ingress) (Workload, error) {
+	name, err := r.backendService(route, ing)
+	if err != nil {
+		return nil, err
+	}
+	return findWorkloadByName(ing.Namespace, name)
+}
+
+func (r *ingressHostResolver) FindGroup(route Route, ing *Ingress, workload Workload) ([]Workload, error) {
+	return findGroupByWorkloadLabel(route, ing, workload)
+}
+
+func (r *ingressHostResolver) FindService(route Route, ing *Ingress) (*Service, error) {
+	name, err := r.backendService(route, ing)
+	if err != nil {
+		return nil, err
+	}
+	return findServiceByName(ing.Namespace, name)
+}
+
+// templateResolver maps the host to the namespace and name of the app's
+// resources (Ingress, workload and Service) using a regular expression and
+// templates of the named groups it captures, e.g. the pattern
+// `^(?P<user>[^-]+)-(?P<app>[^.]+)\.` with the templates `user-{{.user}}` and
+// `{{.user}}-{{.app}}`
+type templateResolver struct {
+	pattern   *regexp.Regexp
+	namespace *template.Template
+	name      *template.Template
+}
+
+// NewTemplateResolver constructs a new templateResolver
+func NewTemplateResolver(pattern string, namespace string, name string) (*templateResolver, error) {
+	if pattern == "" || namespace == "" || name == "" {
+		return nil, fmt.Errorf("the '%s' app resolver requires $HOST_PATTERN, $NAMESPACE_TEMPLATE and $NAME_TEMPLATE", ResolverTemplate)
+	}
+
+	r := &templateResolver{}
+	var err error
+	r.pattern, err = regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid $HOST_PATTERN: %s", err)
+	}
+	r.namespace, err = template.New("namespace").Option("missingkey=error").Parse(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("invalid $NAMESPACE_TEMPLATE: %s", err)
+	}
+	r.name, err = template.New("name").Option("missingkey=error").Parse(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid $NAME_TEMPLATE: %s", err)
+	}
+	return r, nil
+}
+
+func (r *templateResolver) Name() string {
+	return ResolverTemplate
+}
+
+// resolve returns the namespace and name of the app's resources for the host
+func (r *templateResolver) resolve(host string) (string, string, error) {
+	match := r.pattern.FindStringSubmatch(host)
+	if match == nil {
+		return "", "", notFound("%s doesn't match %s", host, r.pattern)
+	}
+	groups := map[string]string{"host": host}
+	for i, group := range r.pattern.SubexpNames() {
+		if group != "" {
+			groups[group] = match[i]
+		}
+	}
+
+	namespace := &bytes.Buffer{}
+	err := r.namespace.Execute(namespace, groups)
+	if err != nil {
+		return "", "", fmt.Errorf("failed executing namespace template: %s", err)
+	}
+	name := &bytes.Buffer{}
+	err = r.name.Execute(name, groups)
+	if err != nil {
+		return "", "", fmt.Errorf("failed executing name template: %s", err)
+	}
+	return namespace.String(), name.String(), nil
+}
+
+// FindIngress returns the Ingress with the name given by the templates, as
+// long as it routes the host and path: its longest rule path matching them
+// must be the longest one of all the Ingresses of the host, as the ingress
+// controllers route to that one
+func (r *templateResolver) FindIngress(route Route) (*Ingress, error) {
+	namespace, name, err := r.resolve(route.Host)
+	if err != nil {
+		return nil, err
+	}
+	ing, err := findIngressByName(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if ing.Match(route.Host, route.Path) == nil {
+		return nil, notFound("Ingress %s has no rule for %s", storeKey(namespace, name), route)
+	}
+
+	ings, err := ingressesByHost(route.Host)
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range longestMatches(route, ings) {
+		if match.Namespace == namespace && match.Name == name {
+			return ing, nil
+		}
+	}
+	return nil, notFound("%s is routed by another Ingress than %s", route, storeKey(namespace, name))
+}
+
+func (r *templateResolver) FindWorkload(route Route, ing *Ingress) (Workload, error) {
+	_, name, err := r.resolve(route.Host)
+	if err != nil {
+		return nil, err
+	}
+	return findWorkloadByName(ing.Namespace, name)
+}
+
+func (r *templateResolver) FindGroup(route Route, ing *Ingress, workload Workload) ([]Workload, error) {
+	return findGroupByWorkloadLabel(route, ing, workload)
+}
+
+func (r *templateResolver) FindService(route Route, ing *Ingress) (*Service, error) {
+	_, name, err := r.resolve(route.Host)
+	if err != nil {
+		return nil, err
+	}
+	return findServiceByName(ing.Namespace, name)
+}
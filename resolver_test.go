@@ -0,0 +1,224 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	appsAPI "k8s.io/api/apps/v1"
+	coreAPI "k8s.io/api/core/v1"
+	extAPI "k8s.io/api/extensions/v1beta1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	k8sFake "k8s.io/client-go/kubernetes/fake"
+)
+
+// withResolvers swaps the kubernetes client for a new, empty, fake one and
+// the app resolvers for the given ones
+func withResolvers(resolvers ...AppResolver) (*k8sFake.Clientset, func()) {
+	previousClient, previousResolvers := k8sClient, appResolvers
+	client := k8sFake.NewSimpleClientset()
+	fakeScale(client)
+	k8sClient = client
+	appResolvers = resolvers
+	return client, func() {
+		k8sClient = previousClient
+		appResolvers = previousResolvers
+	}
+}
+
+// mockApp creates a Deployment and a Service with the given labels and an
+// Ingress routing the host and path to the Service
+func mockApp(client *k8sFake.Clientset, ns string, name string, host string, path string, labels map[string]string) {
+	meta := metaAPI.ObjectMeta{Namespace: ns, Name: name, Labels: labels}
+	client.AppsV1().Deployments(ns).Create(&appsAPI.Deployment{ObjectMeta: meta})
+	client.CoreV1().Services(ns).Create(&coreAPI.Service{ObjectMeta: meta})
+	client.ExtensionsV1beta1().Ingresses(ns).Create(&extAPI.Ingress{
+		ObjectMeta: meta,
+		Spec: extAPI.IngressSpec{
+			Rules: []extAPI.IngressRule{{
+				Host: host,
+				IngressRuleValue: extAPI.IngressRuleValue{HTTP: &extAPI.HTTPIngressRuleValue{
+					Paths: []extAPI.HTTPIngressPath{{
+						Path: path,
+						Backend: extAPI.IngressBackend{
+							ServiceName: name,
+							ServicePort: intstr.FromInt(80),
+						},
+					}},
+				}},
+			}},
+		},
+	})
+}
+
+func TestHashedLabelValue(t *testing.T) {
+	assert.Equal(t, "foo.example.com", hashedLabelValue("foo.example.com"))
+
+	prefix := strings.Repeat("a", 70)
+	first := hashedLabelValue(prefix + "-first.example.com")
+	second := hashedLabelValue(prefix + "-second.example.com")
+	assert.Empty(t, validation.IsValidLabelValue(first))
+	assert.Empty(t, validation.IsValidLabelValue(second))
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, first, hashedLabelValue(prefix+"-first.example.com"))
+}
+
+func TestResolverChainFallsThrough(t *testing.T) {
+	client, restore := withResolvers(&labelResolver{}, &ingressHostResolver{})
+	defer restore()
+	mockApp(client, "host-ns", "host-app", "host-app.example.com", "/", nil)
+
+	a, err := NewApp("host-app.example.com", "/", logger, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, ResolverIngressHost, a.resolver.Name())
+	assert.Equal(t, "host-ns", a.ingress.Namespace)
+	assert.Equal(t, "host-app", a.workload.GetName())
+	assert.Equal(t, "host-app", a.service.Name)
+
+	_, err = NewApp("unknown.example.com", "/", logger, nil)
+	assert.Equal(t, "Ingress for your app not found.", err.Error())
+}
+
+func TestHashedLabelResolver(t *testing.T) {
+	host := strings.Repeat("long", 20) + ".example.com"
+	label := "example.com/unidle-key-hash"
+	client, restore := withResolvers(&hashedLabelResolver{label: label})
+	defer restore()
+	mockApp(client, "hashed-ns", "hashed", host, "/", map[string]string{label: hashedLabelValue(host)})
+
+	a, err := NewApp(host, "/", logger, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "hashed", a.workload.GetName())
+}
+
+func TestTemplateResolver(t *testing.T) {
+	resolver, err := NewTemplateResolver(`^(?P<user>[^-]+)-(?P<app>[^.]+)\.`, "user-{{.user}}", "{{.app}}")
+	assert.Nil(t, err)
+	client, restore := withResolvers(resolver)
+	defer restore()
+	mockApp(client, "user-alice", "rstudio", "alice-rstudio.example.com", "/", nil)
+
+	a, err := NewApp("alice-rstudio.example.com", "/", logger, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "user-alice", a.ingress.Namespace)
+	assert.Equal(t, "rstudio", a.workload.GetName())
+	assert.Equal(t, "rstudio", a.service.Name)
+
+	_, _, err = ResolverChain{resolver}.FindIngress(Route{Host: "nodash.example.com", Path: "/"})
+	assert.True(t, isNotFound(err))
+}
+
+func TestTemplateResolverMatchesHostAndPath(t *testing.T) {
+	resolver, err := NewTemplateResolver(`^(?P<user>[^-]+)-(?P<app>[^.]+)\.`, "user-{{.user}}", "{{.app}}")
+	assert.Nil(t, err)
+	client, restore := withResolvers(resolver)
+	defer restore()
+	mockApp(client, "user-bob", "web", "bob-web.example.com", "/", nil)
+	mockApp(client, "user-bob", "api", "bob-web.example.com", "/api", nil)
+	mockApp(client, "user-bob", "other", "other.example.com", "/", nil)
+
+	ing, _, err := ResolverChain{resolver}.FindIngress(Route{Host: "bob-web.example.com", Path: "/page"})
+	assert.Nil(t, err)
+	assert.Equal(t, "web", ing.Name)
+
+	// The path is routed by the Ingress with the longest matching path
+	_, _, err = ResolverChain{resolver}.FindIngress(Route{Host: "bob-web.example.com", Path: "/api/users"})
+	assert.True(t, isNotFound(err))
+
+	// The Ingress has no rule for the host
+	_, _, err = ResolverChain{resolver}.FindIngress(Route{Host: "bob-other.example.com", Path: "/"})
+	assert.True(t, isNotFound(err))
+}
+
+func TestAmbiguousHost(t *testing.T) {
+	client, restore := withResolvers(&ingressHostResolver{})
+	defer restore()
+	mockApp(client, "first-ns", "app", "shared.example.com", "/", nil)
+	mockApp(client, "second-ns", "app", "shared.example.com", "/", nil)
+
+	_, _, err := appResolvers.FindIngress(Route{Host: "shared.example.com", Path: "/"})
+	ambiguous, ok := err.(*AmbiguousAppError)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"first-ns/app", "second-ns/app"}, ambiguous.Matches)
+
+	_, err = NewApp("shared.example.com", "/", logger, nil)
+	assert.Contains(t, err.Error(), "Several apps match shared.example.com")
+}
+
+func TestSharedHostPaths(t *testing.T) {
+	const host = "shared-paths.example.com"
+	labels := map[string]string{UnidleKeyLabel: unidleKey(host)}
+
+	for _, resolver := range []AppResolver{&labelResolver{}, &ingressHostResolver{}} {
+		client, restore := withResolvers(resolver)
+		mockApp(client, "shared-ns", "dashboard", host, "/dashboard", labels)
+		mockApp(client, "shared-ns", "api", host, "/api", labels)
+
+		a, err := NewApp(host, "/dashboard/page", logger, nil)
+		assert.Nil(t, err, resolver.Name())
+		assert.Equal(t, "dashboard", a.ingress.Name, resolver.Name())
+		assert.Equal(t, "dashboard", a.workload.GetName(), resolver.Name())
+		assert.Equal(t, "dashboard", a.service.Name, resolver.Name())
+		// The app on the other path isn't part of the app's group
+		assert.False(t, a.grouped(), resolver.Name())
+
+		a, err = NewApp(host, "/api", logger, nil)
+		assert.Nil(t, err, resolver.Name())
+		assert.Equal(t, "api", a.workload.GetName(), resolver.Name())
+
+		restore()
+	}
+}
+
+func TestResolversByNameFindGroup(t *testing.T) {
+	const host = "team-web.example.com"
+	const ns = "user-team"
+	labels := map[string]string{UnidleKeyLabel: unidleKey(host)}
+	template, err := NewTemplateResolver(`^(?P<user>[^-]+)-(?P<app>[^.]+)\.`, "user-{{.user}}", "{{.app}}")
+	assert.Nil(t, err)
+
+	for _, resolver := range []AppResolver{&ingressHostResolver{}, template} {
+		client, restore := withResolvers(resolver)
+		mockApp(client, ns, "web", host, "/", labels)
+		client.AppsV1().Deployments(ns).Create(&appsAPI.Deployment{ObjectMeta: metaAPI.ObjectMeta{
+			Namespace: ns,
+			Name:      "worker",
+			Labels:    labels,
+		}})
+
+		a, err := NewApp(host, "/", logger, nil)
+		assert.Nil(t, err, resolver.Name())
+		assert.Equal(t, "web", a.workload.GetName(), resolver.Name())
+		// The workloads with the same label as the app's workload
+		assert.True(t, a.grouped(), resolver.Name())
+
+		restore()
+	}
+}
+
+func TestResolversFromEnv(t *testing.T) {
+	defer os.Unsetenv("APP_RESOLVERS")
+
+	chain, err := ResolversFromEnv()
+	assert.Nil(t, err)
+	assert.Len(t, chain, 1)
+	assert.Equal(t, ResolverLabel, chain[0].Name())
+
+	os.Setenv("APP_RESOLVERS", "label, ingress-host,hashed-label")
+	chain, err = ResolversFromEnv()
+	assert.Nil(t, err)
+	assert.Equal(t, ResolverHashedLabel, chain[2].Name())
+	assert.Equal(t, DEFAULT_HASHED_LABEL, chain[2].(*hashedLabelResolver).label)
+
+	os.Setenv("APP_RESOLVERS", "template")
+	_, err = ResolversFromEnv()
+	assert.Contains(t, err.Error(), "$HOST_PATTERN")
+
+	os.Setenv("APP_RESOLVERS", "label,unknown")
+	_, err = ResolversFromEnv()
+	assert.Contains(t, err.Error(), "unknown app resolver 'unknown'")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	coreAPI "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Where the spec of the App's Service before it was idled comes from
+const (
+	ServiceSpecFromSnapshot = "snapshot"
+	ServiceSpecFromWorkload = "workload"
+)
+
+// Legacy port of the apps' Services, used when the workload has no
+// container ports
+const (
+	DEFAULT_SERVICE_PORT = 80
+	DEFAULT_TARGET_PORT  = 3000
+)
+
+// ServiceSpecWhenUnidled returns the spec of the App's Service before it
+// was idled (type, selector, ports and session affinity) and where it comes
+// from: its snapshot annotation, written at idle time, or else inferred from
+// the workload
+func (a *App) ServiceSpecWhenUnidled() (*coreAPI.ServiceSpec, string) {
+	spec, err := serviceSpecSnapshot(a.service)
+	if err != nil {
+		a.logError(err, "Invalid '%s' annotation, inferring the Service spec from the workload.", ServiceSpecWhenUnidledAnnotation)
+	}
+	if spec != nil {
+		return spec, ServiceSpecFromSnapshot
+	}
+
+	var backend *IngressBackend
+	if a.ingress != nil {
+		backend = a.ingress.Backend(a.host, a.path)
+	}
+	return inferServiceSpec(a.workload, a.service, backend), ServiceSpecFromWorkload
+}
+
+// serviceSpecSnapshot parses the snapshot annotation of the Service. It's nil
+// when the Service doesn't have one
+func serviceSpecSnapshot(svc *Service) (*coreAPI.ServiceSpec, error) {
+	value, ok := svc.Annotations[ServiceSpecWhenUnidledAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	spec := &coreAPI.ServiceSpec{}
+	err := json.Unmarshal([]byte(value), spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing Service spec snapshot: %s", err)
+	}
+	if spec.Type == "" {
+		spec.Type = coreAPI.ServiceTypeClusterIP
+	}
+	if spec.Type == coreAPI.ServiceTypeExternalName {
+		return nil, fmt.Errorf("Service spec snapshot is of type %s", spec.Type)
+	}
+	if len(spec.Ports) == 0 {
+		return nil, fmt.Errorf("Service spec snapshot has no ports")
+	}
+	return spec, nil
+}
+
+// inferServiceSpec returns the spec of a ClusterIP Service selecting the
+// workload's pods and exposing their container ports. The port the Ingress
+// backend refers to (if any) is kept, exposing the first container port
+func inferServiceSpec(workload Workload, svc *Service, backend *IngressBackend) *coreAPI.ServiceSpec {
+	spec := &coreAPI.ServiceSpec{
+		Type:     coreAPI.ServiceTypeClusterIP,
+		Selector: map[string]string{"app": svc.Labels["app"]},
+	}
+	if selector := workload.Selector(); selector != nil && len(selector.MatchLabels) > 0 {
+		spec.Selector = selector.MatchLabels
+	}
+
+	var containers []coreAPI.Container
+	if template := workload.Template(); template != nil {
+		containers = template.Spec.Containers
+	}
+	for _, container := range containers {
+		for _, port := range container.Ports {
+			spec.Ports = append(spec.Ports, coreAPI.ServicePort{
+				Name:       port.Name,
+				Protocol:   port.Protocol,
+				Port:       port.ContainerPort,
+				TargetPort: intstr.FromInt(int(port.ContainerPort)),
+			})
+		}
+	}
+	if len(spec.Ports) == 0 {
+		spec.Ports = []coreAPI.ServicePort{{
+			Port:       DEFAULT_SERVICE_PORT,
+			TargetPort: intstr.FromInt(DEFAULT_TARGET_PORT),
+		}}
+	}
+
+	if backend != nil && !exposesPort(spec.Ports, backend.ServicePort) {
+		switch backend.ServicePort.Type {
+		case intstr.Int:
+			if backend.ServicePort.IntVal > 0 {
+				spec.Ports[0].Port = backend.ServicePort.IntVal
+			}
+		case intstr.String:
+			spec.Ports[0].Name = backend.ServicePort.StrVal
+		}
+	}
+
+	// The ports of multi-port Services must be named
+	if len(spec.Ports) > 1 {
+		for i := range spec.Ports {
+			if spec.Ports[i].Name == "" {
+				spec.Ports[i].Name = fmt.Sprintf("port-%d", spec.Ports[i].Port)
+			}
+		}
+	}
+	return spec
+}
+
+// exposesPort returns true if one of the Service ports is the given port
+// (number or name)
+func exposesPort(ports []coreAPI.ServicePort, port intstr.IntOrString) bool {
+	for _, p := range ports {
+		if (port.Type == intstr.Int && p.Port == port.IntVal) || (port.Type == intstr.String && p.Name == port.StrVal) {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceSpecPatch returns the JSON patch restoring the spec of the Service,
+// replacing (rather than merging with) its selector and ports, and removing
+// its external name and snapshot annotation
+func serviceSpecPatch(svc *Service, spec *coreAPI.ServiceSpec) ([]byte, error) {
+	// NOTE: `add` replaces the value when the field is already there
+	patch := []jsonPatchOperation{
+		{Op: "add", Path: "/spec/type", Value: spec.Type},
+		{Op: "add", Path: "/spec/selector", Value: spec.Selector},
+		{Op: "add", Path: "/spec/ports", Value: spec.Ports},
+	}
+	// NOTE: `remove` fails when the field isn't there
+	if svc.Spec.ExternalName != "" {
+		patch = append(patch, jsonPatchOperation{Op: "remove", Path: "/spec/externalName"})
+	}
+	if spec.SessionAffinity != "" {
+		patch = append(patch, jsonPatchOperation{Op: "add", Path: "/spec/sessionAffinity", Value: spec.SessionAffinity})
+	}
+	if spec.SessionAffinityConfig != nil {
+		patch = append(patch, jsonPatchOperation{Op: "add", Path: "/spec/sessionAffinityConfig", Value: spec.SessionAffinityConfig})
+	}
+	if _, ok := svc.Annotations[ServiceSpecWhenUnidledAnnotation]; ok {
+		patch = append(patch, jsonPatchOperation{
+			Op:   "remove",
+			Path: annotationPath(ServiceSpecWhenUnidledAnnotation),
+		})
+	}
+	return json.Marshal(patch)
+}
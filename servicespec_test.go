@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	appsAPI "k8s.io/api/apps/v1"
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestRedirectServiceRestoresSnapshot(t *testing.T) {
+	const ns = "snapshot-ns"
+	dep := mockDeployment(k8sClient, ns, NAME, HOST)
+	created, _ := k8sClient.CoreV1().Services(ns).Create(&coreAPI.Service{
+		ObjectMeta: metaAPI.ObjectMeta{
+			Name:   NAME,
+			Labels: map[string]string{"app": NAME},
+			Annotations: map[string]string{
+				ServiceSpecWhenUnidledAnnotation: `{
+					"type": "ClusterIP",
+					"selector": {"app.kubernetes.io/name": "rstudio"},
+					"ports": [
+						{"name": "http", "port": 8080, "targetPort": "http"},
+						{"name": "metrics", "port": 9090, "targetPort": 9090}
+					],
+					"sessionAffinity": "ClientIP"
+				}`,
+			},
+		},
+		Spec: coreAPI.ServiceSpec{
+			Type:         coreAPI.ServiceTypeExternalName,
+			ExternalName: "unidler.default.svc.cluster.local",
+			Ports:        []coreAPI.ServicePort{{Port: 80}},
+		},
+	})
+	service := Service(*created)
+	a := &App{host: HOST, workload: &dep, service: &service, logger: app.logger}
+
+	err := a.RedirectService()
+	assert.Nil(t, err)
+
+	restored := getService(ns, NAME)
+	assert.Equal(t, coreAPI.ServiceTypeClusterIP, restored.Spec.Type)
+	assert.Equal(t, map[string]string{"app.kubernetes.io/name": "rstudio"}, restored.Spec.Selector)
+	assert.Equal(t, coreAPI.ServiceAffinityClientIP, restored.Spec.SessionAffinity)
+	if assert.Len(t, restored.Spec.Ports, 2) {
+		assert.Equal(t, int32(8080), restored.Spec.Ports[0].Port)
+		assert.Equal(t, intstr.FromString("http"), restored.Spec.Ports[0].TargetPort)
+		assert.Equal(t, "metrics", restored.Spec.Ports[1].Name)
+	}
+	// XXX fake patch doesn't remove map keys or fields
+	patch, _ := serviceSpecPatch(&service, &restored.Spec)
+	assert.Contains(t, string(patch), `{"op":"remove","path":"/spec/externalName"}`)
+	assert.Contains(t, string(patch), `{"op":"remove","path":"/metadata/annotations/mojanalytics.xyz~1service-spec-when-unidled"}`)
+
+	// Nothing to remove once redirected
+	service.Spec.ExternalName = ""
+	patch, _ = serviceSpecPatch(&service, &restored.Spec)
+	assert.NotContains(t, string(patch), `"/spec/externalName"`)
+}
+
+func TestServiceSpecWhenUnidledIgnoresInvalidSnapshot(t *testing.T) {
+	dep := Deployment{}
+	for _, snapshot := range []string{`not json`, `{"type": "ExternalName", "ports": [{"port": 80}]}`, `{"type": "ClusterIP"}`} {
+		service := Service{ObjectMeta: metaAPI.ObjectMeta{
+			Labels:      map[string]string{"app": NAME},
+			Annotations: map[string]string{ServiceSpecWhenUnidledAnnotation: snapshot},
+		}}
+		a := &App{host: HOST, workload: &dep, service: &service, logger: app.logger}
+
+		spec, source := a.ServiceSpecWhenUnidled()
+		assert.Equal(t, ServiceSpecFromWorkload, source, snapshot)
+		assert.Equal(t, int32(DEFAULT_SERVICE_PORT), spec.Ports[0].Port, snapshot)
+	}
+}
+
+func TestInferServiceSpec(t *testing.T) {
+	dep := &Deployment{Spec: appsAPI.DeploymentSpec{
+		Selector: &metaAPI.LabelSelector{MatchLabels: map[string]string{"app.kubernetes.io/name": "rstudio"}},
+		Template: coreAPI.PodTemplateSpec{Spec: coreAPI.PodSpec{Containers: []coreAPI.Container{
+			{Ports: []coreAPI.ContainerPort{{Name: "http", ContainerPort: 8787, Protocol: coreAPI.ProtocolTCP}}},
+			{Ports: []coreAPI.ContainerPort{{ContainerPort: 9090}}},
+		}}},
+	}}
+	svc := &Service{ObjectMeta: metaAPI.ObjectMeta{Labels: map[string]string{"app": NAME}}}
+
+	// The port the Ingress sends the requests to is kept
+	spec := inferServiceSpec(dep, svc, &IngressBackend{ServiceName: NAME, ServicePort: intstr.FromInt(80)})
+	assert.Equal(t, coreAPI.ServiceTypeClusterIP, spec.Type)
+	assert.Equal(t, dep.Spec.Selector.MatchLabels, spec.Selector)
+	assert.Equal(t, []coreAPI.ServicePort{
+		{Name: "http", Protocol: coreAPI.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt(8787)},
+		{Name: "port-9090", Port: 9090, TargetPort: intstr.FromInt(9090)},
+	}, spec.Ports)
+
+	spec = inferServiceSpec(dep, svc, &IngressBackend{ServiceName: NAME, ServicePort: intstr.FromString("http")})
+	assert.Equal(t, int32(8787), spec.Ports[0].Port)
+
+	// Without container ports, the legacy port is used
+	spec = inferServiceSpec(&Deployment{}, svc, nil)
+	assert.Equal(t, map[string]string{"app": NAME}, spec.Selector)
+	assert.Equal(t, []coreAPI.ServicePort{{Port: 80, TargetPort: intstr.FromInt(3000)}}, spec.Ports)
+}
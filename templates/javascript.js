@@ -2,8 +2,14 @@
 (function () {
   // Delay before redirecting to unidled app
   var DELAY = 5000;
-  var url = '/events/';
+  // The events are requested on the page's path, which the Ingress of the app
+  // routes to the unidler, and told apart by the `Accept` header
+  var url = window.location.pathname;
   var message = document.getElementById("message");
+  var progress = document.getElementById("progress");
+  var podsList = document.getElementById("pods");
+  var componentsList = document.getElementById("components");
+  var wakeForm = document.getElementById("wake");
 
   var urlparams = new URLSearchParams(window.location.search);
   var host = urlparams.get("host");
@@ -13,34 +19,121 @@
   var source = new EventSource(url);
 
   function redirect() {
-    window.location.href = "https://{{.}}/";
+    window.location.href = "{{.RedirectURL}}";
   }
 
   function showMessage(msg) {
-    message.innerHTML = msg;
+    message.textContent = msg;
   }
 
-  function showFinalState(finalState, finalMessage) {
+  function showProgress(update) {
+    progress.max = update.step_total;
+    progress.value = update.step === "done" ? update.step_total : update.step_index - 1;
+  }
+
+  function showPods(pods) {
+    podsList.innerHTML = "";
+    (pods || []).forEach(function (pod) {
+      var containers = (pod.containers || []).map(function (c) {
+        return c.name + ": " + (c.reason || c.state);
+      });
+      var item = document.createElement("li");
+      item.textContent = pod.name + " (" + pod.phase + ")" +
+        (containers.length ? " - " + containers.join(", ") : "");
+      podsList.appendChild(item);
+    });
+  }
+
+  // The workloads of an app group, in the order they're started
+  function showComponents(components) {
+    componentsList.innerHTML = "";
+    (components || []).forEach(function (component) {
+      var item = document.createElement("li");
+      item.textContent = component.name + " (" + component.kind + "): " + component.state;
+      componentsList.appendChild(item);
+    });
+  }
+
+  // How long the unidled app is guaranteed to stay up, in the user's time
+  function showUpUntil(upUntil) {
+    var time = new Date(upUntil);
+    if (isNaN(time.getTime())) {
+      return;
+    }
+    document.getElementById("up-until-time").textContent = time.toLocaleTimeString([], {hour: "2-digit", minute: "2-digit"});
+    document.getElementById("up-until").classList.remove("moj-hidden");
+  }
+
+  // The time the user chooses to keep the app up for is posted on the page's
+  // URL too, while the unidler still serves it
+  function chooseWake(e) {
+    e.preventDefault();
+    var wakeMessage = document.getElementById("wake-message");
+    var request = new XMLHttpRequest();
+    request.open("POST", window.location.pathname + window.location.search);
+    request.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+    request.onload = function () {
+      wakeMessage.textContent = parse(request.responseText).message;
+    };
+    request.send("wake_for=" + encodeURIComponent(document.getElementById("wake-for").value));
+  }
+
+  // Messages data is a JSON progress update
+  function parse(data) {
+    try {
+      return JSON.parse(data);
+    } catch (err) {
+      return {message: data};
+    }
+  }
+
+  function showUpdate(update) {
+    showMessage(update.message);
+    if (update.step_total) {
+      showProgress(update);
+    }
+    if (update.components) {
+      showComponents(update.components);
+    }
+    showPods(update.pods);
+  }
+
+  function showFinalState(finalState, update) {
     source.close();
+    if (wakeForm) {
+      wakeForm.classList.add("moj-hidden");
+    }
 
     var elem = document.getElementById(finalState);
     elem.classList.remove("moj-hidden");
 
-    showMessage(finalMessage);
+    showUpdate(update);
+    if (update.request_id) {
+      document.getElementById("request-id").textContent = update.request_id;
+      document.getElementById("reference").classList.remove("moj-hidden");
+    }
+  }
+
+  if (wakeForm) {
+    wakeForm.addEventListener("submit", chooseWake, false);
   }
 
   source.onmessage = function(e) {
-    showMessage(e.data);
+    showUpdate(parse(e.data));
   };
 
   source.onerror = function (e) {
     if (e.data !== undefined) {
-      showFinalState("failure", e.data);
+      showFinalState("failure", parse(e.data));
     }
   };
 
   source.addEventListener("success", function (e) {
-    showFinalState("success", e.data);
+    var update = parse(e.data);
+    showFinalState("success", update);
+    if (update.up_until) {
+      showUpUntil(update.up_until);
+    }
     window.setTimeout(redirect, DELAY);
   }, false);
 })();
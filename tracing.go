@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OpenTelemetry tracing, exporting the spans to an OTLP collector (OTLP/HTTP)
+// and configured using the standard `OTEL_*` environment variables.
+// See: https://opentelemetry.io/docs/specs/otel/configuration/sdk-environment-variables/
+
+// TraceParentHeader is the W3C Trace Context header used to propagate the
+// trace of the request which triggered the unidling (e.g. from the ingress
+// controller)
+const TraceParentHeader = "traceparent"
+
+const (
+	DEFAULT_OTEL_SERVICE_NAME = "unidler"
+	// TracerName is the instrumentation scope of the unidler's spans
+	TracerName = "github.com/ministryofjustice/analytics-platform-go-unidler"
+)
+
+var (
+	// tracer starts the spans with the global TracerProvider, which doesn't
+	// record them unless tracing is configured, see TracerProviderFromEnv
+	tracer = otel.Tracer(TracerName)
+	// propagator reads and writes the trace context in the W3C Trace Context
+	// headers
+	propagator = propagation.TraceContext{}
+)
+
+// traceParent returns the span context of the `traceparent` header of the
+// request, including whether it's sampled. It's invalid if the header is
+// missing or invalid
+func traceParent(req *http.Request) trace.SpanContext {
+	ctx := propagator.Extract(context.Background(), propagation.HeaderCarrier(req.Header))
+	return trace.SpanContextFromContext(ctx)
+}
+
+// Span is an operation of the unidling. All its methods can be called on a
+// nil Span (e.g. an App without a trace) and do nothing
+type Span struct {
+	span trace.Span
+	ctx  context.Context
+}
+
+// startTrace starts a new span, child of the given remote parent (if valid)
+// or else at the root of a new trace. It's sampled like its parent
+func startTrace(name string, parent trace.SpanContext) *Span {
+	ctx := context.Background()
+	if parent.IsValid() {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, parent)
+	}
+	ctx, span := tracer.Start(ctx, name)
+	return &Span{span: span, ctx: ctx}
+}
+
+// Child starts a new span, child of this one
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	ctx, span := tracer.Start(s.ctx, name)
+	return &Span{span: span, ctx: ctx}
+}
+
+// Context returns the context of the span, to propagate its trace to the
+// requests made during the operation
+func (s *Span) Context() context.Context {
+	if s == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// SetAttributes sets the given attributes on the span, e.g. "namespace"
+func (s *Span) SetAttributes(fields Fields) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(attributes(fields)...)
+}
+
+// SetError marks the span as failed with the given error
+func (s *Span) SetError(err error) {
+	if s == nil {
+		return
+	}
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// Finish ends the span, which is then exported
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.span.End()
+}
+
+// TraceID returns the ID of the span's trace, as hex, or "" if there's none
+func (s *Span) TraceID() string {
+	if s == nil || !s.span.SpanContext().HasTraceID() {
+		return ""
+	}
+	return s.span.SpanContext().TraceID().String()
+}
+
+func attributes(fields Fields) []attribute.KeyValue {
+	kvs := []attribute.KeyValue{}
+	for k, v := range fields {
+		switch v := v.(type) {
+		case string:
+			kvs = append(kvs, attribute.String(k, v))
+		case bool:
+			kvs = append(kvs, attribute.Bool(k, v))
+		case int:
+			kvs = append(kvs, attribute.Int(k, v))
+		case int32:
+			kvs = append(kvs, attribute.Int64(k, int64(v)))
+		case int64:
+			kvs = append(kvs, attribute.Int64(k, v))
+		case float64:
+			kvs = append(kvs, attribute.Float64(k, v))
+		default:
+			kvs = append(kvs, attribute.String(k, fmt.Sprint(v)))
+		}
+	}
+	return kvs
+}
+
+// tracingTransport sends the trace context of the requests (see
+// Span.Context) in their headers, so that the servers downstream (e.g. the
+// kubernetes API) can add to the trace
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !trace.SpanContextFromContext(req.Context()).IsValid() {
+		return t.next.RoundTrip(req)
+	}
+	// NOTE: A RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	propagator.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	return t.next.RoundTrip(req)
+}
+
+// TracerProviderFromEnv configures a TracerProvider exporting the spans to an
+// OTLP collector, using the standard OpenTelemetry environment variables.
+// Tracing is disabled (nil) unless an OTLP endpoint is set (or
+// `OTEL_TRACES_EXPORTER=otlp`)
+func TracerProviderFromEnv(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	exporter := os.Getenv("OTEL_TRACES_EXPORTER")
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+
+	if exporter != "" && exporter != "otlp" && exporter != "none" {
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER '%s', only 'otlp' and 'none' are supported", exporter)
+	}
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" || exporter == "none" || (endpoint == "" && exporter != "otlp") {
+		return nil, nil
+	}
+
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol != "" && !strings.HasPrefix(protocol, "http/") {
+		logger.Info("OTLP protocol '%s' not supported. Using 'http/protobuf'.", protocol)
+	}
+
+	// NOTE: The endpoint, headers and timeout are read from the environment
+	//       by the exporter, the batching settings by the span processor
+	client, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating OTLP exporter: %s", err)
+	}
+
+	defaults := resource.NewSchemaless(attribute.String("service.name", DEFAULT_OTEL_SERVICE_NAME))
+	fromEnv, err := resource.New(ctx, resource.WithFromEnv())
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTEL_RESOURCE_ATTRIBUTES: %s", err)
+	}
+	res, err := resource.Merge(defaults, fromEnv)
+	if err != nil {
+		return nil, fmt.Errorf("failed merging resource attributes: %s", err)
+	}
+
+	if endpoint == "" {
+		endpoint = "http://localhost:4318"
+	}
+	logger.Info("Exporting traces to %s.", endpoint)
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(client),
+		sdktrace.WithResource(res),
+	), nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	collectorAPI "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+
+	appsAPI "k8s.io/api/apps/v1"
+)
+
+// withSpanRecorder sets up a tracer recording the spans in memory for the
+// duration of the test
+func withSpanRecorder(t *testing.T) (*tracetest.SpanRecorder, func()) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := tracer
+	tracer = provider.Tracer(TracerName)
+	return recorder, func() { tracer = previous }
+}
+
+// endedSpan returns the last span ended with the given name, nil if none
+func endedSpan(recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	spans := recorder.Ended()
+	for i := len(spans) - 1; i >= 0; i-- {
+		if spans[i].Name() == name {
+			return spans[i]
+		}
+	}
+	return nil
+}
+
+// spanAttribute returns the value of the span's attribute, nil if not set
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) interface{} {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value.AsInterface()
+		}
+	}
+	return nil
+}
+
+func TestAppOperationsAreTraced(t *testing.T) {
+	recorder, restore := withSpanRecorder(t)
+	defer restore()
+
+	req := httptest.NewRequest("GET", "/events/", nil)
+	req.Header.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	root := startTrace("unidle", traceParent(req))
+
+	a, err := NewApp(HOST, "/", logger, root)
+	assert.Nil(t, err)
+
+	// Deployment already available, with its own namespace
+	const ns = "tracing-ns"
+	dep := mockDeployment(k8sClient, ns, NAME, HOST)
+	dep.Status.AvailableReplicas = 1
+	status := appsAPI.Deployment(dep)
+	k8sClient.Apps().Deployments(ns).UpdateStatus(&status)
+	a.workload, a.group = &dep, nil
+	assert.Nil(t, a.SetReplicas())
+	assert.Nil(t, a.WaitForWorkload(func(*Update) {}))
+	root.Finish()
+
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.TraceID())
+	unidle := endedSpan(recorder, "unidle")
+	if !assert.NotNil(t, unidle) {
+		return
+	}
+	assert.Equal(t, "00f067aa0ba902b7", unidle.Parent().SpanID().String())
+	assert.True(t, unidle.Parent().IsRemote())
+	assert.Equal(t, NS, spanAttribute(unidle, "namespace"))
+	assert.Equal(t, NAME, spanAttribute(unidle, "app"))
+
+	for _, name := range []string{"GetIngress", "GetWorkload", "GetService", "SetReplicas", "WaitForWorkload"} {
+		span := endedSpan(recorder, name)
+		if assert.NotNil(t, span, "expected a %s span", name) {
+			assert.Equal(t, unidle.SpanContext().TraceID(), span.SpanContext().TraceID())
+			assert.Equal(t, unidle.SpanContext().SpanID(), span.Parent().SpanID())
+			assert.Equal(t, HOST, spanAttribute(span, "host"))
+			assert.Equal(t, codes.Unset, span.Status().Code)
+		}
+	}
+	assert.Equal(t, NS, spanAttribute(endedSpan(recorder, "GetWorkload"), "namespace"))
+	assert.Equal(t, NAME, spanAttribute(endedSpan(recorder, "GetService"), "app"))
+	assert.Equal(t, int64(1), spanAttribute(endedSpan(recorder, "SetReplicas"), "replicas.desired"))
+	assert.Equal(t, int64(1), spanAttribute(endedSpan(recorder, "WaitForWorkload"), "replicas.available"))
+}
+
+func TestFailedOperationSpanHasError(t *testing.T) {
+	recorder, restore := withSpanRecorder(t)
+	defer restore()
+
+	root := startTrace("unidle", trace.SpanContext{})
+	a := &App{host: "unknown-tool.example.com", logger: logger, span: root}
+	_, err := a.GetIngress()
+	assert.NotNil(t, err)
+
+	span := endedSpan(recorder, "GetIngress")
+	if assert.NotNil(t, span) {
+		assert.Equal(t, codes.Error, span.Status().Code)
+		assert.Equal(t, err.Error(), span.Status().Description)
+		assert.True(t, span.Parent().IsValid())
+	}
+}
+
+func TestUnsampledTraceIsNotRecorded(t *testing.T) {
+	recorder, restore := withSpanRecorder(t)
+	defer restore()
+
+	req := httptest.NewRequest("GET", "/events/", nil)
+	req.Header.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	root := startTrace("unidle", traceParent(req))
+	root.Child("GetIngress").Finish()
+	root.Finish()
+
+	assert.Empty(t, recorder.Ended())
+	// The trace is still propagated (unsampled) downstream
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.TraceID())
+}
+
+func TestNilSpanDoesNothing(t *testing.T) {
+	var span *Span
+
+	span.SetAttributes(Fields{"namespace": NS})
+	span.SetError(errors.New("boom"))
+	assert.Nil(t, span.Child("GetIngress"))
+	assert.Equal(t, context.Background(), span.Context())
+	assert.Equal(t, "", span.TraceID())
+	span.Finish()
+}
+
+func TestSpansNotRecordedWhenTracingDisabled(t *testing.T) {
+	// NOTE: The global TracerProvider is a no-op one, as in main when
+	//       tracing isn't configured
+	span := startTrace("unidle", trace.SpanContext{})
+	assert.False(t, span.span.IsRecording())
+	assert.Equal(t, "", span.TraceID())
+	span.Child("GetIngress").Finish()
+	span.Finish()
+}
+
+func TestTraceParent(t *testing.T) {
+	testCases := []struct {
+		header  string
+		valid   bool
+		sampled bool
+	}{
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", valid: true, sampled: true},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", valid: true, sampled: false},
+		{header: "", valid: false},
+		{header: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", valid: false},
+		{header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", valid: false},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", valid: false},
+		{header: "00-not-hex-01", valid: false},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/events/", nil)
+		req.Header.Set(TraceParentHeader, tc.header)
+		parent := traceParent(req)
+		assert.Equal(t, tc.valid, parent.IsValid(), tc.header)
+		assert.Equal(t, tc.sampled, parent.IsSampled(), tc.header)
+	}
+}
+
+func TestTracingTransportSendsTraceParent(t *testing.T) {
+	_, restore := withSpanRecorder(t)
+	defer restore()
+
+	received := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Get(TraceParentHeader)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &tracingTransport{next: http.DefaultTransport}}
+
+	span := startTrace("unidle", trace.SpanContext{})
+	defer span.Finish()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := client.Do(req.WithContext(span.Context()))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Contains(t, <-received, "00-"+span.TraceID()+"-")
+	assert.Empty(t, req.Header.Get(TraceParentHeader), "expected request not modified")
+
+	// Requests without a trace are sent as they are
+	resp, err = client.Get(server.URL)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "", <-received)
+}
+
+func TestTracerProviderFromEnvExportsOTLP(t *testing.T) {
+	received := make(chan *collectorAPI.ExportTraceServiceRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/v1/traces", req.URL.Path)
+		assert.Equal(t, "application/x-protobuf", req.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", req.Header.Get("Authorization"))
+		body, _ := ioutil.ReadAll(req.Body)
+		request := &collectorAPI.ExportTraceServiceRequest{}
+		assert.Nil(t, proto.Unmarshal(body, request))
+		received <- request
+	}))
+	defer server.Close()
+
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", server.URL)
+	os.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=secret")
+	os.Setenv("OTEL_SERVICE_NAME", "test-unidler")
+	defer func() {
+		for _, name := range []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_HEADERS", "OTEL_SERVICE_NAME"} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	provider, err := TracerProviderFromEnv(context.Background())
+	if !assert.Nil(t, err) || !assert.NotNil(t, provider) {
+		return
+	}
+	previous := tracer
+	tracer = provider.Tracer(TracerName)
+	defer func() { tracer = previous }()
+
+	span := startTrace("unidle", trace.SpanContext{})
+	span.SetAttributes(Fields{"namespace": NS, "replicas.desired": int32(2)})
+	span.SetError(errors.New("boom"))
+	span.Finish()
+
+	// Spans still buffered are exported on shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, provider.Shutdown(ctx))
+
+	var request *collectorAPI.ExportTraceServiceRequest
+	select {
+	case request = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("spans not exported")
+	}
+
+	resourceSpans := request.GetResourceSpans()
+	if !assert.Len(t, resourceSpans, 1) {
+		return
+	}
+	resourceAttributes := map[string]string{}
+	for _, kv := range resourceSpans[0].GetResource().GetAttributes() {
+		resourceAttributes[kv.GetKey()] = kv.GetValue().GetStringValue()
+	}
+	assert.Equal(t, "test-unidler", resourceAttributes["service.name"])
+
+	exported := resourceSpans[0].GetScopeSpans()[0].GetSpans()
+	if !assert.Len(t, exported, 1) {
+		return
+	}
+	assert.Equal(t, "unidle", exported[0].GetName())
+	assert.Equal(t, span.TraceID(), trace.TraceID(exported[0].GetTraceId()).String())
+	assert.Equal(t, "boom", exported[0].GetStatus().GetMessage())
+	for _, kv := range exported[0].GetAttributes() {
+		switch kv.GetKey() {
+		case "namespace":
+			assert.Equal(t, NS, kv.GetValue().GetStringValue())
+		case "replicas.desired":
+			assert.Equal(t, int64(2), kv.GetValue().GetIntValue())
+		}
+	}
+	assert.Len(t, exported[0].GetAttributes(), 2)
+}
+
+func TestTracerProviderFromEnvDisabledByDefault(t *testing.T) {
+	provider, err := TracerProviderFromEnv(context.Background())
+	assert.Nil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestTracerProviderFromEnvUnsupportedExporter(t *testing.T) {
+	os.Setenv("OTEL_TRACES_EXPORTER", "zipkin")
+	defer os.Unsetenv("OTEL_TRACES_EXPORTER")
+
+	_, err := TracerProviderFromEnv(context.Background())
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	coreAPI "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+// Names of the traffic switches, used in `TrafficSwitchAnnotation`
+const (
+	TrafficSwitchService   = "service"
+	TrafficSwitchIngress   = "ingress"
+	TrafficSwitchHTTPRoute = "httproute"
+)
+
+const (
+	// TrafficSwitchAnnotation is a workload annotation selecting how the
+	// app's traffic is moved from the unidler back to the app
+	TrafficSwitchAnnotation = "mojanalytics.xyz/traffic-switch"
+	// IngressClassAnnotation is the (legacy) class of an Ingress
+	IngressClassAnnotation = "kubernetes.io/ingress.class"
+	// IngressClassWhenUnidledAnnotation contains the class the app's Ingress
+	// had before being idled, when the idler disabled it
+	IngressClassWhenUnidledAnnotation = "mojanalytics.xyz/ingress-class-when-unidled"
+	// HTTPRouteAnnotation is a workload annotation with the name of the
+	// app's HTTPRoute, when it's not the name of the app's Service
+	HTTPRouteAnnotation = "mojanalytics.xyz/httproute"
+)
+
+const (
+	DEFAULT_TRAFFIC_SWITCH      = TrafficSwitchService
+	DEFAULT_GATEWAY_API_VERSION = "gateway.networking.k8s.io/v1"
+	// DEFAULT_BACKEND_PORT is the port of the app's Service the traffic is
+	// sent to when it has no ports
+	DEFAULT_BACKEND_PORT = 80
+	// DEFAULT_INGRESS_UNIDLER_SERVICE is the name of the Service the
+	// Ingress backends of idled apps point to
+	DEFAULT_INGRESS_UNIDLER_SERVICE = UnidlerName
+)
+
+var (
+	// DefaultTrafficSwitch is used for the apps without the
+	// `TrafficSwitchAnnotation` annotation
+	DefaultTrafficSwitch = DEFAULT_TRAFFIC_SWITCH
+	// IngressUnidlerService is the name of the Service, in each app's
+	// namespace, the `ingress` traffic switch points the Ingress backends of
+	// idled apps to (e.g. an ExternalName Service of the unidler). Ingress
+	// backends can't refer to Services in other namespaces
+	IngressUnidlerService = DEFAULT_INGRESS_UNIDLER_SERVICE
+	// trafficSwitches are the available traffic switches, by name. The
+	// HTTPRoute switch requires the REST client, see main
+	trafficSwitches = map[string]TrafficSwitch{
+		TrafficSwitchService:   &serviceSwitch{},
+		TrafficSwitchIngress:   &ingressSwitch{},
+		TrafficSwitchHTTPRoute: &httpRouteSwitch{version: DEFAULT_GATEWAY_API_VERSION, namespace: UnidlerNs},
+	}
+)
+
+// TrafficSwitch moves the traffic of an app from the unidler, where the
+// idler sent it, back to the app. The built-in idler uses it the other way
+// round
+type TrafficSwitch interface {
+	// Name is the name of the TrafficSwitch in the annotation
+	Name() string
+	SwitchToApp(a *App) error
+	SwitchToUnidler(a *App) error
+}
+
+// TrafficSwitch returns the TrafficSwitch of the App, selected by its
+// workload's annotation
+func (a *App) TrafficSwitch() (TrafficSwitch, error) {
+	name, ok := a.workload.GetAnnotations()[TrafficSwitchAnnotation]
+	if !ok {
+		name = DefaultTrafficSwitch
+	}
+	switcher, ok := trafficSwitches[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown traffic switch '%s' in '%s' annotation", name, TrafficSwitchAnnotation)
+	}
+	return switcher, nil
+}
+
+// SwitchTraffic moves the App's traffic from the unidler back to the app
+// using its TrafficSwitch
+func (a *App) SwitchTraffic() error {
+	switcher, err := a.TrafficSwitch()
+	if err != nil {
+		a.logError(err, "Invalid traffic switch.")
+		return fmt.Errorf("Failed to redirect back your app.")
+	}
+	a.log("Switching traffic back to the app with the %s traffic switch.", switcher.Name())
+	return switcher.SwitchToApp(a)
+}
+
+// SwitchTrafficToUnidler moves the App's traffic to the unidler using its
+// TrafficSwitch, so that the next request unidles it
+func (a *App) SwitchTrafficToUnidler() error {
+	switcher, err := a.TrafficSwitch()
+	if err != nil {
+		a.logError(err, "Invalid traffic switch.")
+		return fmt.Errorf("Failed to redirect your app to the unidler.")
+	}
+	a.log("Switching traffic to the unidler with the %s traffic switch.", switcher.Name())
+	return switcher.SwitchToUnidler(a)
+}
+
+// backendPort returns the port of the App's Service the traffic is sent to
+func (a *App) backendPort() int32 {
+	if len(a.service.Spec.Ports) > 0 {
+		return a.service.Spec.Ports[0].Port
+	}
+	return DEFAULT_BACKEND_PORT
+}
+
+// serviceSwitch redirects the app's Service, an ExternalName Service of the
+// unidler while idled, back to the app's pods. See App.RedirectService
+type serviceSwitch struct{}
+
+func (s *serviceSwitch) Name() string {
+	return TrafficSwitchService
+}
+
+func (s *serviceSwitch) SwitchToApp(a *App) error {
+	return a.RedirectService()
+}
+
+func (s *serviceSwitch) SwitchToUnidler(a *App) error {
+	return a.RedirectToUnidler()
+}
+
+// ingressSwitch restores the app's Ingress, whose class was disabled or whose
+// backends were the unidler's Service (IngressUnidlerService) while idled
+type ingressSwitch struct{}
+
+func (s *ingressSwitch) Name() string {
+	return TrafficSwitchIngress
+}
+
+func (s *ingressSwitch) SwitchToApp(a *App) (err error) {
+	span := a.startSpan("SwitchIngress")
+	span.SetAttributes(Fields{"ingress": a.ingress.Name})
+	defer func() { finishSpan(span, err) }()
+
+	patch := ingressSwitchPatch(a.ingress, ingressClient.APIVersion(), a.service.Name, a.backendPort())
+	if len(patch) == 0 {
+		a.log("Ingress doesn't send the traffic to the unidler. Assuming it's already switched back.")
+		return nil
+	}
+	encoded, err := json.Marshal(patch)
+	if err != nil {
+		a.logError(err, "Failed to build Ingress patch.")
+		return fmt.Errorf("Failed to redirect back your app.")
+	}
+
+	start := time.Now()
+	err = ingressClient.Patch(a.ingress.Namespace, a.ingress.Name, encoded)
+	observeKubernetesRequest("patch", "ingresses", start, err)
+	if err != nil {
+		a.logError(err, "Patch to Ingress failed.")
+		return fmt.Errorf("Failed to redirect back your app.")
+	}
+
+	a.log("Successfully switched Ingress back to the app.")
+	a.RecordWorkloadEvent(coreAPI.EventTypeNormal, EventTrafficSwitched, "Switched Ingress %s back to the app.", a.ingress.Name)
+	return nil
+}
+
+func (s *ingressSwitch) SwitchToUnidler(a *App) (err error) {
+	if a.ingress == nil {
+		a.logError(fmt.Errorf("no Ingress routes to the app"), "Ingress can't be switched.")
+		return fmt.Errorf("Failed to redirect your app to the unidler.")
+	}
+	span := a.startSpan("SwitchIngressToUnidler")
+	span.SetAttributes(Fields{"ingress": a.ingress.Name})
+	defer func() { finishSpan(span, err) }()
+
+	patch := ingressUnidlerPatch(a.ingress, ingressClient.APIVersion(), a.service.Name)
+	if len(patch) == 0 {
+		a.log("Ingress doesn't send the traffic to the app's Service. Assuming it's already switched to the unidler.")
+		return nil
+	}
+	// The app would be unreachable if the Ingress sent its traffic to a
+	// Service which doesn't exist
+	_, err = findServiceByName(a.ingress.Namespace, IngressUnidlerService)
+	if err != nil {
+		a.logError(err, "Ingress can't be switched to the unidler's Service %s.", IngressUnidlerService)
+		return fmt.Errorf("Failed to redirect your app to the unidler.")
+	}
+	encoded, err := json.Marshal(patch)
+	if err != nil {
+		a.logError(err, "Failed to build Ingress patch.")
+		return fmt.Errorf("Failed to redirect your app to the unidler.")
+	}
+
+	start := time.Now()
+	err = ingressClient.Patch(a.ingress.Namespace, a.ingress.Name, encoded)
+	observeKubernetesRequest("patch", "ingresses", start, err)
+	if err != nil {
+		a.logError(err, "Patch to Ingress failed.")
+		return fmt.Errorf("Failed to redirect your app to the unidler.")
+	}
+
+	a.log("Successfully switched Ingress to the unidler.")
+	a.RecordWorkloadEvent(coreAPI.EventTypeNormal, EventIdled, "Switched Ingress %s to the unidler.", a.ingress.Name)
+	return nil
+}
+
+// ingressSwitchPatch returns the JSON patch restoring the class of the
+// Ingress and pointing its backends which are the unidler's Service
+// (IngressUnidlerService) to the given Service. It's empty when there's nothing to switch
+func ingressSwitchPatch(ing *Ingress, version string, service string, port int32) []jsonPatchOperation {
+	patch := []jsonPatchOperation{}
+	if class, ok := ing.Annotations[IngressClassWhenUnidledAnnotation]; ok {
+		patch = append(patch,
+			jsonPatchOperation{Op: "add", Path: annotationPath(IngressClassAnnotation), Value: class},
+			jsonPatchOperation{Op: "remove", Path: annotationPath(IngressClassWhenUnidledAnnotation)},
+		)
+	}
+
+	backend := ingressBackendValue(version, service, port)
+	for i, rule := range ing.Rules {
+		for j, path := range rule.Paths {
+			if path.Backend.ServiceName == IngressUnidlerService {
+				patch = append(patch, jsonPatchOperation{Op: "replace", Path: fmt.Sprintf("/spec/rules/%d/http/paths/%d/backend", i, j), Value: backend})
+			}
+		}
+	}
+	if ing.DefaultBackend != nil && ing.DefaultBackend.ServiceName == IngressUnidlerService {
+		field := "backend"
+		if version == NetworkingV1 {
+			field = "defaultBackend"
+		}
+		patch = append(patch, jsonPatchOperation{Op: "replace", Path: "/spec/" + field, Value: backend})
+	}
+	return patch
+}
+
+// ingressUnidlerPatch returns the JSON patch pointing the backends of the
+// Ingress which are the given Service to the unidler's Service
+// (IngressUnidlerService), the mirror image of ingressSwitchPatch. It's empty
+// when there's nothing to switch
+func ingressUnidlerPatch(ing *Ingress, version string, service string) []jsonPatchOperation {
+	patch := []jsonPatchOperation{}
+	backend := ingressBackendValue(version, IngressUnidlerService, UnidlerPort)
+	for i, rule := range ing.Rules {
+		for j, path := range rule.Paths {
+			if path.Backend.ServiceName == service {
+				patch = append(patch, jsonPatchOperation{Op: "replace", Path: fmt.Sprintf("/spec/rules/%d/http/paths/%d/backend", i, j), Value: backend})
+			}
+		}
+	}
+	if ing.DefaultBackend != nil && ing.DefaultBackend.ServiceName == service {
+		field := "backend"
+		if version == NetworkingV1 {
+			field = "defaultBackend"
+		}
+		patch = append(patch, jsonPatchOperation{Op: "replace", Path: "/spec/" + field, Value: backend})
+	}
+	return patch
+}
+
+// ingressBackendValue returns the JSON of an Ingress backend in the given API
+// version
+func ingressBackendValue(version string, service string, port int32) interface{} {
+	if version == NetworkingV1 {
+		return map[string]interface{}{
+			"service": map[string]interface{}{
+				"name": service,
+				"port": map[string]interface{}{"number": port},
+			},
+		}
+	}
+	return map[string]interface{}{"serviceName": service, "servicePort": port}
+}
+
+// httpRouteSwitch points the backendRefs of the app's Gateway API HTTPRoute
+// which are the unidler's Service back to the app's Service
+type httpRouteSwitch struct {
+	version string
+	client  rest.Interface
+	// namespace is the namespace of the unidler's Service. The HTTPRoutes
+	// refer to it across namespaces, which a ReferenceGrant in that
+	// namespace must allow
+	namespace string
+}
+
+// NewHTTPRouteSwitch constructs a new httpRouteSwitch using the given REST
+// client and Gateway API version, pointing the HTTPRoutes of idled apps to the
+// unidler's Service in the given namespace
+func NewHTTPRouteSwitch(client rest.Interface, version string, namespace string) *httpRouteSwitch {
+	return &httpRouteSwitch{version: version, client: client, namespace: namespace}
+}
+
+func (s *httpRouteSwitch) Name() string {
+	return TrafficSwitchHTTPRoute
+}
+
+func (s *httpRouteSwitch) path(namespace string, name string) string {
+	return fmt.Sprintf("/apis/%s/namespaces/%s/httproutes/%s", s.version, namespace, name)
+}
+
+// httpRoute is the part of an HTTPRoute which is switched
+type httpRoute struct {
+	Spec struct {
+		Rules []struct {
+			BackendRefs []map[string]interface{} `json:"backendRefs"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+// routeName returns the name of the App's HTTPRoute
+func (s *httpRouteSwitch) routeName(a *App) string {
+	name, ok := a.workload.GetAnnotations()[HTTPRouteAnnotation]
+	if !ok {
+		name = a.service.Name
+	}
+	return name
+}
+
+// get fetches the HTTPRoute with the given name in the App's namespace, in the
+// trace of the context
+func (s *httpRouteSwitch) get(ctx context.Context, a *App, name string) (*httpRoute, error) {
+	if s.client == nil {
+		return nil, fmt.Errorf("no REST client for the Gateway API")
+	}
+
+	start := time.Now()
+	body, err := s.client.Get().Context(ctx).AbsPath(s.path(a.workload.GetNamespace(), name)).DoRaw()
+	observeKubernetesRequest("get", "httproutes", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPRoute %s not found: %s", name, err)
+	}
+	route := &httpRoute{}
+	err = json.Unmarshal(body, route)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode HTTPRoute %s: %s", name, err)
+	}
+	return route, nil
+}
+
+// patch applies the JSON patch to the HTTPRoute with the given name in the
+// App's namespace, in the trace of the context
+func (s *httpRouteSwitch) patch(ctx context.Context, a *App, name string, patch []jsonPatchOperation) error {
+	encoded, err := json.Marshal(patch)
+	if err != nil {
+		return fmt.Errorf("failed to build HTTPRoute patch: %s", err)
+	}
+
+	start := time.Now()
+	err = s.client.Patch(types.JSONPatchType).Context(ctx).AbsPath(s.path(a.workload.GetNamespace(), name)).Body(encoded).Do().Error()
+	observeKubernetesRequest("patch", "httproutes", start, err)
+	if err != nil {
+		return fmt.Errorf("patch to HTTPRoute %s failed: %s", name, err)
+	}
+	return nil
+}
+
+func (s *httpRouteSwitch) SwitchToApp(a *App) (err error) {
+	name := s.routeName(a)
+	span := a.startSpan("SwitchHTTPRoute")
+	span.SetAttributes(Fields{"httproute": name})
+	defer func() { finishSpan(span, err) }()
+
+	route, err := s.get(span.Context(), a, name)
+	if err != nil {
+		a.logError(err, "HTTPRoute can't be switched.")
+		return fmt.Errorf("Failed to redirect back your app.")
+	}
+
+	patch := httpRouteSwitchPatch(route, a.service.Name, a.backendPort())
+	if len(patch) == 0 {
+		a.log("HTTPRoute %s doesn't send the traffic to the unidler. Assuming it's already switched back.", name)
+		return nil
+	}
+	err = s.patch(span.Context(), a, name, patch)
+	if err != nil {
+		a.logError(err, "HTTPRoute can't be switched.")
+		return fmt.Errorf("Failed to redirect back your app.")
+	}
+
+	a.log("Successfully switched HTTPRoute %s back to the app.", name)
+	a.RecordWorkloadEvent(coreAPI.EventTypeNormal, EventTrafficSwitched, "Switched HTTPRoute %s back to the app.", name)
+	return nil
+}
+
+func (s *httpRouteSwitch) SwitchToUnidler(a *App) (err error) {
+	name := s.routeName(a)
+	span := a.startSpan("SwitchHTTPRouteToUnidler")
+	span.SetAttributes(Fields{"httproute": name})
+	defer func() { finishSpan(span, err) }()
+
+	route, err := s.get(span.Context(), a, name)
+	if err != nil {
+		a.logError(err, "HTTPRoute can't be switched.")
+		return fmt.Errorf("Failed to redirect your app to the unidler.")
+	}
+
+	patch := httpRouteUnidlerPatch(route, a.service.Name, s.namespace)
+	if len(patch) == 0 {
+		a.log("HTTPRoute %s doesn't send the traffic to the app's Service. Assuming it's already switched to the unidler.", name)
+		return nil
+	}
+	err = s.patch(span.Context(), a, name, patch)
+	if err != nil {
+		a.logError(err, "HTTPRoute can't be switched.")
+		return fmt.Errorf("Failed to redirect your app to the unidler.")
+	}
+
+	a.log("Successfully switched HTTPRoute %s to the unidler.", name)
+	a.RecordWorkloadEvent(coreAPI.EventTypeNormal, EventIdled, "Switched HTTPRoute %s to the unidler.", name)
+	return nil
+}
+
+// httpRouteSwitchPatch returns the JSON patch pointing the backendRefs of the
+// HTTPRoute which are the unidler's Service to the given Service. Each one is
+// tested first, so that the patch fails if the HTTPRoute changed meanwhile.
+// It's empty when there's nothing to switch
+func httpRouteSwitchPatch(route *httpRoute, service string, port int32) []jsonPatchOperation {
+	patch := []jsonPatchOperation{}
+	for i, rule := range route.Spec.Rules {
+		for j, ref := range rule.BackendRefs {
+			if ref["name"] != UnidlerName || (ref["kind"] != nil && ref["kind"] != "Service") {
+				continue
+			}
+			switched := map[string]interface{}{"name": service, "port": port}
+			if weight, ok := ref["weight"]; ok {
+				switched["weight"] = weight
+			}
+			path := fmt.Sprintf("/spec/rules/%d/backendRefs/%d", i, j)
+			patch = append(patch,
+				jsonPatchOperation{Op: "test", Path: path, Value: ref},
+				jsonPatchOperation{Op: "replace", Path: path, Value: switched},
+			)
+		}
+	}
+	return patch
+}
+
+// httpRouteUnidlerPatch returns the JSON patch pointing the backendRefs of
+// the HTTPRoute which are the given Service to the unidler's Service in the
+// given namespace, the mirror image of httpRouteSwitchPatch. It's empty when
+// there's nothing to switch
+func httpRouteUnidlerPatch(route *httpRoute, service string, namespace string) []jsonPatchOperation {
+	patch := []jsonPatchOperation{}
+	for i, rule := range route.Spec.Rules {
+		for j, ref := range rule.BackendRefs {
+			if ref["name"] != service || (ref["kind"] != nil && ref["kind"] != "Service") {
+				continue
+			}
+			switched := map[string]interface{}{"name": UnidlerName, "namespace": namespace, "port": UnidlerPort}
+			if weight, ok := ref["weight"]; ok {
+				switched["weight"] = weight
+			}
+			path := fmt.Sprintf("/spec/rules/%d/backendRefs/%d", i, j)
+			patch = append(patch,
+				jsonPatchOperation{Op: "test", Path: path, Value: ref},
+				jsonPatchOperation{Op: "replace", Path: path, Value: switched},
+			)
+		}
+	}
+	return patch
+}
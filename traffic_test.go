@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	coreAPI "k8s.io/api/core/v1"
+	extAPI "k8s.io/api/extensions/v1beta1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const httpRouteJSON = `{
+	"metadata": {"name": "test", "namespace": "route-ns"},
+	"spec": {
+		"hostnames": ["test-tool.example.com"],
+		"rules": [{
+			"backendRefs": [
+				{"name": "unidler", "namespace": "default", "port": 80, "weight": 1},
+				{"name": "other", "port": 8080}
+			]
+		}]
+	}
+}`
+
+// patchesServer serves the given object and records the JSON patches sent
+func patchesServer(t *testing.T, object string) (*httptest.Server, *[]string) {
+	patches := &[]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "PATCH" {
+			assert.Equal(t, "application/json-patch+json", req.Header.Get("Content-Type"))
+			body, _ := ioutil.ReadAll(req.Body)
+			*patches = append(*patches, req.URL.Path+" "+string(body))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(object))
+	}))
+	return server, patches
+}
+
+func TestTrafficSwitchSelection(t *testing.T) {
+	dep := &Deployment{}
+	a := &App{host: HOST, workload: dep, logger: app.logger}
+	switcher, err := a.TrafficSwitch()
+	assert.Nil(t, err)
+	assert.Equal(t, TrafficSwitchService, switcher.Name())
+
+	dep.Annotations = map[string]string{TrafficSwitchAnnotation: TrafficSwitchIngress}
+	switcher, err = a.TrafficSwitch()
+	assert.Nil(t, err)
+	assert.Equal(t, TrafficSwitchIngress, switcher.Name())
+
+	dep.Annotations[TrafficSwitchAnnotation] = "unknown"
+	_, err = a.TrafficSwitch()
+	assert.Contains(t, err.Error(), "unknown traffic switch 'unknown'")
+	assert.Equal(t, "Failed to redirect back your app.", a.SwitchTraffic().Error())
+}
+
+func TestIngressSwitch(t *testing.T) {
+	const ns = "ingress-switch-ns"
+	created, _ := k8sClient.ExtensionsV1beta1().Ingresses(ns).Create(&extAPI.Ingress{
+		ObjectMeta: metaAPI.ObjectMeta{
+			Name: NAME,
+			Annotations: map[string]string{
+				IngressClassAnnotation:            "disabled",
+				IngressClassWhenUnidledAnnotation: "nginx",
+			},
+		},
+		Spec: extAPI.IngressSpec{Rules: []extAPI.IngressRule{{
+			Host: HOST,
+			IngressRuleValue: extAPI.IngressRuleValue{HTTP: &extAPI.HTTPIngressRuleValue{
+				Paths: []extAPI.HTTPIngressPath{{
+					Path:    "/",
+					Backend: extAPI.IngressBackend{ServiceName: UnidlerName, ServicePort: intstr.FromInt(80)},
+				}},
+			}},
+		}}},
+	})
+	dep := Deployment{ObjectMeta: metaAPI.ObjectMeta{
+		Namespace:   ns,
+		Name:        NAME,
+		Annotations: map[string]string{TrafficSwitchAnnotation: TrafficSwitchIngress},
+	}}
+	service := Service{
+		ObjectMeta: metaAPI.ObjectMeta{Namespace: ns, Name: NAME},
+		Spec:       coreAPI.ServiceSpec{Ports: []coreAPI.ServicePort{{Port: 8080}}},
+	}
+	a := &App{host: HOST, ingress: ingressFromExtensions(created), workload: &dep, service: &service, logger: app.logger}
+
+	err := a.SwitchTraffic()
+	assert.Nil(t, err)
+
+	switched, _ := k8sClient.ExtensionsV1beta1().Ingresses(ns).Get(NAME, metaAPI.GetOptions{})
+	assert.Equal(t, "nginx", switched.Annotations[IngressClassAnnotation])
+	assert.Equal(t, NAME, switched.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName)
+	assert.Equal(t, intstr.FromInt(8080), switched.Spec.Rules[0].HTTP.Paths[0].Backend.ServicePort)
+}
+
+func TestNetworkingIngressSwitchPatch(t *testing.T) {
+	server, patches := patchesServer(t, `{}`)
+	defer server.Close()
+	client := &networkingIngressClient{version: NetworkingV1, client: restClientFor(t, server)}
+
+	ing := &Ingress{
+		ObjectMeta:     metaAPI.ObjectMeta{Namespace: NS, Name: NAME},
+		DefaultBackend: &IngressBackend{ServiceName: UnidlerName},
+		Rules: []IngressRule{
+			{Host: "other.example.com"},
+			{Host: HOST, Paths: []IngressPath{
+				{Path: "/api", Backend: IngressBackend{ServiceName: "api"}},
+				{Path: "/", Backend: IngressBackend{ServiceName: UnidlerName}},
+			}},
+		},
+	}
+	patch, _ := json.Marshal(ingressSwitchPatch(ing, NetworkingV1, NAME, 80))
+	err := client.Patch(NS, NAME, patch)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		"/apis/networking.k8s.io/v1/namespaces/test-ns/ingresses/test " +
+			`[{"op":"replace","path":"/spec/rules/1/http/paths/1/backend","value":{"service":{"name":"test","port":{"number":80}}}},` +
+			`{"op":"replace","path":"/spec/defaultBackend","value":{"service":{"name":"test","port":{"number":80}}}}]`,
+	}, *patches)
+}
+
+func TestHTTPRouteSwitch(t *testing.T) {
+	server, patches := patchesServer(t, httpRouteJSON)
+	defer server.Close()
+
+	dep := Deployment{ObjectMeta: metaAPI.ObjectMeta{
+		Namespace: "route-ns",
+		Name:      NAME,
+		Annotations: map[string]string{
+			TrafficSwitchAnnotation: TrafficSwitchHTTPRoute,
+			HTTPRouteAnnotation:     "test-route",
+		},
+	}}
+	service := Service{ObjectMeta: metaAPI.ObjectMeta{Namespace: "route-ns", Name: NAME}}
+	a := &App{host: HOST, workload: &dep, service: &service, logger: app.logger}
+
+	err := NewHTTPRouteSwitch(restClientFor(t, server), "gateway.networking.k8s.io/v1", UnidlerNs).SwitchToApp(a)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		"/apis/gateway.networking.k8s.io/v1/namespaces/route-ns/httproutes/test-route " +
+			`[{"op":"test","path":"/spec/rules/0/backendRefs/0","value":{"name":"unidler","namespace":"default","port":80,"weight":1}},` +
+			`{"op":"replace","path":"/spec/rules/0/backendRefs/0","value":{"name":"test","port":80,"weight":1}}]`,
+	}, *patches)
+}
+
+func TestHTTPRouteSwitchWithoutUnidlerBackend(t *testing.T) {
+	route := &httpRoute{}
+	json.Unmarshal([]byte(`{"spec": {"rules": [{"backendRefs": [{"name": "test", "port": 80}]}]}}`), route)
+	assert.Empty(t, httpRouteSwitchPatch(route, NAME, 80))
+}
+
+func TestIngressSwitchIsReversedByUnidling(t *testing.T) {
+	const host = "ingress-idle.example.com"
+	const ns = "ingress-idle-ns"
+	labels := map[string]string{UnidleKeyLabel: unidleKey(host)}
+	client, restore := withResolvers(&labelResolver{})
+	defer restore()
+	mockApp(client, ns, "web", host, "/", labels)
+	client.AppsV1().Deployments(ns).Delete("web", nil)
+	idleableDeployment(client, ns, "web", 2, labels)
+	annotateDeployment(client, ns, "web", map[string]string{TrafficSwitchAnnotation: TrafficSwitchIngress})
+	client.CoreV1().Services(ns).Create(&coreAPI.Service{ObjectMeta: metaAPI.ObjectMeta{Namespace: ns, Name: IngressUnidlerService}})
+
+	a, err := NewApp(host, "/", logger, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, a.Idle())
+
+	ing, _ := client.ExtensionsV1beta1().Ingresses(ns).Get("web", metaAPI.GetOptions{})
+	assert.Equal(t, UnidlerName, ing.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName)
+	assert.Equal(t, intstr.FromInt(UnidlerPort), ing.Spec.Rules[0].HTTP.Paths[0].Backend.ServicePort)
+	// The Service is left alone
+	for _, action := range client.Actions() {
+		assert.False(t, action.GetVerb() == "patch" && action.GetResource().Resource == "services", "expected the Service not to be patched")
+	}
+
+	a, err = NewApp(host, "/", logger, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, a.SwitchTraffic())
+	ing, _ = client.ExtensionsV1beta1().Ingresses(ns).Get("web", metaAPI.GetOptions{})
+	assert.Equal(t, "web", ing.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName)
+}
+
+func TestIngressSwitchToMissingUnidlerServiceFails(t *testing.T) {
+	const host = "ingress-missing.example.com"
+	const ns = "ingress-missing-ns"
+	labels := map[string]string{UnidleKeyLabel: unidleKey(host)}
+	client, restore := withResolvers(&labelResolver{})
+	defer restore()
+	mockApp(client, ns, "web", host, "/", labels)
+	client.AppsV1().Deployments(ns).Delete("web", nil)
+	idleableDeployment(client, ns, "web", 2, labels)
+	annotateDeployment(client, ns, "web", map[string]string{TrafficSwitchAnnotation: TrafficSwitchIngress})
+
+	a, err := NewApp(host, "/", logger, nil)
+	assert.Nil(t, err)
+	err = a.Idle()
+
+	assert.Equal(t, "Failed to redirect your app to the unidler.", err.Error())
+	// The app keeps its traffic and its replicas
+	ing, _ := client.ExtensionsV1beta1().Ingresses(ns).Get("web", metaAPI.GetOptions{})
+	assert.Equal(t, "web", ing.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName)
+	replicas, _ := a.workload.Replicas()
+	assert.Equal(t, int32(2), replicas)
+}
+
+func TestHTTPRouteSwitchToUnidler(t *testing.T) {
+	server, patches := patchesServer(t, `{"spec": {"rules": [{"backendRefs": [{"name": "test", "port": 8080, "weight": 1}, {"name": "other", "port": 8080}]}]}}`)
+	defer server.Close()
+
+	dep := Deployment{ObjectMeta: metaAPI.ObjectMeta{Namespace: "route-ns", Name: NAME}}
+	service := Service{ObjectMeta: metaAPI.ObjectMeta{Namespace: "route-ns", Name: NAME}}
+	a := &App{host: HOST, workload: &dep, service: &service, logger: app.logger}
+
+	err := NewHTTPRouteSwitch(restClientFor(t, server), "gateway.networking.k8s.io/v1", "unidler-ns").SwitchToUnidler(a)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		"/apis/gateway.networking.k8s.io/v1/namespaces/route-ns/httproutes/test " +
+			`[{"op":"test","path":"/spec/rules/0/backendRefs/0","value":{"name":"test","port":8080,"weight":1}},` +
+			`{"op":"replace","path":"/spec/rules/0/backendRefs/0","value":{"name":"unidler","namespace":"unidler-ns","port":80,"weight":1}}]`,
+	}, *patches)
+}
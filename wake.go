@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	coreAPI "k8s.io/api/core/v1"
+)
+
+const (
+	// WakeExpiresLabel is a metadata label which indicates the workload
+	// stays up for the time chosen by the user, until WakeExpiresAtAnnotation
+	WakeExpiresLabel = "mojanalytics.xyz/wake-expires"
+	// WakeExpiresAtAnnotation is a metadata annotation which indicates the
+	// time (UTC) the workload is idled again, eg: "2018-11-26T18:55:02"
+	WakeExpiresAtAnnotation = "mojanalytics.xyz/wake-expires-at"
+)
+
+const (
+	// DEFAULT_WAKE_DURATIONS are the times the user can choose to keep their
+	// app up for
+	DEFAULT_WAKE_DURATIONS = "1h,4h,8h"
+	// Interval between the checks of the apps whose wake expired
+	DEFAULT_WAKE_EXPIRY_INTERVAL = 1 * time.Minute
+)
+
+// WakeDurations are the times the user can choose to keep their app up for,
+// on the page shown while it's unidled, see `WAKE_DURATIONS`
+var WakeDurations = []time.Duration{1 * time.Hour, 4 * time.Hour, 8 * time.Hour}
+
+// DurationOption is one of the durations the user can choose on a page
+type DurationOption struct {
+	// Value is the duration, as in the configuration
+	Value string
+	// Label is the duration for humans, e.g. "4 hours"
+	Label string
+}
+
+// durationOptions returns the durations as options of a page
+func durationOptions(durations []time.Duration) []DurationOption {
+	options := []DurationOption{}
+	for _, duration := range durations {
+		options = append(options, DurationOption{Value: duration.String(), Label: humanDuration(duration)})
+	}
+	return options
+}
+
+// humanDuration formats the duration in days, hours or minutes, e.g.
+// "1 hour", "90 minutes" or "3 days"
+func humanDuration(d time.Duration) string {
+	value, unit := int64(d/time.Minute), "minute"
+	switch {
+	case d%(24*time.Hour) == 0:
+		value, unit = int64(d/(24*time.Hour)), "day"
+	case d%time.Hour == 0:
+		value, unit = int64(d/time.Hour), "hour"
+	}
+	if value != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", value, unit)
+}
+
+// WakeDurationsFromEnv parses the comma-separated durations in
+// `WAKE_DURATIONS`. The user can't choose how long their app stays up when
+// it's empty
+func WakeDurationsFromEnv() ([]time.Duration, error) {
+	return durationsFromEnv("WAKE_DURATIONS", DEFAULT_WAKE_DURATIONS)
+}
+
+// durationsFromEnv parses the comma-separated durations (of at least a
+// minute) in the given environment variable, defaulting to the given value
+// when not set
+func durationsFromEnv(name string, defaultValue string) ([]time.Duration, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		logger.Info("$%s not set. Defaulting to '%s'", name, defaultValue)
+		value = defaultValue
+	}
+
+	durations := []time.Duration{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(item)
+		if err != nil || duration < time.Minute {
+			return nil, fmt.Errorf("invalid duration '%s' in $%s, expected at least a minute", item, name)
+		}
+		durations = append(durations, duration)
+	}
+	return durations, nil
+}
+
+// chosenDuration returns the duration chosen by the user, which must be one
+// of the given durations
+func chosenDuration(value string, durations []time.Duration) (time.Duration, bool) {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, false
+	}
+	for _, d := range durations {
+		if d == duration {
+			return duration, true
+		}
+	}
+	return 0, false
+}
+
+// SetWakeExpiry records the time the App is idled again, chosen by the user,
+// on its workload. A zero time removes it: the App then stays up until it's
+// idled for other reasons
+func (a *App) SetWakeExpiry(expiresAt time.Time) (err error) {
+	span := a.startSpan("SetWakeExpiry")
+	defer func() { finishSpan(span, err) }()
+
+	patch := fmt.Sprintf(`{"metadata": {"annotations": {"%s": null}, "labels": {"%s": null}}}`, WakeExpiresAtAnnotation, WakeExpiresLabel)
+	if !expiresAt.IsZero() {
+		patch = fmt.Sprintf(
+			`{"metadata": {"annotations": {"%s": "%s"}, "labels": {"%s": "true"}}}`,
+			WakeExpiresAtAnnotation, expiresAt.UTC().Format(IdledAtFormat),
+			WakeExpiresLabel,
+		)
+	}
+	err = a.workload.PatchMetadata([]byte(patch))
+	if err != nil {
+		a.logError(err, "Patch to set wake expiry of %s failed.", a.describe(a.workload))
+		return fmt.Errorf("Failed to keep your app up for the time chosen.")
+	}
+
+	if expiresAt.IsZero() {
+		a.log("Successfully removed wake expiry.")
+		a.RecordWorkloadEvent(coreAPI.EventTypeNormal, EventWakeExpirySet, "Stays up until idled.")
+		return nil
+	}
+	a.log("Successfully set wake expiry to %s.", expiresAt.UTC().Format(IdledAtFormat))
+	a.RecordWorkloadEvent(coreAPI.EventTypeNormal, EventWakeExpirySet, "Idled again at %s (UTC), as chosen by the user.", expiresAt.UTC().Format(IdledAtFormat))
+	return nil
+}
+
+// wakeExpired returns true if the time chosen by the user to keep the
+// workload up for is over, according to its WakeExpiresAtAnnotation
+func wakeExpired(workload Workload, now time.Time) (bool, error) {
+	value, ok := workload.GetAnnotations()[WakeExpiresAtAnnotation]
+	if !ok {
+		return false, nil
+	}
+	expiresAt, err := time.Parse(IdledAtFormat, value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s annotation '%s': %s", WakeExpiresAtAnnotation, value, err)
+	}
+	return !now.Before(expiresAt), nil
+}
+
+// WakeExpirer idles the apps again once the time the user chose to keep them
+// up for is over. It runs in the background of the unidler
+type WakeExpirer struct {
+	interval time.Duration
+}
+
+// NewWakeExpirer constructs a new WakeExpirer
+func NewWakeExpirer(interval time.Duration) *WakeExpirer {
+	return &WakeExpirer{interval: interval}
+}
+
+// Start runs the WakeExpirer every interval, in the background, until the
+// channel is closed
+func (e *WakeExpirer) Start(stop <-chan struct{}) {
+	logger.Info("Starting wake expirer: workloads with %s checked every %s.", WakeExpiresLabel, e.interval)
+	go runEvery(e.interval, stop, func() { e.Run() })
+}
+
+// Run idles the apps whose wake expired, among the workloads of all the
+// `workloadKinds`. It returns the number of apps idled
+func (e *WakeExpirer) Run() int {
+	count := 0
+	now := time.Now().UTC()
+	for _, kind := range workloadKinds {
+		workloads, err := kind.List("", WakeExpiresLabel+"=true")
+		if err != nil {
+			logger.Error(err, "Wake expirer failed to list %s.", kind.Name())
+			continue
+		}
+
+		for _, workload := range workloads {
+			if e.expire(workload, now) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// expire idles the app of the workload, with its whole group, if its wake
+// expired and it's past its grace period (see inGracePeriod). It returns true
+// if it was idled
+func (e *WakeExpirer) expire(workload Workload, now time.Time) bool {
+	if _, ok := workload.GetLabels()[IdledLabel]; ok {
+		return false
+	}
+	log := logger.With(Fields{"namespace": workload.GetNamespace(), "workload": workload.GetName(), "kind": workloadKind(workload)})
+
+	expired, err := wakeExpired(workload, now)
+	if err != nil {
+		log.Error(err, "Wake expirer couldn't tell when the app expires.")
+		return false
+	}
+	if !expired {
+		return false
+	}
+	annotations := workload.GetAnnotations()
+	if pinned(workload, now) {
+		log.Info("App's wake expired but it's pinned until %s. Not idling it.", annotations[PinnedUntilAnnotation])
+		return false
+	}
+	// NOTE: The user was told the app stays up until the end of the grace
+	// period, even when they chose a shorter time
+	if inGracePeriod(workload, now) {
+		log.Info("App's wake expired but it was unidled at %s, less than %s ago. Not idling it yet.", annotations[UnidledAtAnnotation], UnidleGracePeriod)
+		return false
+	}
+
+	svc, err := workloadService(workload)
+	if err != nil {
+		log.Error(err, "Wake expirer couldn't find the Service of the workload.")
+		inc(idleFailures, workload.GetNamespace(), IdleTriggerWakeExpired)
+		return false
+	}
+	ok, err := idleWorkload(workload, svc, IdleTriggerWakeExpired, log, fmt.Sprintf("App's wake expired at %s. Idling it.", annotations[WakeExpiresAtAnnotation]))
+	if err != nil {
+		inc(idleFailures, workload.GetNamespace(), IdleTriggerWakeExpired)
+		return false
+	}
+	if ok {
+		inc(idled, workload.GetNamespace(), IdleTriggerWakeExpired)
+	}
+	return ok
+}
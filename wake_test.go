@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	appsAPI "k8s.io/api/apps/v1"
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWakeDurationsFromEnv(t *testing.T) {
+	defer os.Unsetenv("WAKE_DURATIONS")
+
+	durations, err := WakeDurationsFromEnv()
+	assert.Nil(t, err)
+	assert.Equal(t, []time.Duration{time.Hour, 4 * time.Hour, 8 * time.Hour}, durations)
+
+	os.Setenv("WAKE_DURATIONS", "")
+	durations, err = WakeDurationsFromEnv()
+	assert.Nil(t, err)
+	assert.Empty(t, durations)
+
+	os.Setenv("WAKE_DURATIONS", "30m, 2d")
+	_, err = WakeDurationsFromEnv()
+	assert.Equal(t, "invalid duration '2d' in $WAKE_DURATIONS, expected at least a minute", err.Error())
+}
+
+func TestDurationOptions(t *testing.T) {
+	defer func(durations []time.Duration) { WakeDurations = durations }(WakeDurations)
+	WakeDurations = []time.Duration{30 * time.Minute, time.Hour, 90 * time.Minute, 8 * time.Hour, 72 * time.Hour}
+
+	assert.Equal(t, []DurationOption{
+		{Value: "30m0s", Label: "30 minutes"},
+		{Value: "1h0m0s", Label: "1 hour"},
+		{Value: "1h30m0s", Label: "90 minutes"},
+		{Value: "8h0m0s", Label: "8 hours"},
+		{Value: "72h0m0s", Label: "3 days"},
+	}, durationOptions(WakeDurations))
+}
+
+func TestWakeHandler(t *testing.T) {
+	const host = "wake.example.com"
+	const ns = "user-waker"
+	labels := map[string]string{UnidleKeyLabel: unidleKey(host)}
+	client, restore := withResolvers(&labelResolver{})
+	defer restore()
+	mockApp(client, ns, "web", host, "/", labels)
+
+	post := func(value string, user string, origin string) *http.Request {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(url.Values{"wake_for": {value}}.Encode()))
+		req.Host = host
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		authenticate(req, user)
+		req.Header.Set("Origin", origin)
+		return req
+	}
+	send := func(req *http.Request) (*httptest.ResponseRecorder, WakeResponse) {
+		rec := httptest.NewRecorder()
+		appHandler(http.HandlerFunc(indexHandler)).ServeHTTP(rec, req)
+		response := WakeResponse{}
+		json.Unmarshal(rec.Body.Bytes(), &response)
+		return rec, response
+	}
+	wake := func(value string) (*httptest.ResponseRecorder, WakeResponse) {
+		return send(post(value, "Waker", "https://"+host))
+	}
+
+	// Only the signed-in owner of the app, on its page, can keep it up
+	rec, response := send(post("4h0m0s", "", "https://"+host))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec, response = send(post("4h0m0s", "alice", "https://"+host))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, "You can only keep up your own apps.", response.Message)
+	rec, _ = send(post("4h0m0s", "Waker", ""))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec, _ = send(post("4h0m0s", "Waker", "https://evil.example.com"))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	// The user's header (and `Origin`) set by the client, not the proxy
+	spoofed := post("4h0m0s", "Waker", "https://"+host)
+	spoofed.Header.Del(AuthProxySecretHeader)
+	rec, response = send(spoofed)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "You need to be signed in to keep your app up.", response.Message)
+	assert.Equal(t, 0, countActions(client, "patch"))
+
+	// Other posts get the page
+	req := post("4h0m0s", "Waker", "https://"+host)
+	req.Header.Set("Content-Type", "application/json")
+	rec, _ = send(req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+	assert.Equal(t, 0, countActions(client, "patch"))
+
+	rec, response = wake("3h")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "Your app can't be kept up for 3h.", response.Message)
+
+	rec, response = wake("4h0m0s")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "Your app will be idled again in 4 hours.", response.Message)
+	dep := getDeployment(ns, "web")
+	assert.Equal(t, "true", dep.Labels[WakeExpiresLabel])
+	expiresAt, err := time.Parse(IdledAtFormat, dep.Annotations[WakeExpiresAtAnnotation])
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(4*time.Hour), expiresAt, time.Minute)
+	assert.Equal(t, expiresAt.Format(time.RFC3339), response.ExpiresAt)
+
+	// NOTE: The fake patch doesn't remove, the patches are checked instead
+	patches := countActions(client, "patch")
+	rec, response = wake("")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, response.ExpiresAt)
+	assert.Equal(t, patches+1, countActions(client, "patch"))
+}
+
+func TestWakeExpirerIdlesExpiredApps(t *testing.T) {
+	const ns = "wake-expirer-ns"
+	client, restore := withResolvers()
+	defer restore()
+
+	for name, expiresIn := range map[string]time.Duration{"expired": -time.Minute, "awake": time.Hour} {
+		idleableDeployment(client, ns, name, 2, map[string]string{WakeExpiresLabel: "true"})
+		dep := getDeployment(ns, name)
+		dep.Annotations = map[string]string{WakeExpiresAtAnnotation: time.Now().UTC().Add(expiresIn).Format(IdledAtFormat)}
+		client.AppsV1().Deployments(ns).Update((*appsAPI.Deployment)(&dep))
+		client.CoreV1().Services(ns).Create(&coreAPI.Service{ObjectMeta: metaAPI.ObjectMeta{Namespace: ns, Name: name}})
+	}
+
+	expirer := NewWakeExpirer(time.Minute)
+	assert.Equal(t, 1, expirer.Run())
+
+	dep := getDeployment(ns, "expired")
+	assert.Equal(t, int32(0), *dep.Spec.Replicas)
+	assert.Equal(t, "true", dep.Labels[IdledLabel])
+	assert.Equal(t, "2", dep.Annotations[ReplicasWhenUnidledAnnotation])
+	svc, _ := client.CoreV1().Services(ns).Get("expired", metaAPI.GetOptions{})
+	assert.Equal(t, coreAPI.ServiceTypeExternalName, svc.Spec.Type)
+	assert.Equal(t, int32(2), *getDeployment(ns, "awake").Spec.Replicas)
+
+	// Once idled, the app isn't idled again
+	assert.Equal(t, 0, expirer.Run())
+}
+
+func TestWakeExpirerIdlesStatefulSetAppGroups(t *testing.T) {
+	const host = "wake-group.example.com"
+	const ns = "wake-group-ns"
+	labels := map[string]string{UnidleKeyLabel: unidleKey(host)}
+	client, restore := withResolvers(&labelResolver{})
+	defer restore()
+	// The app's workload is the StatefulSet, the Deployment is in its group
+	defer withWorkloadKinds(&statefulSetKind{}, &deploymentKind{})()
+	mockApp(client, ns, "web", host, "/", labels)
+	client.AppsV1().Deployments(ns).Delete("web", nil)
+	replicas := int32(1)
+	client.AppsV1().StatefulSets(ns).Create(&appsAPI.StatefulSet{
+		ObjectMeta: metaAPI.ObjectMeta{
+			Namespace:   ns,
+			Name:        "web",
+			Labels:      map[string]string{UnidleKeyLabel: unidleKey(host), WakeExpiresLabel: "true"},
+			Annotations: map[string]string{WakeExpiresAtAnnotation: time.Now().UTC().Add(-time.Minute).Format(IdledAtFormat)},
+		},
+		Spec: appsAPI.StatefulSetSpec{Replicas: &replicas},
+	})
+	idleableDeployment(client, ns, "worker", 1, labels)
+
+	expirer := NewWakeExpirer(time.Minute)
+	assert.Equal(t, 1, expirer.Run())
+
+	sts, _ := client.AppsV1().StatefulSets(ns).Get("web", metaAPI.GetOptions{})
+	assert.Equal(t, int32(0), *sts.Spec.Replicas)
+	assert.Equal(t, "true", sts.Labels[IdledLabel])
+	// The whole group is idled
+	worker := getDeployment(ns, "worker")
+	assert.Equal(t, int32(0), *worker.Spec.Replicas)
+	assert.Equal(t, "true", worker.Labels[IdledLabel])
+}
+
+func TestWakeExpirerHonoursGracePeriod(t *testing.T) {
+	const ns = "wake-grace-ns"
+	client, restore := withResolvers()
+	defer restore()
+
+	idleableDeployment(client, ns, "web", 1, map[string]string{WakeExpiresLabel: "true"})
+	client.CoreV1().Services(ns).Create(&coreAPI.Service{ObjectMeta: metaAPI.ObjectMeta{Namespace: ns, Name: "web"}})
+	// Kept up for a minute, but unidled 5 minutes ago
+	annotateDeployment(client, ns, "web", map[string]string{
+		UnidledAtAnnotation:     time.Now().UTC().Add(-5 * time.Minute).Format(IdledAtFormat),
+		WakeExpiresAtAnnotation: time.Now().UTC().Add(-4 * time.Minute).Format(IdledAtFormat),
+	})
+
+	expirer := NewWakeExpirer(time.Minute)
+	assert.Equal(t, 0, expirer.Run())
+	assert.Equal(t, int32(1), *getDeployment(ns, "web").Spec.Replicas)
+
+	annotateDeployment(client, ns, "web", map[string]string{UnidledAtAnnotation: time.Now().UTC().Add(-UnidleGracePeriod).Format(IdledAtFormat)})
+	assert.Equal(t, 1, expirer.Run())
+	assert.Equal(t, int32(0), *getDeployment(ns, "web").Spec.Replicas)
+}
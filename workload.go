@@ -0,0 +1,586 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	appsAPI "k8s.io/api/apps/v1"
+	autoscalingAPI "k8s.io/api/autoscaling/v1"
+	coreAPI "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+// Names of the native workload kinds, used in `WORKLOAD_KINDS`
+const (
+	WorkloadDeployments  = "deployments"
+	WorkloadStatefulSets = "statefulsets"
+)
+
+const DEFAULT_WORKLOAD_KINDS = WorkloadDeployments + "," + WorkloadStatefulSets
+
+// workloadKinds are the kinds of workloads the apps are looked up in, in
+// order, see WorkloadKindsFromEnv
+var workloadKinds = []WorkloadKind{&deploymentKind{}, &statefulSetKind{}}
+
+// Workload is the kubernetes resource running the app's pods: a Deployment, a
+// StatefulSet or a custom resource with a scale subresource (e.g. an Argo
+// Rollout). Its replicas are read and set through its scale subresource
+type Workload interface {
+	metaAPI.Object
+	// Reference is the reference to the workload, e.g. in its Events
+	Reference() *coreAPI.ObjectReference
+	// Selector is the selector of the workload's pods, nil if unknown
+	Selector() *metaAPI.LabelSelector
+	// Template is the template of the workload's pods, nil if unknown
+	Template() *coreAPI.PodTemplateSpec
+	// Replicas returns the desired number of replicas
+	Replicas() (int32, error)
+	// Scale sets the desired number of replicas
+	Scale(replicas int32) error
+	// PatchMetadata applies a merge patch of the workload's metadata
+	PatchMetadata(patch []byte) error
+	// ReplicasStatus returns the latest status of the replicas. The workload
+	// is ready when it has available replicas
+	ReplicasStatus() (*ReplicasStatus, error)
+	// Pods returns the pods of the workload
+	Pods() ([]coreAPI.Pod, error)
+}
+
+// WorkloadKind looks up the workloads of a kind
+type WorkloadKind interface {
+	// Name is the name of the WorkloadKind in the configuration
+	Name() string
+	// FindByLabel returns the workloads in the namespace with the label
+	FindByLabel(namespace string, label string, value string) ([]Workload, error)
+	// List returns the workloads in the namespace (all of them when empty)
+	// matching the label selector, with the kubernetes API
+	List(namespace string, selector string) ([]Workload, error)
+	// FindByName returns the workload with the namespace and name, or nil
+	FindByName(namespace string, name string) (Workload, error)
+}
+
+// workloadKind returns the kind of the workload, e.g. "StatefulSet"
+func workloadKind(w Workload) string {
+	return w.Reference().Kind
+}
+
+// WorkloadKindsFromEnv configures the kinds of workloads from the
+// comma-separated names in `WORKLOAD_KINDS`: `deployments`, `statefulsets` or
+// `<group>/<version>/<resource>` for custom resources, looked up with the given
+// REST client
+func WorkloadKindsFromEnv(client rest.Interface) ([]WorkloadKind, error) {
+	names, ok := os.LookupEnv("WORKLOAD_KINDS")
+	if !ok {
+		logger.Info("$WORKLOAD_KINDS not set. Defaulting to '%s'", DEFAULT_WORKLOAD_KINDS)
+		names = DEFAULT_WORKLOAD_KINDS
+	}
+
+	kinds := []WorkloadKind{}
+	for _, name := range strings.Split(names, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case WorkloadDeployments:
+			kinds = append(kinds, &deploymentKind{})
+		case WorkloadStatefulSets:
+			kinds = append(kinds, &statefulSetKind{})
+		default:
+			kind, err := NewScaleKind(client, name)
+			if err != nil {
+				return nil, err
+			}
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds, nil
+}
+
+// scaleClient is the scale subresource of the native workloads
+type scaleClient interface {
+	GetScale(name string, options metaAPI.GetOptions) (*autoscalingAPI.Scale, error)
+	UpdateScale(name string, scale *autoscalingAPI.Scale) (*autoscalingAPI.Scale, error)
+}
+
+func getScale(client scaleClient, resource string, name string) (*autoscalingAPI.Scale, error) {
+	start := time.Now()
+	scale, err := client.GetScale(name, metaAPI.GetOptions{})
+	observeKubernetesRequest("get", resource+"/scale", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting %s scale: %s", resource, err)
+	}
+	return scale, nil
+}
+
+func updateScale(client scaleClient, resource string, name string, replicas int32) error {
+	scale, err := getScale(client, resource, name)
+	if err != nil {
+		return err
+	}
+
+	scale.Spec.Replicas = replicas
+	start := time.Now()
+	_, err = client.UpdateScale(name, scale)
+	observeKubernetesRequest("update", resource+"/scale", start, err)
+	if err != nil {
+		return fmt.Errorf("failed updating %s scale: %s", resource, err)
+	}
+	return nil
+}
+
+// listPods returns the pods in the namespace matching the label selector
+func listPods(namespace string, selector string) ([]coreAPI.Pod, error) {
+	start := time.Now()
+	pods, err := k8sClient.CoreV1().Pods(namespace).List(metaAPI.ListOptions{
+		LabelSelector: selector,
+	})
+	observeKubernetesRequest("list", "pods", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing pods: %s", err)
+	}
+	return pods.Items, nil
+}
+
+// deploymentKind looks up the Deployments, in the cache when enabled
+type deploymentKind struct{}
+
+func (k *deploymentKind) Name() string {
+	return WorkloadDeployments
+}
+
+func (k *deploymentKind) FindByLabel(namespace string, label string, value string) ([]Workload, error) {
+	var items []appsAPI.Deployment
+	if cacheReady() {
+		inc(cacheLookups, "deployments", "hit")
+		items = appCache.DeploymentsByLabel(namespace, label, value)
+	} else {
+		return k.List(namespace, fmt.Sprintf("%s=%s", label, value))
+	}
+
+	workloads := []Workload{}
+	for _, item := range items {
+		dep := Deployment(item)
+		workloads = append(workloads, &dep)
+	}
+	return workloads, nil
+}
+
+func (k *deploymentKind) List(namespace string, selector string) ([]Workload, error) {
+	start := time.Now()
+	list, err := k8sClient.AppsV1().Deployments(namespace).List(metaAPI.ListOptions{LabelSelector: selector})
+	observeKubernetesRequest("list", "deployments", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing deployments: %s", err)
+	}
+
+	workloads := []Workload{}
+	for _, item := range list.Items {
+		dep := Deployment(item)
+		workloads = append(workloads, &dep)
+	}
+	return workloads, nil
+}
+
+func (k *deploymentKind) FindByName(namespace string, name string) (Workload, error) {
+	var found *appsAPI.Deployment
+	if cacheReady() {
+		found = appCache.Deployment(namespace, name)
+		inc(cacheLookups, "deployments", cacheResult(found != nil))
+	}
+	if found == nil {
+		start := time.Now()
+		var err error
+		found, err = k8sClient.AppsV1().Deployments(namespace).Get(name, metaAPI.GetOptions{})
+		observeKubernetesRequest("get", "deployments", start, err)
+		if errors.IsNotFound(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed getting deployment: %s", err)
+		}
+	}
+
+	if found == nil {
+		return nil, nil
+	}
+	dep := Deployment(*found)
+	return &dep, nil
+}
+
+func (d *Deployment) Reference() *coreAPI.ObjectReference {
+	return &coreAPI.ObjectReference{
+		APIVersion:      "apps/v1",
+		Kind:            "Deployment",
+		Namespace:       d.Namespace,
+		Name:            d.Name,
+		UID:             d.UID,
+		ResourceVersion: d.ResourceVersion,
+	}
+}
+
+func (d *Deployment) Selector() *metaAPI.LabelSelector {
+	return d.Spec.Selector
+}
+
+func (d *Deployment) Template() *coreAPI.PodTemplateSpec {
+	return &d.Spec.Template
+}
+
+func (d *Deployment) Replicas() (int32, error) {
+	scale, err := getScale(k8sClient.AppsV1().Deployments(d.Namespace), "deployments", d.Name)
+	if err != nil {
+		return 0, err
+	}
+	return scale.Spec.Replicas, nil
+}
+
+func (d *Deployment) Scale(replicas int32) error {
+	return updateScale(k8sClient.AppsV1().Deployments(d.Namespace), "deployments", d.Name, replicas)
+}
+
+func (d *Deployment) PatchMetadata(patch []byte) error {
+	return d.Patch(patch)
+}
+
+func (d *Deployment) ReplicasStatus() (*ReplicasStatus, error) {
+	latest, err := d.Get()
+	if err != nil {
+		return nil, err
+	}
+	return replicasStatus(latest), nil
+}
+
+// Pods returns the pods of the Deployment's current ReplicaSet
+func (d *Deployment) Pods() ([]coreAPI.Pod, error) {
+	latest, err := d.Get()
+	if err != nil {
+		return nil, err
+	}
+	return deploymentPods(latest)
+}
+
+// statefulSetKind looks up the StatefulSets with the kubernetes API
+type statefulSetKind struct{}
+
+func (k *statefulSetKind) Name() string {
+	return WorkloadStatefulSets
+}
+
+func (k *statefulSetKind) FindByLabel(namespace string, label string, value string) ([]Workload, error) {
+	return k.List(namespace, fmt.Sprintf("%s=%s", label, value))
+}
+
+func (k *statefulSetKind) List(namespace string, selector string) ([]Workload, error) {
+	start := time.Now()
+	list, err := k8sClient.AppsV1().StatefulSets(namespace).List(metaAPI.ListOptions{LabelSelector: selector})
+	observeKubernetesRequest("list", "statefulsets", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing statefulsets: %s", err)
+	}
+
+	workloads := []Workload{}
+	for _, item := range list.Items {
+		sts := StatefulSet(item)
+		workloads = append(workloads, &sts)
+	}
+	return workloads, nil
+}
+
+func (k *statefulSetKind) FindByName(namespace string, name string) (Workload, error) {
+	start := time.Now()
+	found, err := k8sClient.AppsV1().StatefulSets(namespace).Get(name, metaAPI.GetOptions{})
+	observeKubernetesRequest("get", "statefulsets", start, err)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed getting statefulset: %s", err)
+	}
+	sts := StatefulSet(*found)
+	return &sts, nil
+}
+
+func (s *StatefulSet) Reference() *coreAPI.ObjectReference {
+	return &coreAPI.ObjectReference{
+		APIVersion:      "apps/v1",
+		Kind:            "StatefulSet",
+		Namespace:       s.Namespace,
+		Name:            s.Name,
+		UID:             s.UID,
+		ResourceVersion: s.ResourceVersion,
+	}
+}
+
+func (s *StatefulSet) Selector() *metaAPI.LabelSelector {
+	return s.Spec.Selector
+}
+
+func (s *StatefulSet) Template() *coreAPI.PodTemplateSpec {
+	return &s.Spec.Template
+}
+
+func (s *StatefulSet) Replicas() (int32, error) {
+	scale, err := getScale(k8sClient.AppsV1().StatefulSets(s.Namespace), "statefulsets", s.Name)
+	if err != nil {
+		return 0, err
+	}
+	return scale.Spec.Replicas, nil
+}
+
+func (s *StatefulSet) Scale(replicas int32) error {
+	return updateScale(k8sClient.AppsV1().StatefulSets(s.Namespace), "statefulsets", s.Name, replicas)
+}
+
+func (s *StatefulSet) PatchMetadata(patch []byte) error {
+	start := time.Now()
+	_, err := k8sClient.AppsV1().StatefulSets(s.Namespace).Patch(s.Name, types.StrategicMergePatchType, patch)
+	observeKubernetesRequest("patch", "statefulsets", start, err)
+	if err != nil {
+		return fmt.Errorf("Patch on StatefulSet failed: %s", err)
+	}
+	return nil
+}
+
+// ReplicasStatus returns the status of the StatefulSet's replicas. Its ready
+// replicas are considered available, as StatefulSets don't report those
+func (s *StatefulSet) ReplicasStatus() (*ReplicasStatus, error) {
+	start := time.Now()
+	latest, err := k8sClient.AppsV1().StatefulSets(s.Namespace).Get(s.Name, metaAPI.GetOptions{})
+	observeKubernetesRequest("get", "statefulsets", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &ReplicasStatus{
+		Ready:     latest.Status.ReadyReplicas,
+		Available: latest.Status.ReadyReplicas,
+	}
+	if latest.Spec.Replicas != nil {
+		status.Desired = *latest.Spec.Replicas
+	}
+	return status, nil
+}
+
+// Pods returns the pods matching the StatefulSet's selector which it owns
+func (s *StatefulSet) Pods() ([]coreAPI.Pod, error) {
+	if s.Spec.Selector == nil {
+		return nil, nil
+	}
+	selector, err := metaAPI.LabelSelectorAsSelector(s.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid StatefulSet selector: %s", err)
+	}
+
+	pods, err := listPods(s.Namespace, selector.String())
+	if err != nil {
+		return nil, err
+	}
+	owned := []coreAPI.Pod{}
+	for _, pod := range pods {
+		if owner := metaAPI.GetControllerOf(&pod); owner != nil && owner.UID == s.UID {
+			owned = append(owned, pod)
+		}
+	}
+	return owned, nil
+}
+
+// scaleKind looks up the custom resources of a kind with a scale subresource
+// (e.g. Argo Rollouts) with the REST client
+type scaleKind struct {
+	groupVersion string
+	resource     string
+	client       rest.Interface
+}
+
+// NewScaleKind constructs a new scaleKind for `<group>/<version>/<resource>`,
+// e.g. `argoproj.io/v1alpha1/rollouts`
+func NewScaleKind(client rest.Interface, kind string) (*scaleKind, error) {
+	parts := strings.Split(kind, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("invalid workload kind '%s' in $WORKLOAD_KINDS, expected '%s', '%s' or '<group>/<version>/<resource>'", kind, WorkloadDeployments, WorkloadStatefulSets)
+	}
+	return &scaleKind{groupVersion: parts[0] + "/" + parts[1], resource: parts[2], client: client}, nil
+}
+
+func (k *scaleKind) Name() string {
+	return k.groupVersion + "/" + k.resource
+}
+
+// path returns the API path of the resources in the namespace (in all the
+// namespaces when empty), followed by the given elements (name, subresource)
+func (k *scaleKind) path(namespace string, elements ...string) string {
+	if namespace == "" {
+		return strings.Join(append([]string{fmt.Sprintf("/apis/%s/%s", k.groupVersion, k.resource)}, elements...), "/")
+	}
+	return strings.Join(append([]string{fmt.Sprintf("/apis/%s/namespaces/%s/%s", k.groupVersion, namespace, k.resource)}, elements...), "/")
+}
+
+func (k *scaleKind) FindByLabel(namespace string, label string, value string) ([]Workload, error) {
+	return k.List(namespace, fmt.Sprintf("%s=%s", label, value))
+}
+
+func (k *scaleKind) List(namespace string, selector string) ([]Workload, error) {
+	start := time.Now()
+	body, err := k.client.Get().AbsPath(k.path(namespace)).Param("labelSelector", selector).DoRaw()
+	observeKubernetesRequest("list", k.resource, start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing %s: %s", k.resource, err)
+	}
+
+	list := &struct {
+		Items []ScaledResource `json:"items"`
+	}{}
+	err = json.Unmarshal(body, list)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding %s: %s", k.resource, err)
+	}
+	workloads := []Workload{}
+	for i := range list.Items {
+		list.Items[i].kind = k
+		workloads = append(workloads, &list.Items[i])
+	}
+	return workloads, nil
+}
+
+func (k *scaleKind) FindByName(namespace string, name string) (Workload, error) {
+	start := time.Now()
+	body, err := k.client.Get().AbsPath(k.path(namespace, name)).DoRaw()
+	observeKubernetesRequest("get", k.resource, start, err)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed getting %s: %s", k.resource, err)
+	}
+
+	found := &ScaledResource{kind: k}
+	err = json.Unmarshal(body, found)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding %s: %s", k.resource, err)
+	}
+	return found, nil
+}
+
+// ScaledResource is a custom resource with a scale subresource. Its pods'
+// selector and template are read from the usual `spec.selector` and
+// `spec.template` fields, when it has them
+type ScaledResource struct {
+	metaAPI.TypeMeta   `json:",inline"`
+	metaAPI.ObjectMeta `json:"metadata"`
+	Spec               struct {
+		Selector *metaAPI.LabelSelector   `json:"selector"`
+		Template *coreAPI.PodTemplateSpec `json:"template"`
+	} `json:"spec"`
+
+	kind *scaleKind
+}
+
+func (r *ScaledResource) Reference() *coreAPI.ObjectReference {
+	apiVersion := r.APIVersion
+	if apiVersion == "" {
+		apiVersion = r.kind.groupVersion
+	}
+	return &coreAPI.ObjectReference{
+		APIVersion:      apiVersion,
+		Kind:            r.Kind,
+		Namespace:       r.Namespace,
+		Name:            r.Name,
+		UID:             r.UID,
+		ResourceVersion: r.ResourceVersion,
+	}
+}
+
+func (r *ScaledResource) Selector() *metaAPI.LabelSelector {
+	return r.Spec.Selector
+}
+
+func (r *ScaledResource) Template() *coreAPI.PodTemplateSpec {
+	return r.Spec.Template
+}
+
+// scale gets the scale subresource of the custom resource
+func (r *ScaledResource) scale() (*autoscalingAPI.Scale, error) {
+	start := time.Now()
+	body, err := r.kind.client.Get().AbsPath(r.kind.path(r.Namespace, r.Name, "scale")).DoRaw()
+	observeKubernetesRequest("get", r.kind.resource+"/scale", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting %s scale: %s", r.kind.resource, err)
+	}
+
+	scale := &autoscalingAPI.Scale{}
+	err = json.Unmarshal(body, scale)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding %s scale: %s", r.kind.resource, err)
+	}
+	return scale, nil
+}
+
+func (r *ScaledResource) Replicas() (int32, error) {
+	scale, err := r.scale()
+	if err != nil {
+		return 0, err
+	}
+	return scale.Spec.Replicas, nil
+}
+
+// Scale sets the replicas with a merge patch of the scale subresource, as
+// custom resources don't support strategic merge patches
+func (r *ScaledResource) Scale(replicas int32) error {
+	patch := fmt.Sprintf(`{"spec": {"replicas": %d}}`, replicas)
+	start := time.Now()
+	err := r.kind.client.Patch(types.MergePatchType).AbsPath(r.kind.path(r.Namespace, r.Name, "scale")).Body([]byte(patch)).Do().Error()
+	observeKubernetesRequest("patch", r.kind.resource+"/scale", start, err)
+	if err != nil {
+		return fmt.Errorf("failed patching %s scale: %s", r.kind.resource, err)
+	}
+	return nil
+}
+
+func (r *ScaledResource) PatchMetadata(patch []byte) error {
+	start := time.Now()
+	err := r.kind.client.Patch(types.MergePatchType).AbsPath(r.kind.path(r.Namespace, r.Name)).Body(patch).Do().Error()
+	observeKubernetesRequest("patch", r.kind.resource, start, err)
+	if err != nil {
+		return fmt.Errorf("Patch on %s failed: %s", r.Kind, err)
+	}
+	return nil
+}
+
+// ReplicasStatus returns the status of the custom resource's replicas. As
+// their status is specific to each custom resource, the ready replicas are
+// the ready pods matching the selector of its scale subresource
+func (r *ScaledResource) ReplicasStatus() (*ReplicasStatus, error) {
+	scale, err := r.scale()
+	if err != nil {
+		return nil, err
+	}
+	pods, err := r.scalePods(scale)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &ReplicasStatus{Desired: scale.Spec.Replicas}
+	for i := range pods {
+		if podConditionTime(&pods[i], coreAPI.PodReady) != nil {
+			status.Ready++
+		}
+	}
+	status.Available = status.Ready
+	return status, nil
+}
+
+// Pods returns the pods matching the selector of the scale subresource
+func (r *ScaledResource) Pods() ([]coreAPI.Pod, error) {
+	scale, err := r.scale()
+	if err != nil {
+		return nil, err
+	}
+	return r.scalePods(scale)
+}
+
+func (r *ScaledResource) scalePods(scale *autoscalingAPI.Scale) ([]coreAPI.Pod, error) {
+	if scale.Status.Selector == "" {
+		return nil, nil
+	}
+	return listPods(r.Namespace, scale.Status.Selector)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	appsAPI "k8s.io/api/apps/v1"
+	autoscalingAPI "k8s.io/api/autoscaling/v1"
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8sFake "k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+// fakeScale makes the fake clientset serve the scale subresource of the
+// Deployments and StatefulSets, from and to their replicas, which it doesn't
+// do by itself
+func fakeScale(client *k8sFake.Clientset) {
+	// The last reactor is the one serving the objects
+	objects := client.ReactionChain[len(client.ReactionChain)-1]
+
+	client.PrependReactor("get", "*", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		name := action.(k8sTesting.GetAction).GetName()
+		_, obj, err := objects.React(k8sTesting.NewGetAction(action.GetResource(), action.GetNamespace(), name))
+		if err != nil {
+			return true, nil, err
+		}
+
+		scale := &autoscalingAPI.Scale{ObjectMeta: metaAPI.ObjectMeta{Namespace: action.GetNamespace(), Name: name}}
+		switch obj := obj.(type) {
+		case *appsAPI.Deployment:
+			scale.Spec.Replicas = *obj.Spec.Replicas
+			scale.Status.Replicas = obj.Status.Replicas
+		case *appsAPI.StatefulSet:
+			scale.Spec.Replicas = *obj.Spec.Replicas
+			scale.Status.Replicas = obj.Status.Replicas
+		}
+		return true, scale, nil
+	})
+
+	client.PrependReactor("update", "*", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		scale := action.(k8sTesting.UpdateAction).GetObject().(*autoscalingAPI.Scale)
+		patch := fmt.Sprintf(`{"spec": {"replicas": %d}}`, scale.Spec.Replicas)
+		_, _, err := objects.React(k8sTesting.NewPatchAction(action.GetResource(), action.GetNamespace(), scale.Name, types.StrategicMergePatchType, []byte(patch)))
+		return true, scale, err
+	})
+}
+
+// withWorkloadKinds swaps the kinds of workloads for the given ones
+func withWorkloadKinds(kinds ...WorkloadKind) func() {
+	previous := workloadKinds
+	workloadKinds = kinds
+	return func() {
+		workloadKinds = previous
+	}
+}
+
+func readyPod(ns string, name string, labels map[string]string, owners ...metaAPI.OwnerReference) *coreAPI.Pod {
+	return &coreAPI.Pod{
+		ObjectMeta: metaAPI.ObjectMeta{Namespace: ns, Name: name, Labels: labels, OwnerReferences: owners},
+		Status: coreAPI.PodStatus{Conditions: []coreAPI.PodCondition{
+			{Type: coreAPI.PodReady, Status: coreAPI.ConditionTrue},
+		}},
+	}
+}
+
+func TestStatefulSetWorkload(t *testing.T) {
+	const host = "db.example.com"
+	const ns = "db-ns"
+	labels := map[string]string{UnidleKeyLabel: unidleKey(host)}
+	client, restore := withResolvers(&labelResolver{})
+	defer restore()
+	mockApp(client, ns, "db", host, "/", labels)
+	client.AppsV1().Deployments(ns).Delete("db", nil)
+
+	_, err := NewApp(host, "/", logger, nil)
+	assert.Equal(t, "Workload for your app not found.", err.Error())
+
+	replicas := int32(0)
+	client.AppsV1().StatefulSets(ns).Create(&appsAPI.StatefulSet{
+		ObjectMeta: metaAPI.ObjectMeta{
+			Namespace:   ns,
+			Name:        "db",
+			UID:         "db-uid",
+			Labels:      labels,
+			Annotations: map[string]string{ReplicasWhenUnidledAnnotation: "2"},
+		},
+		Spec: appsAPI.StatefulSetSpec{
+			Replicas: &replicas,
+			Selector: &metaAPI.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+		},
+	})
+
+	a, err := NewApp(host, "/", logger, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "StatefulSet", workloadKind(a.workload))
+
+	assert.Nil(t, a.SetReplicas())
+	latest, _ := client.AppsV1().StatefulSets(ns).Get("db", metaAPI.GetOptions{})
+	assert.Equal(t, int32(2), *latest.Spec.Replicas)
+
+	// Only the pods the StatefulSet owns are its pods
+	controller := true
+	client.CoreV1().Pods(ns).Create(readyPod(ns, "db-0", map[string]string{"app": "db"}, metaAPI.OwnerReference{
+		Kind: "StatefulSet", Name: "db", UID: "db-uid", Controller: &controller,
+	}))
+	client.CoreV1().Pods(ns).Create(readyPod(ns, "other", map[string]string{"app": "db"}))
+	pods, err := a.workload.Pods()
+	assert.Nil(t, err)
+	if assert.Len(t, pods, 1) {
+		assert.Equal(t, "db-0", pods[0].Name)
+	}
+
+	latest.Status.ReadyReplicas = 1
+	client.AppsV1().StatefulSets(ns).UpdateStatus(latest)
+	assert.Nil(t, a.WaitForWorkload(func(*Update) {}))
+}
+
+func TestScaledResourceWorkload(t *testing.T) {
+	const host = "notebook.example.com"
+	const ns = "rollout-ns"
+	labels := map[string]string{UnidleKeyLabel: unidleKey(host)}
+	client, restore := withResolvers(&labelResolver{})
+	defer restore()
+	mockApp(client, ns, "notebook", host, "/", labels)
+	client.AppsV1().Deployments(ns).Delete("notebook", nil)
+
+	rollout := `{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind": "Rollout",
+		"metadata": {"namespace": "rollout-ns", "name": "notebook", "labels": {"unidle-key": "notebook"}},
+		"spec": {
+			"selector": {"matchLabels": {"app": "notebook"}},
+			"template": {"spec": {"containers": [{"name": "notebook", "ports": [{"containerPort": 8888}]}]}}
+		}
+	}`
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests = append(requests, strings.TrimSpace(fmt.Sprintf("%s %s %s %s", req.Method, req.URL.Path, req.Header.Get("Content-Type"), body)))
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/scale"):
+			w.Write([]byte(`{"spec": {"replicas": 0}, "status": {"replicas": 0, "selector": "app=notebook"}}`))
+		case req.URL.Path == "/apis/argoproj.io/v1alpha1/namespaces/rollout-ns/rollouts":
+			assert.Equal(t, "unidle-key=notebook", req.URL.Query().Get("labelSelector"))
+			w.Write([]byte(`{"items": [` + rollout + `]}`))
+		default:
+			w.Write([]byte(rollout))
+		}
+	}))
+	defer server.Close()
+	kind, err := NewScaleKind(restClientFor(t, server), "argoproj.io/v1alpha1/rollouts")
+	assert.Nil(t, err)
+	defer withWorkloadKinds(&deploymentKind{}, kind)()
+
+	a, err := NewApp(host, "/", logger, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, &coreAPI.ObjectReference{APIVersion: "argoproj.io/v1alpha1", Kind: "Rollout", Namespace: ns, Name: "notebook"}, a.workload.Reference())
+
+	// Replicas are read and set through the scale subresource
+	assert.Nil(t, a.SetReplicas())
+	assert.Contains(t, requests, `PATCH /apis/argoproj.io/v1alpha1/namespaces/rollout-ns/rollouts/notebook/scale application/merge-patch+json {"spec": {"replicas": 1}}`)
+
+	// The Service spec is inferred from the pods' template
+	spec := inferServiceSpec(a.workload, a.service, nil)
+	assert.Equal(t, map[string]string{"app": "notebook"}, spec.Selector)
+	assert.Equal(t, int32(8888), spec.Ports[0].Port)
+
+	// It's ready once the pods matching the scale selector are
+	client.CoreV1().Pods(ns).Create(readyPod(ns, "notebook-abc", map[string]string{"app": "notebook"}))
+	status, err := a.workload.ReplicasStatus()
+	assert.Nil(t, err)
+	assert.Equal(t, &ReplicasStatus{Desired: 0, Ready: 1, Available: 1}, status)
+	assert.Nil(t, a.WaitForWorkload(func(*Update) {}))
+
+	assert.Nil(t, a.RemoveIdledMetadata("test-request-id"))
+	assert.Contains(t, requests[len(requests)-1], "PATCH /apis/argoproj.io/v1alpha1/namespaces/rollout-ns/rollouts/notebook application/merge-patch+json")
+}
+
+func TestWorkloadKindsFromEnv(t *testing.T) {
+	defer os.Unsetenv("WORKLOAD_KINDS")
+
+	kinds, err := WorkloadKindsFromEnv(nil)
+	assert.Nil(t, err)
+	if assert.Len(t, kinds, 2) {
+		assert.Equal(t, WorkloadDeployments, kinds[0].Name())
+		assert.Equal(t, WorkloadStatefulSets, kinds[1].Name())
+	}
+
+	os.Setenv("WORKLOAD_KINDS", "statefulsets, argoproj.io/v1alpha1/rollouts")
+	kinds, err = WorkloadKindsFromEnv(nil)
+	assert.Nil(t, err)
+	if assert.Len(t, kinds, 2) {
+		assert.Equal(t, "argoproj.io/v1alpha1/rollouts", kinds[1].Name())
+	}
+
+	os.Setenv("WORKLOAD_KINDS", "deployments,rollouts")
+	_, err = WorkloadKindsFromEnv(nil)
+	assert.Contains(t, err.Error(), "invalid workload kind 'rollouts'")
+}